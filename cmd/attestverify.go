@@ -0,0 +1,180 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/kairos-io/go-ukify/pkg/attest"
+	"github.com/kairos-io/go-ukify/pkg/measure"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/spf13/cobra"
+)
+
+var attestVerifyCmd = &cobra.Command{
+	Use:   "attest-verify",
+	Short: "Verify a TPM2 quote against the PCR 11 value predicted for a UKI",
+	Long: "Check the signature and nonce of a TPM2 quote, and that the quoted PCRs match the PCR 11 value " +
+		"predicted for a UKI, its section files or a prediction json from 'measure calculate --json', at the given phase. " +
+		"The quote is either the TPMS_ATTEST and TPMT_SIGNATURE files written by tpm2_quote, or a single blob " +
+		"with a TPM2B_ATTEST followed by the TPMT_SIGNATURE.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		quotePath, _ := flags.GetString("quote")
+		signaturePath, _ := flags.GetString("signature")
+		akPath, _ := flags.GetString("ak")
+		nonceHex, _ := flags.GetString("nonce")
+		predictionPath, _ := flags.GetString("prediction")
+		phase, _ := flags.GetString("phase")
+		policyPCRs, _ := flags.GetStringArray("policy-pcr")
+		skipNonce, _ := flags.GetBool("insecure-skip-nonce")
+
+		if debug, _ := flags.GetBool("debug"); debug {
+			slog.SetLogLoggerLevel(slog.LevelDebug)
+		}
+
+		quoteData, err := os.ReadFile(quotePath)
+		if err != nil {
+			return err
+		}
+
+		var quote *attest.Quote
+		if signaturePath != "" {
+			signature, err := os.ReadFile(signaturePath)
+			if err != nil {
+				return err
+			}
+			quote, err = attest.ParseQuote(quoteData, signature)
+			if err != nil {
+				return err
+			}
+		} else if quote, err = attest.ParseQuoteBlob(quoteData); err != nil {
+			return err
+		}
+
+		key, err := attest.ReadPublicKey(akPath)
+		if err != nil {
+			return err
+		}
+
+		nonce, err := hex.DecodeString(nonceHex)
+		if err != nil {
+			return fmt.Errorf("invalid nonce: %w", err)
+		}
+
+		var extra []types.PolicyPCR
+		for _, value := range policyPCRs {
+			parsed, err := types.ParsePolicyPCR(value)
+			if err != nil {
+				return err
+			}
+			extra = append(extra, parsed)
+		}
+
+		// predict returns the expected PCR values at a phase path, and the candidate phase paths to diagnose a mismatch
+		var predict func(phase string) (attest.PCRValues, error)
+		var candidates []string
+
+		if predictionPath != "" {
+			data, err := os.ReadFile(predictionPath)
+			if err != nil {
+				return err
+			}
+			calculation := measure.Calculation{}
+			if err = json.Unmarshal(data, &calculation); err != nil {
+				return fmt.Errorf("failed parsing %s: %w", predictionPath, err)
+			}
+			predict = func(phase string) (attest.PCRValues, error) {
+				return attest.PredictFromCalculation(calculation, phase)
+			}
+			for _, entries := range calculation {
+				for _, entry := range entries {
+					candidates = append(candidates, entry.Phase)
+				}
+				break
+			}
+		} else {
+			sections, err := loadSections(flags)
+			if err != nil {
+				return err
+			}
+			predict = func(phase string) (attest.PCRValues, error) {
+				var phases []types.PhaseInfo
+				if phase != "" {
+					var err error
+					if phases, err = types.ParsePhases(phase); err != nil {
+						return nil, err
+					}
+				}
+				return attest.PredictUKI(sections, phases, quote.QuotedBanks())
+			}
+			path := knownPhasePath()
+			for i := range len(path) + 1 {
+				candidates = append(candidates, types.PhasesToString(path[:i]))
+			}
+		}
+
+		values, err := predict(phase)
+		if err != nil {
+			return err
+		}
+		if err = values.AddPolicyPCRs(extra, quote.QuotedBanks()); err != nil {
+			return err
+		}
+
+		cmd.SilenceUsage = true
+		if skipNonce {
+			slog.Warn("Not checking the quote nonce, a replayed quote passes")
+			err = quote.VerifyWithoutNonce(key, values)
+		} else {
+			err = quote.Verify(key, nonce, values)
+		}
+		if err == nil {
+			fmt.Printf("Quote verified: the device booted the expected UKI and is at phase %q\n", phase)
+			return nil
+		}
+
+		if !errors.Is(err, attest.ErrPCRDigest) {
+			return err
+		}
+
+		// Tell apart a device that booted the expected UKI but is at another phase from one that didn't
+		for _, candidate := range candidates {
+			if candidate == phase {
+				continue
+			}
+			other, perr := predict(candidate)
+			if perr != nil || other.AddPolicyPCRs(extra, quote.QuotedBanks()) != nil {
+				continue
+			}
+			if quote.VerifyPCRs(other) == nil {
+				return fmt.Errorf("%w: the device booted the expected UKI but is at phase %q", err, candidate)
+			}
+		}
+
+		return fmt.Errorf("%w: the device didn't boot the expected UKI", err)
+	},
+}
+
+func init() {
+	attestVerifyCmd.Flags().String("quote", "", "Quote to verify, the TPMS_ATTEST if --signature is given, or a blob with both.")
+	attestVerifyCmd.Flags().String("signature", "", "TPMT_SIGNATURE of the quote.")
+	attestVerifyCmd.Flags().String("ak", "", "Public part of the attestation key, PEM, DER or TPM2B_PUBLIC.")
+	attestVerifyCmd.Flags().String("nonce", "", "Expected nonce, hex encoded.")
+	attestVerifyCmd.Flags().Bool("insecure-skip-nonce", false, "Don't check the nonce, for quotes taken without one. A replayed quote passes.")
+	attestVerifyCmd.Flags().String("prediction", "", "Prediction json, as output by 'measure calculate --json'.")
+	addSectionFlags(attestVerifyCmd.Flags())
+	attestVerifyCmd.Flags().String("uki", "", "UKI to take the measured sections from.")
+	attestVerifyCmd.Flags().String("phase", "enter-initrd:leave-initrd:sysinit:ready", "Phase path the device is expected to be at, separated by :.")
+	attestVerifyCmd.Flags().StringArray("policy-pcr", []string{}, "Value of another quoted PCR, in the INDEX[:BANK=HEX,...] form. Can be repeated.")
+	attestVerifyCmd.Flags().Bool("debug", false, "Enable debug output")
+	_ = attestVerifyCmd.MarkFlagRequired("quote")
+	_ = attestVerifyCmd.MarkFlagRequired("ak")
+	attestVerifyCmd.MarkFlagsOneRequired("nonce", "insecure-skip-nonce")
+	attestVerifyCmd.MarkFlagsMutuallyExclusive("nonce", "insecure-skip-nonce")
+
+	rootCmd.AddCommand(attestVerifyCmd)
+}
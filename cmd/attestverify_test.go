@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/measure"
+	"github.com/kairos-io/go-ukify/pkg/measure/pcr"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Cmd test Suite")
+}
+
+// run executes ukify with the given args, resetting the flags the previous run set
+func run(args ...string) error {
+	resetFlags(rootCmd)
+
+	rootCmd.SetOut(GinkgoWriter)
+	rootCmd.SetErr(GinkgoWriter)
+	rootCmd.SetArgs(args)
+	_, err := rootCmd.ExecuteC()
+	return err
+}
+
+// resetFlags resets the flags changed by a previous run of cmd and its subcommands
+func resetFlags(cmd *cobra.Command) {
+	for _, sub := range cmd.Commands() {
+		sub.Flags().VisitAll(func(flag *pflag.Flag) {
+			if !flag.Changed {
+				return
+			}
+			if value, ok := flag.Value.(pflag.SliceValue); ok {
+				_ = value.Replace(nil)
+			} else {
+				_ = flag.Value.Set(flag.DefValue)
+			}
+			flag.Changed = false
+		})
+		resetFlags(sub)
+	}
+}
+
+var _ = Describe("attest-verify", func() {
+	var dir string
+	var args []string
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).ToNot(HaveOccurred())
+
+		// a quote of PCR 11, with nonce
+		value := sha256.Sum256([]byte("pcr 11"))
+		selector, err := pcr.CreateSelector([]int{constants.UKIPCR})
+		Expect(err).ToNot(HaveOccurred())
+		composite := sha256.Sum256(value[:])
+		attest := tpm2.Marshal(tpm2.TPMSAttest{
+			Magic:     tpm2.TPMGeneratedValue,
+			Type:      tpm2.TPMSTAttestQuote,
+			ExtraData: tpm2.TPM2BData{Buffer: []byte("nonce")},
+			Attested: tpm2.NewTPMUAttest(tpm2.TPMSTAttestQuote, &tpm2.TPMSQuoteInfo{
+				PCRSelect: tpm2.TPMLPCRSelection{PCRSelections: []tpm2.TPMSPCRSelection{
+					{Hash: tpm2.TPMAlgSHA256, PCRSelect: selector},
+				}},
+				PCRDigest: tpm2.TPM2BDigest{Buffer: composite[:]},
+			}),
+		})
+		digest := sha256.Sum256(attest)
+		sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+		Expect(err).ToNot(HaveOccurred())
+		signature := tpm2.Marshal(tpm2.TPMTSignature{
+			SigAlg: tpm2.TPMAlgRSASSA,
+			Signature: tpm2.NewTPMUSignature(tpm2.TPMAlgRSASSA, &tpm2.TPMSSignatureRSA{
+				Hash: tpm2.TPMAlgSHA256,
+				Sig:  tpm2.TPM2BPublicKeyRSA{Buffer: sig},
+			}),
+		})
+
+		public, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		Expect(err).ToNot(HaveOccurred())
+		prediction, err := json.Marshal(measure.Calculation{
+			"sha256": {{Phase: "enter-initrd", PCR: constants.UKIPCR, Hash: hex.EncodeToString(value[:])}},
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		for name, data := range map[string][]byte{
+			"quote":           attest,
+			"signature":       signature,
+			"ak.pem":          pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public}),
+			"prediction.json": prediction,
+		} {
+			Expect(os.WriteFile(filepath.Join(dir, name), data, 0o600)).To(Succeed())
+		}
+
+		args = []string{"attest-verify",
+			"--quote", filepath.Join(dir, "quote"),
+			"--signature", filepath.Join(dir, "signature"),
+			"--ak", filepath.Join(dir, "ak.pem"),
+			"--prediction", filepath.Join(dir, "prediction.json"),
+			"--phase", "enter-initrd",
+		}
+	})
+
+	It("Verifies a quote with the expected nonce", func() {
+		Expect(run(append(args, "--nonce", hex.EncodeToString([]byte("nonce")))...)).To(Succeed())
+	})
+
+	It("Rejects a quote with another nonce", func() {
+		err := run(append(args, "--nonce", hex.EncodeToString([]byte("other")))...)
+		Expect(err).To(MatchError(ContainSubstring("quote nonce doesn't match")))
+	})
+
+	It("Requires a nonce unless skipping the check explicitly", func() {
+		Expect(run(args...)).To(MatchError(ContainSubstring("nonce")))
+		Expect(run(append(args, "--insecure-skip-nonce")...)).To(Succeed())
+		Expect(run(append(args, "--insecure-skip-nonce", "--nonce", hex.EncodeToString([]byte("nonce")))...)).ToNot(Succeed())
+	})
+})
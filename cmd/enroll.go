@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"crypto/x509"
+	"log/slog"
+
+	"github.com/foxboron/go-uefi/efi/util"
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+	"github.com/kairos-io/go-ukify/pkg/secureboot"
+	"github.com/spf13/cobra"
+)
+
+var enrollKeysCmd = &cobra.Command{
+	Use:   "enroll-keys",
+	Short: "Generate sd-boot SecureBoot auto-enrollment files",
+	Long: "Generate the signed PK, KEK and db variables that systemd-boot enrolls from " +
+		"loader/keys/<name>/ on the ESP. The PK is self-signed, the KEK is signed with the PK " +
+		"and db is signed with the KEK.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		pkCert, _ := flags.GetString("pk-cert")
+		pkKey, _ := flags.GetString("pk-key")
+		kekCert, _ := flags.GetString("kek-cert")
+		kekKey, _ := flags.GetString("kek-key")
+		dbCerts, _ := flags.GetStringSlice("db-cert")
+		ownerGUID, _ := flags.GetString("owner-guid")
+		outputDir, _ := flags.GetString("output-dir")
+		name, _ := flags.GetString("name")
+		force, _ := flags.GetBool("force")
+
+		if debug, _ := flags.GetBool("debug"); debug {
+			slog.SetLogLoggerLevel(slog.LevelDebug)
+		}
+
+		var owner util.EFIGUID
+		var err error
+		if ownerGUID != "" {
+			owner, err = secureboot.ParseOwnerGUID(ownerGUID)
+		} else {
+			owner, err = secureboot.NewOwnerGUID()
+		}
+		if err != nil {
+			return err
+		}
+		slog.Info("Using signature owner", "guid", owner.Format())
+
+		pk, err := pesign.NewSecureBootSigner(pkCert, pkKey)
+		if err != nil {
+			return err
+		}
+
+		kek, err := pesign.NewSecureBootSigner(kekCert, kekKey)
+		if err != nil {
+			return err
+		}
+
+		var db []*x509.Certificate
+		for _, path := range dbCerts {
+			certs, err := secureboot.ReadCertificates(path)
+			if err != nil {
+				return err
+			}
+			for _, cert := range certs {
+				slog.Info("Adding certificate to db", "subject", cert.Subject.String(), "path", path)
+			}
+			db = append(db, certs...)
+		}
+
+		enrollment := &secureboot.Enrollment{
+			Owner: owner,
+			PK:    pk,
+			KEK:   kek,
+			DB:    db,
+		}
+
+		files, err := enrollment.Generate()
+		if err != nil {
+			return err
+		}
+
+		dir, err := files.Write(outputDir, name, force)
+		if err != nil {
+			return err
+		}
+
+		slog.Info("Wrote enrollment files", "dir", dir)
+		return nil
+	},
+}
+
+func init() {
+	enrollKeysCmd.Flags().String("pk-cert", "", "Platform key certificate.")
+	enrollKeysCmd.Flags().String("pk-key", "", "Platform key private key.")
+	enrollKeysCmd.Flags().String("kek-cert", "", "Key exchange key certificate.")
+	enrollKeysCmd.Flags().String("kek-key", "", "Key exchange key private key.")
+	enrollKeysCmd.Flags().StringSlice("db-cert", []string{}, "Certificate to add to db, PEM or DER. Can be repeated to add vendor certificates.")
+	enrollKeysCmd.Flags().String("owner-guid", "", "Owner GUID of the signature entries. A random one is generated if not given.")
+	enrollKeysCmd.Flags().StringP("output-dir", "o", ".", "Root of the ESP to write the loader/keys structure into.")
+	enrollKeysCmd.Flags().String("name", "auto", "Name of the key set, sd-boot only auto-enrolls the one named auto.")
+	enrollKeysCmd.Flags().Bool("force", false, "Overwrite existing files.")
+	enrollKeysCmd.Flags().Bool("debug", false, "Enable debug output")
+
+	_ = enrollKeysCmd.MarkFlagRequired("pk-cert")
+	_ = enrollKeysCmd.MarkFlagRequired("pk-key")
+	_ = enrollKeysCmd.MarkFlagRequired("kek-cert")
+	_ = enrollKeysCmd.MarkFlagRequired("kek-key")
+	_ = enrollKeysCmd.MarkFlagRequired("db-cert")
+
+	rootCmd.AddCommand(enrollKeysCmd)
+}
@@ -0,0 +1,192 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/eventlog"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/spf13/cobra"
+)
+
+var eventLogCmd = &cobra.Command{
+	Use:   "eventlog",
+	Short: "Inspect TPM event logs",
+}
+
+var eventLogShowCmd = &cobra.Command{
+	Use:   "show LOG",
+	Short: "Show the PCR 11 and 12 events of a saved event log",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if debug, _ := cmd.Flags().GetBool("debug"); debug {
+			slog.SetLogLoggerLevel(slog.LevelDebug)
+		}
+
+		log, err := eventlog.ReadFile(args[0])
+		if err != nil {
+			return err
+		}
+
+		for _, event := range log.PCREvents(constants.UKIPCR, constants.KernelConfigPCR) {
+			fmt.Printf("%d: PCR %d type 0x%x %q\n", event.Index, event.PCR, event.Type, event.Description())
+			for _, alg := range log.Algorithms {
+				if digest, ok := event.Digests[alg.ID]; ok {
+					fmt.Printf("  %s=%s\n", types.BankName(alg.ID), hex.EncodeToString(digest))
+				}
+			}
+		}
+		return nil
+	},
+}
+
+var eventLogCompareCmd = &cobra.Command{
+	Use:   "compare LOG",
+	Short: "Compare the PCR 11 and 12 events of a saved event log with the ones expected for a UKI",
+	Long: "Line up the events systemd-stub and systemd-pcrphase measured into PCR 11 and 12 with the ones " +
+		"expected for the sections of a UKI, or the given section files, and report every event that diverges. " +
+		"The log is usually a copy of /sys/kernel/security/tpm0/binary_bios_measurements.",
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		phase, _ := flags.GetString("phase")
+		verbose, _ := flags.GetBool("verbose")
+
+		if debug, _ := flags.GetBool("debug"); debug {
+			slog.SetLogLoggerLevel(slog.LevelDebug)
+		}
+
+		log, err := eventlog.ReadFile(args[0])
+		if err != nil {
+			return err
+		}
+
+		sections, err := loadSections(flags)
+		if err != nil {
+			return err
+		}
+
+		// The firmware log usually ends before any phase is measured, so those are only reported if they differ
+		phases := knownPhasePath()
+		if flags.Changed("phase") {
+			phases = nil
+			if phase != "" {
+				if phases, err = types.ParsePhases(phase); err != nil {
+					return err
+				}
+			}
+		}
+
+		expected, err := eventlog.ExpectedUKIEvents(sections, phases, nil)
+		if err != nil {
+			return err
+		}
+
+		diverged := 0
+		for _, result := range eventlog.Compare(log, expected) {
+			if result.Diverges() {
+				diverged++
+			}
+			if result.Diverges() || verbose {
+				fmt.Println(result)
+			}
+		}
+
+		if diverged > 0 {
+			cmd.SilenceUsage = true
+			return fmt.Errorf("%d events diverge from the expected ones", diverged)
+		}
+
+		fmt.Println("All events match")
+		return nil
+	},
+}
+
+var eventLogGenerateCmd = &cobra.Command{
+	Use:   "generate",
+	Short: "Generate a synthetic event log for a UKI boot",
+	Long: "Generate a binary TCG2 crypto-agile event log with the PCR 11 events systemd-stub and systemd-pcrphase " +
+		"would record when booting a UKI, or the given section files. Useful as a fixture to test attestation verifiers.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		phase, _ := flags.GetString("phase")
+		bankNames, _ := flags.GetStringSlice("pcr-banks")
+		output, _ := flags.GetString("output")
+
+		if debug, _ := flags.GetBool("debug"); debug {
+			slog.SetLogLoggerLevel(slog.LevelDebug)
+		}
+
+		sections, err := loadSections(flags)
+		if err != nil {
+			return err
+		}
+
+		banks, err := types.ParsePCRBanks(bankNames)
+		if err != nil {
+			return err
+		}
+
+		var phases []types.PhaseInfo
+		if phase != "" {
+			if phases, err = types.ParsePhases(phase); err != nil {
+				return err
+			}
+		}
+
+		expected, err := eventlog.ExpectedUKIEvents(sections, phases, banks)
+		if err != nil {
+			return err
+		}
+
+		log, err := eventlog.NewLog(banks)
+		if err != nil {
+			return err
+		}
+		if err = log.Add(expected...); err != nil {
+			return err
+		}
+
+		data, err := log.Marshal()
+		if err != nil {
+			return err
+		}
+
+		for _, alg := range log.Algorithms {
+			value, err := log.Replay(constants.UKIPCR, alg.ID)
+			if err != nil {
+				return err
+			}
+			slog.Info("Expected PCR value", "pcr", constants.UKIPCR, "bank", types.BankName(alg.ID), "hash", hex.EncodeToString(value))
+		}
+
+		if err = os.WriteFile(output, data, 0o644); err != nil {
+			return err
+		}
+		slog.Info("Wrote event log", "path", output, "events", len(log.Events))
+		return nil
+	},
+}
+
+func init() {
+	eventLogShowCmd.Flags().Bool("debug", false, "Enable debug output")
+
+	addSectionFlags(eventLogCompareCmd.Flags())
+	eventLogCompareCmd.Flags().String("uki", "", "UKI to take the measured sections from.")
+	eventLogCompareCmd.Flags().String("phase", "", "Phase path expected after the sections, separated by :. Defaults to all the known phases.")
+	eventLogCompareCmd.Flags().BoolP("verbose", "v", false, "Also show the events that match.")
+	eventLogCompareCmd.Flags().Bool("debug", false, "Enable debug output")
+
+	addSectionFlags(eventLogGenerateCmd.Flags())
+	eventLogGenerateCmd.Flags().String("uki", "", "UKI to take the measured sections from.")
+	eventLogGenerateCmd.Flags().String("phase", "enter-initrd:leave-initrd:sysinit:ready", "Phases measured after the sections, separated by :. Empty to only measure the sections.")
+	eventLogGenerateCmd.Flags().StringSlice("pcr-banks", []string{}, "PCR banks to record digests for. Defaults to all of them.")
+	eventLogGenerateCmd.Flags().StringP("output", "o", "binary_bios_measurements", "Path to write the event log to.")
+	eventLogGenerateCmd.Flags().Bool("debug", false, "Enable debug output")
+
+	eventLogCmd.AddCommand(eventLogShowCmd, eventLogCompareCmd, eventLogGenerateCmd)
+	rootCmd.AddCommand(eventLogCmd)
+}
@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/measure"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/spf13/cobra"
+)
+
+var explainPCRCmd = &cobra.Command{
+	Use:   "explain-pcr",
+	Short: "Explain an observed PCR 11 value",
+	Long: "Find which phase a device was in when it reported the given PCR 11 value, by measuring every phase " +
+		"on top of the sections of a UKI, or of the given section files. If no phase matches, the digest of " +
+		"every section is reported so they can be compared with the expected inputs.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		observed, _ := flags.GetString("observed")
+		bank, _ := flags.GetString("bank")
+		phases, _ := flags.GetStringArray("phase")
+		asJSON, _ := flags.GetBool("json")
+
+		if debug, _ := flags.GetBool("debug"); debug {
+			slog.SetLogLoggerLevel(slog.LevelDebug)
+		}
+
+		value, err := hex.DecodeString(strings.TrimPrefix(observed, "0x"))
+		if err != nil || len(value) == 0 {
+			return fmt.Errorf("invalid observed value %q", observed)
+		}
+
+		banks, err := types.ParsePCRBanks([]string{bank})
+		if err != nil {
+			return err
+		}
+
+		sections, err := loadSections(flags)
+		if err != nil {
+			return err
+		}
+
+		phasePaths := [][]types.PhaseInfo{knownPhasePath()}
+		if len(phases) > 0 {
+			phasePaths = nil
+			for _, phase := range phases {
+				parsed, err := types.ParsePhases(phase)
+				if err != nil {
+					return err
+				}
+				phasePaths = append(phasePaths, parsed)
+			}
+		}
+
+		explanation, err := measure.ExplainPCR(sections, phasePaths, banks[0], value, constants.UKIPCR)
+		if err != nil {
+			return err
+		}
+
+		if asJSON {
+			out, err := json.MarshalIndent(explanation, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(out))
+		} else if err = measure.WriteExplanation(os.Stdout, explanation); err != nil {
+			return err
+		}
+
+		if !explanation.Matched {
+			cmd.SilenceUsage = true
+			return errors.New("observed value doesn't match any phase")
+		}
+
+		return nil
+	},
+}
+
+// knownPhasePath returns every known phase, in the order they are measured during a full boot and shutdown
+func knownPhasePath() []types.PhaseInfo {
+	var path []types.PhaseInfo
+	for _, phase := range constants.KnownPhases() {
+		path = append(path, types.PhaseInfo{Phase: phase})
+	}
+	return path
+}
+
+func init() {
+	explainPCRCmd.Flags().String("observed", "", "Observed PCR 11 value, hex encoded.")
+	explainPCRCmd.Flags().String("bank", "sha256", "PCR bank the observed value was read from.")
+	addSectionFlags(explainPCRCmd.Flags())
+	explainPCRCmd.Flags().String("uki", "", "UKI to take the measured sections from.")
+	explainPCRCmd.Flags().StringArray("phase", []string{}, "Phase path to walk, separated by :. Can be repeated. Defaults to all the known phases.")
+	explainPCRCmd.Flags().Bool("json", false, "Output the explanation as JSON.")
+	explainPCRCmd.Flags().Bool("debug", false, "Enable debug output")
+	_ = explainPCRCmd.MarkFlagRequired("observed")
+
+	rootCmd.AddCommand(explainPCRCmd)
+}
@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/kairos-io/go-ukify/pkg/keys"
+	"github.com/spf13/cobra"
+)
+
+var genKeyCmd = &cobra.Command{
+	Use:   "genkey",
+	Short: "Generate SecureBoot and PCR signing keys",
+	Long: "Generate a self-signed SecureBoot code signing certificate and key, and a PCR signing key " +
+		"with its public part. Existing files are never overwritten unless --force is given. " +
+		"Pass an empty path to skip generating that file pair.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		sbCert, _ := flags.GetString("sb-cert")
+		sbKey, _ := flags.GetString("sb-key")
+		pcrKey, _ := flags.GetString("pcr-key")
+		pcrPublicKey, _ := flags.GetString("pcr-public-key")
+		commonName, _ := flags.GetString("common-name")
+		organization, _ := flags.GetString("organization")
+		validityDays, _ := flags.GetInt("validity-days")
+		keySize, _ := flags.GetInt("key-size")
+		force, _ := flags.GetBool("force")
+
+		if debug, _ := flags.GetBool("debug"); debug {
+			slog.SetLogLoggerLevel(slog.LevelDebug)
+		}
+
+		if (sbCert == "") != (sbKey == "") {
+			return errors.New("--sb-cert and --sb-key must be given together")
+		}
+
+		if (pcrKey == "") != (pcrPublicKey == "") {
+			return errors.New("--pcr-key and --pcr-public-key must be given together")
+		}
+
+		if validityDays <= 0 {
+			return fmt.Errorf("invalid validity: %d days", validityDays)
+		}
+
+		// Check everything up front so we don't leave half the material behind
+		if !force {
+			for _, path := range []string{sbCert, sbKey, pcrKey, pcrPublicKey} {
+				if path == "" {
+					continue
+				}
+				if _, err := os.Stat(path); err == nil {
+					return fmt.Errorf("%s already exists, refusing to overwrite it (use --force)", path)
+				}
+			}
+		}
+
+		if sbCert != "" {
+			subject := pkix.Name{CommonName: commonName}
+			if organization != "" {
+				subject.Organization = []string{organization}
+			}
+
+			slog.Info("Generating SecureBoot certificate", "subject", subject.String())
+			certPEM, keyPEM, err := keys.GenerateSecureBootKey(keys.SecureBootOptions{
+				Subject:  subject,
+				Validity: time.Duration(validityDays) * 24 * time.Hour,
+				KeySize:  keySize,
+			})
+			if err != nil {
+				return err
+			}
+
+			if err = keys.WriteFile(sbKey, keyPEM, 0o600, force); err != nil {
+				return err
+			}
+			if err = keys.WriteFile(sbCert, certPEM, 0o644, force); err != nil {
+				return err
+			}
+			slog.Info("Wrote SecureBoot certificate", "cert", sbCert, "key", sbKey)
+		}
+
+		if pcrKey != "" {
+			slog.Info("Generating PCR signing key")
+			privatePEM, publicPEM, err := keys.GeneratePCRKey(keySize)
+			if err != nil {
+				return err
+			}
+
+			if err = keys.WriteFile(pcrKey, privatePEM, 0o600, force); err != nil {
+				return err
+			}
+			if err = keys.WriteFile(pcrPublicKey, publicPEM, 0o644, force); err != nil {
+				return err
+			}
+			slog.Info("Wrote PCR signing key", "key", pcrKey, "public", pcrPublicKey)
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	genKeyCmd.Flags().String("sb-cert", "sb.pem", "Path to write the SecureBoot certificate to.")
+	genKeyCmd.Flags().String("sb-key", "sb.key", "Path to write the SecureBoot private key to.")
+	genKeyCmd.Flags().String("pcr-key", "pcr-private.pem", "Path to write the PCR signing private key to.")
+	genKeyCmd.Flags().String("pcr-public-key", "pcr-public.pem", "Path to write the PCR signing public key to.")
+	genKeyCmd.Flags().String("common-name", "Kairos DB", "Common name of the SecureBoot certificate subject.")
+	genKeyCmd.Flags().String("organization", "", "Organization of the SecureBoot certificate subject.")
+	genKeyCmd.Flags().Int("validity-days", 3650, "Validity of the SecureBoot certificate in days.")
+	genKeyCmd.Flags().Int("key-size", keys.DefaultKeySize, "RSA key size in bits.")
+	genKeyCmd.Flags().Bool("force", false, "Overwrite existing files.")
+	genKeyCmd.Flags().Bool("debug", false, "Enable debug output")
+
+	rootCmd.AddCommand(genKeyCmd)
+}
@@ -0,0 +1,244 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/measure"
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/uki"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+var measureCmd = &cobra.Command{
+	Use:   "measure",
+	Short: "Pre-calculate and sign PCR 11 values, compatible with systemd-measure",
+}
+
+var measureCalculateCmd = &cobra.Command{
+	Use:   "calculate",
+	Short: "Calculate expected PCR 11 values for the given UKI sections",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		sectionsData, phasePaths, banks, format, err := parseMeasureFlags(cmd.Flags())
+		if err != nil {
+			return err
+		}
+
+		if appendPath, _ := cmd.Flags().GetString("append"); appendPath != "" {
+			return errors.New("the --append= switch is only supported for 'sign'")
+		}
+
+		calculation, err := measure.Calculate(sectionsData, phasePaths, banks, constants.UKIPCR)
+		if err != nil {
+			return err
+		}
+
+		if format == "off" {
+			return measure.WriteCalculation(os.Stdout, os.Stderr, calculation, banks, phasePaths)
+		}
+
+		out, err := measure.MarshalSystemdJSON(calculation, format)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(out)
+		return err
+	},
+}
+
+var measureSignCmd = &cobra.Command{
+	Use:   "sign",
+	Short: "Calculate and sign expected PCR 11 values for the given UKI sections",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		privateKey, _ := flags.GetString("private-key")
+		publicKey, _ := flags.GetString("public-key")
+		appendPath, _ := flags.GetString("append")
+
+		if privateKey == "" {
+			return errors.New("no private key specified, use --private-key=")
+		}
+
+		// The public key doubles as the .pcrpkey section if that was not given
+		if publicKey != "" && !flags.Changed("pcrpkey") {
+			_ = flags.Set("pcrpkey", publicKey)
+		}
+
+		sectionsData, phasePaths, banks, format, err := parseMeasureFlags(flags)
+		if err != nil {
+			return err
+		}
+
+		// JSON is the only output format for signatures
+		if format == "off" {
+			format = "pretty"
+		}
+
+		signer, err := pesign.NewPCRSigner(privateKey)
+		if err != nil {
+			return err
+		}
+
+		data := &types.PCRData{}
+		if appendPath != "" {
+			existing, err := os.ReadFile(appendPath)
+			if err != nil {
+				return err
+			}
+			if err = json.Unmarshal(existing, data); err != nil {
+				return fmt.Errorf("failed parsing %s: %w", appendPath, err)
+			}
+		}
+
+		signed, err := measure.Sign(sectionsData, phasePaths, signer, banks, constants.UKIPCR)
+		if err != nil {
+			return err
+		}
+
+		data.SHA1 = append(data.SHA1, signed.SHA1...)
+		data.SHA256 = append(data.SHA256, signed.SHA256...)
+		data.SHA384 = append(data.SHA384, signed.SHA384...)
+		data.SHA512 = append(data.SHA512, signed.SHA512...)
+
+		out, err := measure.MarshalSystemdJSON(data, format)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(out)
+		return err
+	},
+}
+
+// parseMeasureFlags parses the flags shared by the measure subcommands
+func parseMeasureFlags(flags *pflag.FlagSet) (measure.SectionsData, [][]types.PhaseInfo, []tpm2.TPMAlgID, string, error) {
+	if debug, _ := flags.GetBool("debug"); debug {
+		slog.SetLogLoggerLevel(slog.LevelDebug)
+	}
+
+	if current, _ := flags.GetBool("current"); current {
+		return nil, nil, nil, "", errors.New("--current is not supported, pass the kernel image with --linux=")
+	}
+
+	sectionsData, err := sectionFlags(flags)
+	if err != nil {
+		return nil, nil, nil, "", err
+	}
+
+	if sectionsData[constants.Linux] == "" {
+		return nil, nil, nil, "", errors.New("--linux= must be specified")
+	}
+
+	bankNames, _ := flags.GetStringArray("bank")
+	banks, err := types.ParsePCRBanks(bankNames)
+	if err != nil {
+		return nil, nil, nil, "", err
+	}
+
+	// GetStringArray turns a lone --phase= into no phases at all, read the raw values instead
+	phases := flags.Lookup("phase").Value.(pflag.SliceValue).GetSlice()
+	phasePaths := measure.DefaultSystemdPhasePaths()
+	if len(phases) > 0 {
+		phasePaths = nil
+		for _, phase := range phases {
+			// An empty phase means measuring no phase at all
+			if phase == "" {
+				phasePaths = append(phasePaths, []types.PhaseInfo{{}})
+				continue
+			}
+			parsed, err := types.ParsePhases(phase)
+			if err != nil {
+				return nil, nil, nil, "", err
+			}
+			phasePaths = append(phasePaths, parsed)
+		}
+	}
+
+	format, _ := flags.GetString("json")
+	if format != "off" && format != "short" && format != "pretty" {
+		return nil, nil, nil, "", fmt.Errorf("unknown JSON format %q, valid formats are pretty, short and off", format)
+	}
+
+	return sectionsData, phasePaths, banks, format, nil
+}
+
+// addSectionFlags adds a flag per measured section, named after it without the leading dot
+func addSectionFlags(flags *pflag.FlagSet) {
+	flags.String("linux", "", "Path to the kernel image.")
+	flags.String("osrel", "", "Path to the os-release file.")
+	flags.String("cmdline", "", "Path to the file with the kernel cmdline.")
+	flags.String("initrd", "", "Path to the initrd image.")
+	flags.String("splash", "", "Path to the splash bitmap.")
+	flags.String("dtb", "", "Path to the devicetree file.")
+	flags.String("uname", "", "Path to the file with the kernel version.")
+	flags.String("sbat", "", "Path to the SBAT file.")
+	flags.String("pcrpkey", "", "Path to the public key embedded in the .pcrpkey section.")
+}
+
+// sectionFlags returns the section files given with the flags added by addSectionFlags
+func sectionFlags(flags *pflag.FlagSet) (measure.SectionsData, error) {
+	sectionsData := measure.SectionsData{}
+	for _, section := range constants.OrderedSections() {
+		path, _ := flags.GetString(strings.TrimPrefix(string(section), "."))
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			return nil, err
+		}
+		sectionsData[section] = path
+	}
+	return sectionsData, nil
+}
+
+// loadSections returns the contents of the sections of the UKI given with --uki, or of the section files
+func loadSections(flags *pflag.FlagSet) (map[constants.Section][]byte, error) {
+	ukiPath, _ := flags.GetString("uki")
+
+	sectionsData, err := sectionFlags(flags)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case ukiPath != "" && len(sectionsData) > 0:
+		return nil, errors.New("--uki can't be used together with section files")
+	case ukiPath != "":
+		return uki.GetMeasuredSections(ukiPath)
+	case sectionsData[constants.Linux] == "":
+		return nil, errors.New("either --uki or --linux must be specified")
+	}
+
+	sections := map[constants.Section][]byte{}
+	for section, path := range sectionsData {
+		if sections[section], err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	return sections, nil
+}
+
+func init() {
+	for _, cmd := range []*cobra.Command{measureCalculateCmd, measureSignCmd} {
+		addSectionFlags(cmd.Flags())
+		cmd.Flags().StringArray("bank", []string{}, "PCR bank to calculate, can be repeated. Defaults to all of them.")
+		cmd.Flags().StringArray("phase", []string{}, "Phase path to calculate for, separated by :. Can be repeated.")
+		cmd.Flags().String("json", "off", "Output JSON format: pretty, short or off.")
+		cmd.Flags().String("append", "", "Existing signature JSON to append the new signatures to.")
+		cmd.Flags().Bool("current", false, "Use the running kernel. Not supported.")
+		cmd.Flags().Bool("debug", false, "Enable debug output")
+		measureCmd.AddCommand(cmd)
+	}
+
+	measureSignCmd.Flags().String("private-key", "", "Private key to sign the policies with.")
+	measureSignCmd.Flags().String("public-key", "", "Public key matching the private key.")
+
+	rootCmd.AddCommand(measureCmd)
+}
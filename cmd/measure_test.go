@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/go-ukify/pkg/measure"
+	"github.com/kairos-io/go-ukify/pkg/types"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("measure", func() {
+	var linux string
+
+	BeforeEach(func() {
+		linux = filepath.Join(GinkgoT().TempDir(), "linux")
+		Expect(os.WriteFile(linux, []byte("kernel"), 0o644)).To(Succeed())
+	})
+
+	It("Measures no phase at all with an empty --phase=", func() {
+		Expect(run("measure", "calculate", "--linux="+linux, "--phase=")).To(Succeed())
+
+		_, phasePaths, _, _, err := parseMeasureFlags(measureCalculateCmd.Flags())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(phasePaths).To(Equal([][]types.PhaseInfo{{{}}}))
+	})
+
+	It("Measures the default phase paths without --phase", func() {
+		Expect(run("measure", "calculate", "--linux="+linux)).To(Succeed())
+
+		_, phasePaths, _, _, err := parseMeasureFlags(measureCalculateCmd.Flags())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(phasePaths).To(Equal(measure.DefaultSystemdPhasePaths()))
+	})
+})
@@ -0,0 +1,232 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/foxboron/go-uefi/efi/util"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/kairos-io/go-ukify/pkg/attest"
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/eventlog"
+	"github.com/kairos-io/go-ukify/pkg/measure"
+	"github.com/kairos-io/go-ukify/pkg/secureboot"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/uki"
+	"github.com/spf13/cobra"
+)
+
+// predictedEvent is the JSON form of a predicted event
+type predictedEvent struct {
+	PCR         int               `json:"pcr"`
+	Type        string            `json:"type"`
+	Description string            `json:"description,omitempty"`
+	Digests     map[string]string `json:"digests"`
+}
+
+// prediction is the output of the predict command
+type prediction struct {
+	Events []predictedEvent    `json:"events"`
+	PCRs   measure.Calculation `json:"pcrs"`
+}
+
+var predictCmd = &cobra.Command{
+	Use:   "predict",
+	Short: "Predict the PCR 4, 7 and 11 values when booting a signed UKI",
+	Long: "Predict the PCR 4 value out of the Authenticode hashes of sd-boot and the UKI, the PCR 7 value out of " +
+		"the Secure Boot variables and the db entry authorizing them, and the PCR 11 value at every step of the phases. " +
+		"PK, KEK, db and dbx can be given as .auth or .esl files, or as certificates enrolled with --owner-guid.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		ukiPath, _ := flags.GetString("uki")
+		sdBootPath, _ := flags.GetString("sd-boot")
+		pk, _ := flags.GetString("pk")
+		kek, _ := flags.GetString("kek")
+		db, _ := flags.GetString("db")
+		dbx, _ := flags.GetString("dbx")
+		ownerGUID, _ := flags.GetString("owner-guid")
+		phase, _ := flags.GetString("phase")
+		bankNames, _ := flags.GetStringSlice("pcr-banks")
+		output, _ := flags.GetString("output")
+		eventLogPath, _ := flags.GetString("eventlog")
+
+		if debug, _ := flags.GetBool("debug"); debug {
+			slog.SetLogLoggerLevel(slog.LevelDebug)
+		}
+
+		banks, err := types.ParsePCRBanks(bankNames)
+		if err != nil {
+			return err
+		}
+
+		phases, err := types.ParsePhases(phase)
+		if err != nil {
+			return err
+		}
+
+		var binaries []string
+		if sdBootPath != "" {
+			binaries = append(binaries, sdBootPath)
+		}
+		binaries = append(binaries, ukiPath)
+
+		log, err := eventlog.NewLog(banks)
+		if err != nil {
+			return err
+		}
+
+		appEvents, err := eventlog.BootApplicationEvents(binaries, banks)
+		if err != nil {
+			return err
+		}
+		log.Events = append(log.Events, appEvents...)
+
+		pcrs := []int{constants.BootLoaderCodePCR}
+		if pk != "" || kek != "" || db != "" {
+			if pk == "" || kek == "" || db == "" {
+				return errors.New("--pk, --kek and --db must be given together")
+			}
+
+			// The owner GUID is part of the measured variables, so it can't be made up for certificates
+			var owner util.EFIGUID
+			if ownerGUID != "" {
+				if owner, err = secureboot.ParseOwnerGUID(ownerGUID); err != nil {
+					return err
+				}
+			} else {
+				for _, path := range []string{pk, kek, db} {
+					if ext := filepath.Ext(path); ext != ".auth" && ext != ".esl" {
+						return fmt.Errorf("--owner-guid is required to predict PCR 7 out of the certificates in %s", path)
+					}
+				}
+			}
+
+			var config eventlog.SecureBootConfig
+			if config.PK, err = secureboot.ReadVariableDatabase(pk, owner); err != nil {
+				return err
+			}
+			if config.KEK, err = secureboot.ReadVariableDatabase(kek, owner); err != nil {
+				return err
+			}
+			if config.DB, err = secureboot.ReadVariableDatabase(db, owner); err != nil {
+				return err
+			}
+			if dbx != "" {
+				if config.DBX, err = secureboot.ReadSignatureDatabaseFile(dbx); err != nil {
+					return err
+				}
+			}
+
+			sbEvents, err := eventlog.SecureBootEvents(config, binaries, banks)
+			if err != nil {
+				return err
+			}
+			log.Events = append(log.Events, sbEvents...)
+			pcrs = append(pcrs, constants.SecureBootPCR)
+		}
+
+		sections, err := uki.GetMeasuredSections(ukiPath)
+		if err != nil {
+			return err
+		}
+
+		expected, err := eventlog.ExpectedUKIEvents(sections, phases, banks)
+		if err != nil {
+			return err
+		}
+		if err = log.Add(expected...); err != nil {
+			return err
+		}
+
+		result := prediction{PCRs: measure.Calculation{}}
+		loaded := 0
+		for _, event := range log.Events {
+			description := event.Description()
+			// Loaded images are logged by device path, describe them by the binary they come from
+			if event.Type == eventlog.EventTypeEFIBootServicesApplication && loaded < len(binaries) {
+				description = binaries[loaded]
+				loaded++
+			}
+			digests := map[string]string{}
+			for bank, digest := range event.Digests {
+				digests[types.BankName(bank)] = hex.EncodeToString(digest)
+			}
+			result.Events = append(result.Events, predictedEvent{
+				PCR:         event.PCR,
+				Type:        eventlog.TypeName(event.Type),
+				Description: description,
+				Digests:     digests,
+			})
+		}
+
+		for _, alg := range log.Algorithms {
+			name := types.BankName(alg.ID)
+			for _, pcr := range pcrs {
+				value, err := log.Replay(pcr, alg.ID)
+				if err != nil {
+					return err
+				}
+				result.PCRs[name] = append(result.PCRs[name], measure.PCRValue{PCR: pcr, Hash: hex.EncodeToString(value)})
+			}
+
+			// PCR 11 at every step of the phases
+			for i := range phases {
+				values, err := attest.PredictUKI(sections, phases[:i+1], []tpm2.TPMAlgID{alg.ID})
+				if err != nil {
+					return err
+				}
+				result.PCRs[name] = append(result.PCRs[name], measure.PCRValue{
+					Phase: types.PhasesToString(phases[:i+1]),
+					PCR:   constants.UKIPCR,
+					Hash:  hex.EncodeToString(values[alg.ID][constants.UKIPCR]),
+				})
+			}
+		}
+
+		if eventLogPath != "" {
+			data, err := log.Marshal()
+			if err != nil {
+				return err
+			}
+			if err = os.WriteFile(eventLogPath, data, 0o644); err != nil {
+				return err
+			}
+			slog.Info("Wrote predicted event log", "path", eventLogPath)
+		}
+
+		out, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		if output == "" || output == "-" {
+			fmt.Println(string(out))
+			return nil
+		}
+
+		return os.WriteFile(output, append(out, '\n'), 0o644)
+	},
+}
+
+func init() {
+	predictCmd.Flags().String("uki", "", "Signed UKI to predict the measurements of.")
+	predictCmd.Flags().String("sd-boot", "", "Signed sd-boot that loads the UKI, if any.")
+	predictCmd.Flags().String("pk", "", "PK, as an .auth or .esl file, or certificates.")
+	predictCmd.Flags().String("kek", "", "KEK, as an .auth or .esl file, or certificates.")
+	predictCmd.Flags().String("db", "", "db, as an .auth or .esl file, or certificates.")
+	predictCmd.Flags().String("dbx", "", "dbx, as an .auth or .esl file. Empty if not given.")
+	predictCmd.Flags().String("owner-guid", "", "Owner GUID the certificates were enrolled with.")
+	predictCmd.Flags().String("phase", "enter-initrd:leave-initrd:sysinit:ready", "Phases measured into PCR 11 after the sections, separated by :.")
+	predictCmd.Flags().StringSlice("pcr-banks", []string{}, "PCR banks to predict. Defaults to all of them.")
+	predictCmd.Flags().StringP("output", "o", "", "Path to write the prediction json to. Defaults to stdout.")
+	predictCmd.Flags().String("eventlog", "", "Also write the predicted events as a binary event log to this path.")
+	predictCmd.Flags().Bool("debug", false, "Enable debug output")
+	_ = predictCmd.MarkFlagRequired("uki")
+
+	rootCmd.AddCommand(predictCmd)
+}
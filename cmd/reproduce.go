@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/go-ukify/pkg/uki"
+	"github.com/spf13/cobra"
+)
+
+var reproduceCmd = &cobra.Command{
+	Use:   "reproduce MANIFEST",
+	Short: "Rebuild a UKI from its build manifest and check the result is identical",
+	Long: "Rebuild a UKI from the manifest written by create --output-manifest, with the same inputs, options and " +
+		"SOURCE_DATE_EPOCH, and compare the hashes of the rebuilt artifacts with the recorded ones. The signing " +
+		"keys are not part of the manifest and have to be given again.",
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		inputDir, _ := flags.GetString("input-dir")
+		sbKey, _ := flags.GetString("sb-key")
+		sbCert, _ := flags.GetString("sb-cert")
+		pcrKey, _ := flags.GetString("pcr-key")
+		pcrSigningKeys, _ := flags.GetStringArray("pcr-signing-key")
+		keep, _ := flags.GetString("output-dir")
+
+		if debug, _ := flags.GetBool("debug"); debug {
+			slog.SetLogLoggerLevel(slog.LevelDebug)
+		}
+
+		manifest, err := uki.ReadManifest(args[0])
+		if err != nil {
+			return err
+		}
+
+		builder, err := manifest.Builder(inputDir)
+		if err != nil {
+			return err
+		}
+
+		// The manifest SOURCE_DATE_EPOCH, or the lack of it, is the one that counts
+		if manifest.SourceDateEpoch == nil {
+			if err = os.Unsetenv("SOURCE_DATE_EPOCH"); err != nil {
+				return err
+			}
+		}
+
+		pcrKeys, err := parsePCRSigningKeys(pcrSigningKeys)
+		if err != nil {
+			return err
+		}
+		builder.SBKey = sbKey
+		builder.SBCert = sbCert
+		builder.PCRKey = pcrKey
+		builder.PCRKeys = pcrKeys
+
+		outDir := keep
+		if outDir == "" {
+			if outDir, err = os.MkdirTemp("", "ukify-reproduce"); err != nil {
+				return err
+			}
+			defer os.RemoveAll(outDir) //nolint:errcheck
+		}
+		builder.OutUKIPath = filepath.Join(outDir, "uki.signed.efi")
+		builder.OutSdBootPath = filepath.Join(outDir, "sdboot.signed.efi")
+		builder.OutManifestPath = filepath.Join(outDir, "manifest.json")
+
+		if err = builder.Build(); err != nil {
+			return fmt.Errorf("error rebuilding: %w", err)
+		}
+
+		rebuilt, err := uki.ReadManifest(builder.OutManifestPath)
+		if err != nil {
+			return err
+		}
+
+		diffs := manifest.Diff(rebuilt)
+		for _, diff := range diffs {
+			fmt.Printf("DIFFERS %s\n", diff)
+		}
+		if len(diffs) > 0 {
+			cmd.SilenceUsage = true
+			return errors.New("the build is not reproducible")
+		}
+
+		for _, output := range manifest.Outputs {
+			fmt.Printf("OK %s %s\n", output.Name, output.SHA256)
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	reproduceCmd.Flags().String("input-dir", "", "Directory relative input paths of the manifest are resolved against. Defaults to the current directory.")
+	reproduceCmd.Flags().String("sb-cert", "", "SecureBoot certificate the build was signed with.")
+	reproduceCmd.Flags().String("sb-key", "", "SecureBoot key the build was signed with.")
+	reproduceCmd.Flags().StringP("pcr-key", "p", "", "PCR key the build was signed with.")
+	reproduceCmd.Flags().StringArray("pcr-signing-key", []string{}, "Additional PCR key the build was signed with, in the KEY[=PHASE:PHASE...] form. Can be repeated.")
+	reproduceCmd.Flags().String("output-dir", "", "Directory to keep the rebuilt artifacts in, for inspection. They are discarded if empty.")
+	reproduceCmd.Flags().Bool("debug", false, "Enable debug output")
+
+	rootCmd.AddCommand(reproduceCmd)
+}
@@ -0,0 +1,158 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/foxboron/go-uefi/efi/util"
+	"github.com/kairos-io/go-ukify/pkg/keys"
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+	"github.com/kairos-io/go-ukify/pkg/secureboot"
+	"github.com/spf13/cobra"
+)
+
+var revokeCmd = &cobra.Command{
+	Use:   "revoke [flags] [EFI binary...]",
+	Short: "Create a signed dbx update revoking EFI binaries and certificates",
+	Long: "Compute the Authenticode SHA-256 hash of the given UKIs or EFI binaries and build a dbx " +
+		"signature list out of them and the given certificates, signed with the KEK as an " +
+		"authenticated variable update.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		kekCert, _ := flags.GetString("kek-cert")
+		kekKey, _ := flags.GetString("kek-key")
+		certPaths, _ := flags.GetStringSlice("cert")
+		ownerGUID, _ := flags.GetString("owner-guid")
+		output, _ := flags.GetString("output")
+		eslOutput, _ := flags.GetString("output-esl")
+		appendWrite, _ := flags.GetBool("append")
+		force, _ := flags.GetBool("force")
+
+		if debug, _ := flags.GetBool("debug"); debug {
+			slog.SetLogLoggerLevel(slog.LevelDebug)
+		}
+
+		if len(args) == 0 && len(certPaths) == 0 {
+			return errors.New("nothing to revoke, pass EFI binaries and/or --cert")
+		}
+
+		var owner util.EFIGUID
+		var err error
+		if ownerGUID != "" {
+			owner, err = secureboot.ParseOwnerGUID(ownerGUID)
+		} else {
+			owner, err = secureboot.NewOwnerGUID()
+		}
+		if err != nil {
+			return err
+		}
+
+		revocation := &secureboot.Revocation{Owner: owner}
+
+		for _, path := range args {
+			hash, err := revocation.AddBinary(path)
+			if err != nil {
+				return err
+			}
+			slog.Info("Revoking binary", "path", path, "sha256", hex.EncodeToString(hash))
+		}
+
+		for _, path := range certPaths {
+			certs, err := secureboot.ReadCertificates(path)
+			if err != nil {
+				return err
+			}
+			for _, cert := range certs {
+				slog.Info("Revoking certificate", "subject", cert.Subject.String(), "path", path)
+			}
+			revocation.Certificates = append(revocation.Certificates, certs...)
+		}
+
+		if eslOutput != "" {
+			db, err := revocation.Database()
+			if err != nil {
+				return err
+			}
+			if err = keys.WriteFile(eslOutput, db.Bytes(), 0o644, force); err != nil {
+				return err
+			}
+			slog.Info("Wrote dbx signature list", "path", eslOutput)
+		}
+
+		kek, err := pesign.NewSecureBootSigner(kekCert, kekKey)
+		if err != nil {
+			return err
+		}
+
+		auth, err := revocation.Sign(kek, appendWrite)
+		if err != nil {
+			return err
+		}
+
+		if err = keys.WriteFile(output, auth, 0o644, force); err != nil {
+			return err
+		}
+
+		slog.Info("Wrote signed dbx update", "path", output, "append", appendWrite)
+		return nil
+	},
+}
+
+var revokeCheckCmd = &cobra.Command{
+	Use:   "check --dbx FILE EFI binary...",
+	Short: "Check whether EFI binaries are blocked by a dbx file",
+	Long: "Check the given UKIs or EFI binaries against a dbx .auth or signature list file. " +
+		"Exits with an error if any of them is not blocked.",
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dbxPath, _ := cmd.Flags().GetString("dbx")
+
+		dbx, err := secureboot.ReadSignatureDatabaseFile(dbxPath)
+		if err != nil {
+			return err
+		}
+
+		var notBlocked int
+		for _, path := range args {
+			reason, err := secureboot.RevokedBy(dbx, path)
+			if err != nil {
+				return err
+			}
+			if reason == "" {
+				notBlocked++
+				fmt.Printf("%s: not blocked\n", path)
+				continue
+			}
+			fmt.Printf("%s: blocked by %s\n", path, reason)
+		}
+
+		if notBlocked > 0 {
+			return fmt.Errorf("%d of %d binaries are not blocked by %s", notBlocked, len(args), dbxPath)
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	revokeCmd.Flags().String("kek-cert", "", "Key exchange key certificate to sign the dbx update with.")
+	revokeCmd.Flags().String("kek-key", "", "Key exchange key private key.")
+	revokeCmd.Flags().StringSlice("cert", []string{}, "Certificate to revoke, PEM or DER. Can be repeated.")
+	revokeCmd.Flags().String("owner-guid", "", "Owner GUID of the signature entries. A random one is generated if not given.")
+	revokeCmd.Flags().StringP("output", "o", "dbx.auth", "Path to write the signed dbx update to.")
+	revokeCmd.Flags().String("output-esl", "", "Also write the unsigned dbx signature list to this path.")
+	revokeCmd.Flags().Bool("append", true, "Append to the existing dbx instead of replacing it.")
+	revokeCmd.Flags().Bool("force", false, "Overwrite existing files.")
+	revokeCmd.Flags().Bool("debug", false, "Enable debug output")
+
+	_ = revokeCmd.MarkFlagRequired("kek-cert")
+	_ = revokeCmd.MarkFlagRequired("kek-key")
+
+	revokeCheckCmd.Flags().String("dbx", "", "dbx .auth or signature list file to check against.")
+	_ = revokeCheckCmd.MarkFlagRequired("dbx")
+
+	revokeCmd.AddCommand(revokeCheckCmd)
+	rootCmd.AddCommand(revokeCmd)
+}
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/kairos-io/go-ukify/pkg/uki"
+	"github.com/spf13/cobra"
+)
+
+var sbatCheckCmd = &cobra.Command{
+	Use:   "sbat-check --level FILE EFI binary...",
+	Short: "Check whether EFI binaries are revoked by an SBAT level",
+	Long: "Check the .sbat section of the given UKIs or EFI binaries against an SbatLevel policy file, a " +
+		"COMPONENT,GENERATION revocation per line, and report every component shim would refuse. " +
+		"Binaries without an SBAT section are refused too. Exits with an error if any of them is refused.",
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		levelPath, _ := cmd.Flags().GetString("level")
+
+		if debug, _ := cmd.Flags().GetBool("debug"); debug {
+			slog.SetLogLoggerLevel(slog.LevelDebug)
+		}
+
+		data, err := os.ReadFile(levelPath)
+		if err != nil {
+			return err
+		}
+		level, err := uki.ParseSBATLevel(data)
+		if err != nil {
+			return fmt.Errorf("error parsing %s: %w", levelPath, err)
+		}
+
+		var refused int
+		for _, path := range args {
+			sbat, err := uki.GetSBAT(path)
+			if errors.Is(err, uki.ErrNoSBAT) {
+				refused++
+				fmt.Printf("%s: refused, no SBAT section\n", path)
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("error reading %s: %w", path, err)
+			}
+
+			entries, err := uki.ParseSBAT(sbat)
+			if err != nil {
+				return fmt.Errorf("error parsing the SBAT of %s: %w", path, err)
+			}
+			slog.Debug("Read SBAT", "path", path, "entries", len(entries))
+
+			refusals := uki.CheckSBAT(entries, level)
+			if len(refusals) == 0 {
+				fmt.Printf("%s: not revoked\n", path)
+				continue
+			}
+
+			refused++
+			for _, refusal := range refusals {
+				fmt.Printf("%s: refused, %s generation %d is revoked below %d\n", path,
+					refusal.Entry.Component, refusal.Entry.Generation, refusal.Revocation.Generation)
+			}
+		}
+
+		if refused > 0 {
+			cmd.SilenceUsage = true
+			return fmt.Errorf("%d of %d binaries are refused by %s", refused, len(args), levelPath)
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	sbatCheckCmd.Flags().String("level", "", "SbatLevel policy file to check against.")
+	sbatCheckCmd.Flags().Bool("debug", false, "Enable debug output")
+	_ = sbatCheckCmd.MarkFlagRequired("level")
+
+	rootCmd.AddCommand(sbatCheckCmd)
+}
@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/kairos-io/go-ukify/pkg/measure"
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/spf13/cobra"
+)
+
+var signPCRCmd = &cobra.Command{
+	Use:   "sign-pcr",
+	Short: "Sign precomputed PCR values",
+	Long: "Sign policies for already known PCR values, without building a UKI. " +
+		"The output is the same PCR signature json that is embedded in the .pcrsig section.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		pcrKey, _ := flags.GetString("pcr-key")
+		pcrs, _ := flags.GetStringArray("pcr")
+		combine, _ := flags.GetBool("combine")
+		output, _ := flags.GetString("output")
+
+		if debug, _ := flags.GetBool("debug"); debug {
+			slog.SetLogLoggerLevel(slog.LevelDebug)
+		}
+
+		var values []types.PolicyPCR
+		for _, pcr := range pcrs {
+			parsed, err := types.ParsePolicyPCR(pcr)
+			if err != nil {
+				return err
+			}
+			if len(parsed.Values) == 0 {
+				return fmt.Errorf("no value given for PCR %d", parsed.PCR)
+			}
+			values = append(values, parsed)
+		}
+
+		if len(values) == 0 {
+			return errors.New("no PCR values given")
+		}
+
+		signer, err := pesign.NewPCRSigner(pcrKey)
+		if err != nil {
+			return err
+		}
+
+		var data *types.PCRData
+		if combine {
+			data, err = measure.SignCombinedPCRValues(values, signer)
+		} else {
+			data, err = measure.SignPCRValues(values, signer)
+		}
+		if err != nil {
+			return err
+		}
+
+		out, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+
+		if output == "" || output == "-" {
+			fmt.Println(string(out))
+			return nil
+		}
+
+		return os.WriteFile(output, out, 0o644)
+	},
+}
+
+func init() {
+	signPCRCmd.Flags().StringP("pcr-key", "p", "", "PCR key.")
+	signPCRCmd.Flags().StringArray("pcr", []string{}, "PCR value to sign, in the INDEX:BANK=HEX[,BANK=HEX...] form. Can be repeated.")
+	signPCRCmd.Flags().Bool("combine", false, "Sign a single policy per bank binding all the given PCRs together.")
+	signPCRCmd.Flags().StringP("output", "o", "", "Path to write the signature json to, stdout if empty.")
+	signPCRCmd.Flags().Bool("debug", false, "Enable debug output")
+
+	_ = signPCRCmd.MarkFlagRequired("pcr-key")
+	_ = signPCRCmd.MarkFlagRequired("pcr")
+
+	rootCmd.AddCommand(signPCRCmd)
+}
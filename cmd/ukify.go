@@ -1,12 +1,14 @@
 package cmd
 
 import (
-	"github.com/kairos-io/go-ukify/pkg/constants"
+	"encoding/json"
+	"fmt"
 	"github.com/kairos-io/go-ukify/pkg/types"
 	"github.com/kairos-io/go-ukify/pkg/uki"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"log/slog"
+	"os"
 	"strings"
 )
 
@@ -15,16 +17,68 @@ var createUkify = &cobra.Command{
 	Short: "Create a uki file",
 	RunE: func(cmd *cobra.Command, args []string) error {
 		var parsedPhases []types.PhaseInfo
+		var phasePaths [][]types.PhaseInfo
+
+		// Each --phases is an independent path, the first one being the main one
+		for _, phases := range viper.GetStringSlice("phases") {
+			parsed, err := types.ParsePhases(phases)
+			if err != nil {
+				return err
+			}
+			if parsedPhases == nil {
+				parsedPhases = parsed
+			} else {
+				phasePaths = append(phasePaths, parsed)
+			}
+		}
 
-		phases := viper.GetString("phases")
 		// Default to know systemd phases
-		if phases == "" {
+		if parsedPhases == nil {
 			parsedPhases = types.OrderedPhases()
-		} else {
-			// Parse phases from string in order
-			for _, phase := range strings.Split(phases, ":") {
-				parsedPhases = append(parsedPhases, types.PhaseInfo{Phase: constants.Phase(phase)})
+		}
+
+		pcrKeys, err := parsePCRSigningKeys(viper.GetStringSlice("pcr-signing-key"))
+		if err != nil {
+			return err
+		}
+
+		pcrBanks, err := types.ParsePCRBanks(viper.GetStringSlice("pcr-banks"))
+		if err != nil {
+			return err
+		}
+
+		var policyPCRs []types.PolicyPCR
+		for _, policyPCR := range viper.GetStringSlice("policy-pcr") {
+			parsed, err := types.ParsePolicyPCR(policyPCR)
+			if err != nil {
+				return err
+			}
+			policyPCRs = append(policyPCRs, parsed)
+		}
+
+		// SBAT entries are given inline, or as @PATH to read them from a file
+		var sbat []string
+		for _, entries := range viper.GetStringSlice("sbat") {
+			if path, ok := strings.CutPrefix(entries, "@"); ok {
+				data, err := os.ReadFile(path)
+				if err != nil {
+					return err
+				}
+				entries = string(data)
+			}
+			if _, err := uki.ParseSBAT([]byte(entries)); err != nil {
+				return err
 			}
+			sbat = append(sbat, entries)
+		}
+
+		var extraSections []types.ExtraSection
+		for _, section := range viper.GetStringSlice("section") {
+			parsed, err := types.ParseExtraSection(section)
+			if err != nil {
+				return err
+			}
+			extraSections = append(extraSections, parsed)
 		}
 
 		if viper.GetBool("debug") {
@@ -32,29 +86,77 @@ var createUkify = &cobra.Command{
 		}
 
 		builder := &uki.Builder{
-			Arch:          viper.GetString("arch"),
-			Version:       viper.GetString("version"),
-			SdStubPath:    viper.GetString("sd-stub-path"),
-			SdBootPath:    viper.GetString("sd-boot-path"),
-			KernelPath:    viper.GetString("kernel"),
-			InitrdPath:    viper.GetString("initrd"),
-			Cmdline:       viper.GetString("cmdline"),
-			OutSdBootPath: viper.GetString("output-sdboot"),
-			OutUKIPath:    viper.GetString("output-uki"),
-			PCRKey:        viper.GetString("pcr-key"),
-			SBKey:         viper.GetString("sb-key"),
-			SBCert:        viper.GetString("sb-cert"),
-			Phases:        parsedPhases,
+			Arch:            viper.GetString("arch"),
+			Version:         viper.GetString("version"),
+			SdStubPath:      viper.GetString("sd-stub-path"),
+			SdBootPath:      viper.GetString("sd-boot-path"),
+			KernelPath:      viper.GetString("kernel"),
+			InitrdPath:      viper.GetString("initrd"),
+			Cmdline:         viper.GetString("cmdline"),
+			OutSdBootPath:   viper.GetString("output-sdboot"),
+			OutUKIPath:      viper.GetString("output-uki"),
+			OutPCRLockDir:   viper.GetString("output-pcrlock"),
+			OutManifestPath: viper.GetString("output-manifest"),
+			ManifestFormat:  viper.GetString("manifest-format"),
+			SigningWorkers:  viper.GetInt("signing-workers"),
+			PCRKey:          viper.GetString("pcr-key"),
+			PCRKeys:         pcrKeys,
+			PCRBanks:        pcrBanks,
+			PolicyPCRs:      policyPCRs,
+			ExtraSections:   extraSections,
+			SBAT:            sbat,
+			SBKey:           viper.GetString("sb-key"),
+			SBCert:          viper.GetString("sb-cert"),
+			Phases:          parsedPhases,
+			PhasePaths:      phasePaths,
 		}
 
 		if viper.GetString("os-release") != "" {
 			builder.OsRelease = viper.GetString("os-release")
 		}
 
+		// Describe what would be built without writing anything
+		if viper.GetBool("dry-run") {
+			plan, err := builder.Plan(cmd.Context())
+			if err != nil {
+				return err
+			}
+			defer plan.Close()
+
+			description, err := plan.Describe()
+			if err != nil {
+				return err
+			}
+			out, err := json.MarshalIndent(description, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(out))
+			return nil
+		}
+
 		return builder.Build()
 	},
 }
 
+// parsePCRSigningKeys parses extra PCR signing keys in the KEY[=PHASE:PHASE...] form
+func parsePCRSigningKeys(keys []string) ([]types.PCRKey, error) {
+	var pcrKeys []types.PCRKey
+	for _, key := range keys {
+		path, keyPhases, _ := strings.Cut(key, "=")
+		pcrKey := types.PCRKey{KeyPath: path}
+		if keyPhases != "" {
+			parsed, err := types.ParsePhases(keyPhases)
+			if err != nil {
+				return nil, err
+			}
+			pcrKey.Phases = parsed
+		}
+		pcrKeys = append(pcrKeys, pcrKey)
+	}
+	return pcrKeys, nil
+}
+
 func init() {
 	createUkify.Flags().StringP("arch", "a", "", "Arch of the UKI file.")
 	createUkify.Flags().String("version", "", "Version.")
@@ -67,9 +169,19 @@ func init() {
 	createUkify.Flags().String("sb-cert", "", "SecureBoot certificate to sign efi files with.")
 	createUkify.Flags().String("sb-key", "", "SecureBoot certificate to sign efi files with.")
 	createUkify.Flags().StringP("pcr-key", "p", "", "PCR key.")
+	createUkify.Flags().StringArray("pcr-signing-key", []string{}, "Additional PCR key in the KEY[=PHASE:PHASE...] form, only signing the given phases. Can be repeated.")
+	createUkify.Flags().StringSlice("pcr-banks", []string{}, "PCR banks to measure and sign, separated by commas. Defaults to sha1,sha256,sha384,sha512.")
+	createUkify.Flags().StringArray("policy-pcr", []string{}, "Extra PCR to bind in the signed policy, in the INDEX[:BANK=HEX,BANK=HEX...] form. Values not given are predicted if possible. Can be repeated.")
+	createUkify.Flags().StringArray("sbat", []string{}, "SBAT entries to merge with the ones of the sd-stub and the kernel into the .sbat section, as CSV or @PATH to read them from a file. Can be repeated.")
+	createUkify.Flags().StringArray("section", []string{}, "Extra section to add to the UKI in the NAME=PATH[:measure] form. Only the sections the stub knows can be measured, and they have to be. Can be repeated.")
+	createUkify.Flags().Int("signing-workers", 0, "Maximum number of signatures computed at the same time. Defaults to the number of CPUs.")
 	createUkify.Flags().StringP("output-sdboot", "", "sdboot.signed.efi", "sdboot output.")
 	createUkify.Flags().StringP("output-uki", "", "uki.signed.efi", "uki artifact output.")
-	createUkify.Flags().StringP("phases", "", "enter-initrd:leave-initrd:sysinit:ready", "phases to measure for, separated by : and in order of measurement")
+	createUkify.Flags().String("output-pcrlock", "", "Directory to write the systemd-pcrlock files for the UKI to.")
+	createUkify.Flags().String("output-manifest", "", "Path to write the build manifest to, to check the build with the reproduce command.")
+	createUkify.Flags().String("manifest-format", uki.ManifestFormatJSON, "Format of the build manifest, json or in-toto for an in-toto statement with a SLSA provenance predicate.")
+	createUkify.Flags().StringArray("phases", []string{"enter-initrd:leave-initrd:sysinit:ready"}, "phases to measure for, separated by : and in order of measurement. Can be repeated to measure independent phase paths")
+	createUkify.Flags().Bool("dry-run", false, "Print the sections, their layout and PCR predictions of the UKI as JSON, without building it.")
 	createUkify.Flags().Bool("debug", false, "Enable debug output")
 
 	_ = createUkify.MarkFlagRequired("sd-stub-path")
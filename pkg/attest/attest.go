@@ -0,0 +1,327 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package attest verifies TPM2 quotes against the PCR values predicted for a UKI.
+package attest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"slices"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+var (
+	// ErrSignature is returned when the quote is not signed by the attestation key.
+	ErrSignature = errors.New("quote signature is not valid")
+	// ErrNonce is returned when the quote doesn't carry the expected nonce.
+	ErrNonce = errors.New("quote nonce doesn't match")
+	// ErrPCRDigest is returned when the quoted PCRs don't match the expected values.
+	ErrPCRDigest = errors.New("quoted PCR digest doesn't match the expected PCR values")
+)
+
+// Quote is a parsed TPM2 quote.
+type Quote struct {
+	// Raw is the marshalled TPMS_ATTEST, which is what the signature covers.
+	Raw       []byte
+	Attest    *tpm2.TPMSAttest
+	Info      *tpm2.TPMSQuoteInfo
+	Signature *tpm2.TPMTSignature
+}
+
+// PCRValues holds PCR values per bank and PCR index.
+type PCRValues map[tpm2.TPMAlgID]map[int][]byte
+
+// Set stores the value of a PCR in a bank.
+func (v PCRValues) Set(bank tpm2.TPMAlgID, pcr int, value []byte) {
+	if v[bank] == nil {
+		v[bank] = map[int][]byte{}
+	}
+	v[bank][pcr] = value
+}
+
+// ParseQuote parses a quote from the marshalled TPMS_ATTEST and TPMT_SIGNATURE, as written by tpm2_quote.
+func ParseQuote(attest, signature []byte) (*Quote, error) {
+	parsed, err := tpm2.Unmarshal[tpm2.TPMSAttest](attest)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing TPMS_ATTEST: %w", err)
+	}
+
+	if parsed.Type != tpm2.TPMSTAttestQuote {
+		return nil, fmt.Errorf("attestation is not a quote but type 0x%x", uint16(parsed.Type))
+	}
+
+	info, err := parsed.Attested.Quote()
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := tpm2.Unmarshal[tpm2.TPMTSignature](signature)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing TPMT_SIGNATURE: %w", err)
+	}
+
+	return &Quote{Raw: attest, Attest: parsed, Info: info, Signature: sig}, nil
+}
+
+// ParseQuoteBlob parses a quote stored as a single blob: a TPM2B_ATTEST followed by a TPMT_SIGNATURE.
+func ParseQuoteBlob(blob []byte) (*Quote, error) {
+	if len(blob) < 2 {
+		return nil, errors.New("quote blob too short")
+	}
+
+	size := int(binary.BigEndian.Uint16(blob))
+	if len(blob) < 2+size {
+		return nil, fmt.Errorf("quote blob too short for a %d bytes attestation", size)
+	}
+
+	return ParseQuote(blob[2:2+size], blob[2+size:])
+}
+
+// ReadPublicKey reads the attestation key public part, either PEM or DER encoded, or as a marshalled TPM2B_PUBLIC.
+func ReadPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if block, _ := pem.Decode(data); block != nil {
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	}
+
+	if key, err := x509.ParsePKIXPublicKey(data); err == nil {
+		return key, nil
+	}
+
+	public, err := tpm2.Unmarshal[tpm2.TPM2BPublic](data)
+	if err != nil {
+		return nil, fmt.Errorf("%s is neither a PKIX public key nor a TPM2B_PUBLIC", path)
+	}
+
+	contents, err := public.Contents()
+	if err != nil {
+		return nil, err
+	}
+
+	return TPMPublicKey(contents)
+}
+
+// TPMPublicKey converts a TPM public area into a crypto public key.
+func TPMPublicKey(public *tpm2.TPMTPublic) (crypto.PublicKey, error) {
+	switch public.Type {
+	case tpm2.TPMAlgRSA:
+		parms, err := public.Parameters.RSADetail()
+		if err != nil {
+			return nil, err
+		}
+		unique, err := public.Unique.RSA()
+		if err != nil {
+			return nil, err
+		}
+		return tpm2.RSAPub(parms, unique)
+	case tpm2.TPMAlgECC:
+		parms, err := public.Parameters.ECCDetail()
+		if err != nil {
+			return nil, err
+		}
+		unique, err := public.Unique.ECC()
+		if err != nil {
+			return nil, err
+		}
+		curve, err := parms.CurveID.Curve()
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(unique.X.Buffer),
+			Y:     new(big.Int).SetBytes(unique.Y.Buffer),
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type 0x%x", uint16(public.Type))
+}
+
+// signatureHash returns the hash algorithm the quote was signed with.
+func (q *Quote) signatureHash() (crypto.Hash, error) {
+	var hashAlg tpm2.TPMIAlgHash
+	switch q.Signature.SigAlg {
+	case tpm2.TPMAlgRSASSA:
+		sig, err := q.Signature.Signature.RSASSA()
+		if err != nil {
+			return 0, err
+		}
+		hashAlg = sig.Hash
+	case tpm2.TPMAlgRSAPSS:
+		sig, err := q.Signature.Signature.RSAPSS()
+		if err != nil {
+			return 0, err
+		}
+		hashAlg = sig.Hash
+	case tpm2.TPMAlgECDSA:
+		sig, err := q.Signature.Signature.ECDSA()
+		if err != nil {
+			return 0, err
+		}
+		hashAlg = sig.Hash
+	default:
+		return 0, fmt.Errorf("unsupported signature algorithm 0x%x", uint16(q.Signature.SigAlg))
+	}
+	return hashAlg.Hash()
+}
+
+// VerifySignature checks that the quote was signed by the given attestation key.
+func (q *Quote) VerifySignature(key crypto.PublicKey) error {
+	hash, err := q.signatureHash()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrSignature, err)
+	}
+
+	h := hash.New()
+	h.Write(q.Raw)
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if q.Signature.SigAlg == tpm2.TPMAlgRSASSA {
+			sig, _ := q.Signature.Signature.RSASSA()
+			err = rsa.VerifyPKCS1v15(k, hash, digest, sig.Sig.Buffer)
+		} else if q.Signature.SigAlg == tpm2.TPMAlgRSAPSS {
+			sig, _ := q.Signature.Signature.RSAPSS()
+			err = rsa.VerifyPSS(k, hash, digest, sig.Sig.Buffer, nil)
+		} else {
+			err = errors.New("RSA key but not an RSA signature")
+		}
+	case *ecdsa.PublicKey:
+		if q.Signature.SigAlg != tpm2.TPMAlgECDSA {
+			err = errors.New("ECC key but not an ECDSA signature")
+			break
+		}
+		sig, _ := q.Signature.Signature.ECDSA()
+		r := new(big.Int).SetBytes(sig.SignatureR.Buffer)
+		s := new(big.Int).SetBytes(sig.SignatureS.Buffer)
+		if !ecdsa.Verify(k, digest, r, s) {
+			err = errors.New("verification failed")
+		}
+	default:
+		err = fmt.Errorf("unsupported key type %T", key)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrSignature, err)
+	}
+	return nil
+}
+
+// VerifyNonce checks that the quote carries the nonce the verifier sent.
+func (q *Quote) VerifyNonce(nonce []byte) error {
+	if !bytes.Equal(q.Attest.ExtraData.Buffer, nonce) {
+		return fmt.Errorf("%w: got %s, expected %s", ErrNonce, hex.EncodeToString(q.Attest.ExtraData.Buffer), hex.EncodeToString(nonce))
+	}
+	return nil
+}
+
+// SelectedPCRs returns the PCRs the quote selected in each bank, in ascending order.
+func (q *Quote) SelectedPCRs() map[tpm2.TPMAlgID][]int {
+	selected := map[tpm2.TPMAlgID][]int{}
+	for _, selection := range q.Info.PCRSelect.PCRSelections {
+		selected[selection.Hash] = append(selected[selection.Hash], selectionPCRs(selection.PCRSelect)...)
+	}
+	return selected
+}
+
+// QuotedBanks returns the banks the quote selected PCRs from, sorted.
+func (q *Quote) QuotedBanks() []tpm2.TPMAlgID {
+	var banks []tpm2.TPMAlgID
+	for bank := range q.SelectedPCRs() {
+		banks = append(banks, bank)
+	}
+	slices.Sort(banks)
+	return banks
+}
+
+// selectionPCRs decodes a PCR selection bitmap.
+func selectionPCRs(bitmap []byte) []int {
+	var pcrs []int
+	for i, b := range bitmap {
+		for bit := 0; bit < 8; bit++ {
+			if b&(1<<bit) != 0 {
+				pcrs = append(pcrs, i*8+bit)
+			}
+		}
+	}
+	return pcrs
+}
+
+// PCRDigest computes the composite digest the TPM would quote for the given PCR values.
+//
+// The selected PCRs are concatenated in the order of the selection, bank after bank, and hashed with the
+// hash algorithm of the quote signature.
+func (q *Quote) PCRDigest(values PCRValues) ([]byte, error) {
+	hash, err := q.signatureHash()
+	if err != nil {
+		return nil, err
+	}
+
+	h := hash.New()
+	for _, selection := range q.Info.PCRSelect.PCRSelections {
+		for _, pcr := range selectionPCRs(selection.PCRSelect) {
+			value, ok := values[selection.Hash][pcr]
+			if !ok {
+				return nil, fmt.Errorf("no expected value for PCR %d in the %s bank", pcr, types.BankName(selection.Hash))
+			}
+			h.Write(value)
+		}
+	}
+
+	return h.Sum(nil), nil
+}
+
+// VerifyPCRs checks that the quoted PCR digest matches the given PCR values.
+func (q *Quote) VerifyPCRs(values PCRValues) error {
+	expected, err := q.PCRDigest(values)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(expected, q.Info.PCRDigest.Buffer) {
+		return fmt.Errorf("%w: got %s, expected %s", ErrPCRDigest, hex.EncodeToString(q.Info.PCRDigest.Buffer), hex.EncodeToString(expected))
+	}
+	return nil
+}
+
+// Verify checks the signature, the nonce and the quoted PCRs, in that order. The nonce is always checked, a
+// nil nonce only matches a quote taken without one.
+func (q *Quote) Verify(key crypto.PublicKey, nonce []byte, values PCRValues) error {
+	if err := q.VerifySignature(key); err != nil {
+		return err
+	}
+
+	if err := q.VerifyNonce(nonce); err != nil {
+		return err
+	}
+
+	return q.VerifyPCRs(values)
+}
+
+// VerifyWithoutNonce checks the signature and the quoted PCRs, but not the nonce, so a replayed quote passes.
+// Prefer Verify, this is only meant for quotes taken without a nonce from the verifier.
+func (q *Quote) VerifyWithoutNonce(key crypto.PublicKey, values PCRValues) error {
+	if err := q.VerifySignature(key); err != nil {
+		return err
+	}
+
+	return q.VerifyPCRs(values)
+}
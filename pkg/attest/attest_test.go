@@ -0,0 +1,225 @@
+package attest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/measure"
+	"github.com/kairos-io/go-ukify/pkg/measure/pcr"
+	"github.com/kairos-io/go-ukify/pkg/types"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Attest test Suite")
+}
+
+// makeQuote builds a quote of the given sha256 PCRs with their values, signed with key
+func makeQuote(key crypto.Signer, nonce []byte, pcrs []int, values PCRValues) (attest, signature []byte) {
+	selector, err := pcr.CreateSelector(pcrs)
+	Expect(err).ToNot(HaveOccurred())
+
+	composite := sha256.New()
+	for _, index := range pcrs {
+		composite.Write(values[tpm2.TPMAlgSHA256][index])
+	}
+
+	attest = tpm2.Marshal(tpm2.TPMSAttest{
+		Magic:     tpm2.TPMGeneratedValue,
+		Type:      tpm2.TPMSTAttestQuote,
+		ExtraData: tpm2.TPM2BData{Buffer: nonce},
+		Attested: tpm2.NewTPMUAttest(tpm2.TPMSTAttestQuote, &tpm2.TPMSQuoteInfo{
+			PCRSelect: tpm2.TPMLPCRSelection{PCRSelections: []tpm2.TPMSPCRSelection{
+				{Hash: tpm2.TPMAlgSHA256, PCRSelect: selector},
+			}},
+			PCRDigest: tpm2.TPM2BDigest{Buffer: composite.Sum(nil)},
+		}),
+	})
+
+	digest := sha256.Sum256(attest)
+	sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	Expect(err).ToNot(HaveOccurred())
+
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		signature = tpm2.Marshal(tpm2.TPMTSignature{
+			SigAlg: tpm2.TPMAlgRSASSA,
+			Signature: tpm2.NewTPMUSignature(tpm2.TPMAlgRSASSA, &tpm2.TPMSSignatureRSA{
+				Hash: tpm2.TPMAlgSHA256,
+				Sig:  tpm2.TPM2BPublicKeyRSA{Buffer: sig},
+			}),
+		})
+	case *ecdsa.PrivateKey:
+		var parsed struct{ R, S *big.Int }
+		_, err := asn1.Unmarshal(sig, &parsed)
+		Expect(err).ToNot(HaveOccurred())
+		signature = tpm2.Marshal(tpm2.TPMTSignature{
+			SigAlg: tpm2.TPMAlgECDSA,
+			Signature: tpm2.NewTPMUSignature(tpm2.TPMAlgECDSA, &tpm2.TPMSSignatureECC{
+				Hash:       tpm2.TPMAlgSHA256,
+				SignatureR: tpm2.TPM2BECCParameter{Buffer: parsed.R.Bytes()},
+				SignatureS: tpm2.TPM2BECCParameter{Buffer: parsed.S.Bytes()},
+			}),
+		})
+	}
+
+	return attest, signature
+}
+
+var _ = Describe("Attest tests", func() {
+	var rsaKey *rsa.PrivateKey
+	var sections map[constants.Section][]byte
+	var nonce []byte
+	var err error
+
+	BeforeEach(func() {
+		rsaKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).ToNot(HaveOccurred())
+		sections = map[constants.Section][]byte{
+			constants.Linux:   []byte("kernel"),
+			constants.CMDLine: []byte("console=ttyS0"),
+		}
+		nonce = []byte("0123456789abcdef")
+	})
+
+	Describe("Verify", func() {
+		It("Verifies a quote of the predicted PCR 11 value", func() {
+			values, err := PredictUKI(sections, types.OrderedPhases()[:2], nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			attest, signature := makeQuote(rsaKey, nonce, []int{constants.UKIPCR}, values)
+			quote, err := ParseQuote(attest, signature)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(quote.SelectedPCRs()).To(Equal(map[tpm2.TPMAlgID][]int{tpm2.TPMAlgSHA256: {constants.UKIPCR}}))
+			Expect(quote.Verify(&rsaKey.PublicKey, nonce, values)).To(Succeed())
+
+			// Same UKI, another phase
+			other, err := PredictUKI(sections, types.OrderedPhases()[:1], nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(errors.Is(quote.Verify(&rsaKey.PublicKey, nonce, other), ErrPCRDigest)).To(BeTrue())
+		})
+		It("Rejects a wrong nonce or key", func() {
+			values, err := PredictUKI(sections, nil, []tpm2.TPMAlgID{tpm2.TPMAlgSHA256})
+			Expect(err).ToNot(HaveOccurred())
+
+			attest, signature := makeQuote(rsaKey, nonce, []int{constants.UKIPCR}, values)
+			quote, err := ParseQuote(attest, signature)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(errors.Is(quote.Verify(&rsaKey.PublicKey, []byte("other"), values), ErrNonce)).To(BeTrue())
+			// No nonce is not a skipped check
+			Expect(errors.Is(quote.Verify(&rsaKey.PublicKey, nil, values), ErrNonce)).To(BeTrue())
+			Expect(quote.VerifyWithoutNonce(&rsaKey.PublicKey, values)).To(Succeed())
+
+			otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(errors.Is(quote.Verify(&otherKey.PublicKey, nonce, values), ErrSignature)).To(BeTrue())
+		})
+		It("Verifies ECDSA quotes with extra PCRs", func() {
+			ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+
+			values, err := PredictUKI(sections, types.OrderedPhases(), []tpm2.TPMAlgID{tpm2.TPMAlgSHA256})
+			Expect(err).ToNot(HaveOccurred())
+			pcr12, err := types.ParsePolicyPCR("12")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(values.AddPolicyPCRs([]types.PolicyPCR{pcr12}, []tpm2.TPMAlgID{tpm2.TPMAlgSHA256})).To(Succeed())
+
+			attest, signature := makeQuote(ecKey, nonce, []int{constants.UKIPCR, constants.KernelConfigPCR}, values)
+			quote, err := ParseQuote(attest, signature)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(quote.Verify(&ecKey.PublicKey, nonce, values)).To(Succeed())
+
+			// Missing the PCR 12 value
+			delete(values[tpm2.TPMAlgSHA256], constants.KernelConfigPCR)
+			Expect(quote.Verify(&ecKey.PublicKey, nonce, values)).ToNot(Succeed())
+		})
+	})
+
+	Describe("ParseQuoteBlob", func() {
+		It("Parses a size prefixed attestation followed by the signature", func() {
+			values, err := PredictUKI(sections, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+			attest, signature := makeQuote(rsaKey, nonce, []int{constants.UKIPCR}, values)
+
+			blob := binary.BigEndian.AppendUint16(nil, uint16(len(attest)))
+			blob = append(append(blob, attest...), signature...)
+			quote, err := ParseQuoteBlob(blob)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(quote.Raw).To(Equal(attest))
+
+			_, err = ParseQuoteBlob(blob[:10])
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("PredictFromCalculation", func() {
+		It("Picks the values of the phase", func() {
+			tmpDir, err := os.MkdirTemp("", "attest")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(tmpDir) //nolint:errcheck
+
+			Expect(os.WriteFile(filepath.Join(tmpDir, "linux"), sections[constants.Linux], 0o644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(tmpDir, "cmdline"), sections[constants.CMDLine], 0o644)).To(Succeed())
+			calculation, err := measure.Calculate(measure.SectionsData{
+				constants.Linux:   filepath.Join(tmpDir, "linux"),
+				constants.CMDLine: filepath.Join(tmpDir, "cmdline"),
+			}, measure.DefaultSystemdPhasePaths(), nil, constants.UKIPCR)
+			Expect(err).ToNot(HaveOccurred())
+
+			values, err := PredictFromCalculation(calculation, "enter-initrd:leave-initrd")
+			Expect(err).ToNot(HaveOccurred())
+			predicted, err := PredictUKI(sections, types.OrderedPhases()[:2], nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(values).To(Equal(predicted))
+
+			_, err = PredictFromCalculation(calculation, "bogus")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("ReadPublicKey", func() {
+		It("Reads PEM and TPM2B_PUBLIC keys", func() {
+			tmpDir, err := os.MkdirTemp("", "attest")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(tmpDir) //nolint:errcheck
+
+			der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(os.WriteFile(filepath.Join(tmpDir, "ak.pem"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o644)).To(Succeed())
+			key, err := ReadPublicKey(filepath.Join(tmpDir, "ak.pem"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rsaKey.PublicKey.Equal(key)).To(BeTrue())
+
+			public := tpm2.New2B(tpm2.TPMTPublic{
+				Type:    tpm2.TPMAlgRSA,
+				NameAlg: tpm2.TPMAlgSHA256,
+				Parameters: tpm2.NewTPMUPublicParms(tpm2.TPMAlgRSA, &tpm2.TPMSRSAParms{
+					KeyBits: 2048,
+				}),
+				Unique: tpm2.NewTPMUPublicID(tpm2.TPMAlgRSA, &tpm2.TPM2BPublicKeyRSA{Buffer: rsaKey.N.Bytes()}),
+			})
+			Expect(os.WriteFile(filepath.Join(tmpDir, "ak.pub"), tpm2.Marshal(public), 0o644)).To(Succeed())
+			key, err = ReadPublicKey(filepath.Join(tmpDir, "ak.pub"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rsaKey.PublicKey.Equal(key)).To(BeTrue())
+		})
+	})
+})
@@ -0,0 +1,82 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package attest
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/measure"
+	"github.com/kairos-io/go-ukify/pkg/measure/pcr"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// PredictUKI returns the PCR 11 value of every given bank, or all of them if none are given, after booting
+// a UKI with the given sections up to the end of the given phases.
+func PredictUKI(sections map[constants.Section][]byte, phases []types.PhaseInfo, banks []tpm2.TPMAlgID) (PCRValues, error) {
+	_, algos, err := types.GetTPMALGorithmForBanks(banks)
+	if err != nil {
+		return nil, err
+	}
+
+	values := PCRValues{}
+	for _, alg := range algos {
+		hash, err := pcr.MeasureSectionsData(alg.Alg, sections)
+		if err != nil {
+			return nil, err
+		}
+		for _, phase := range phases {
+			hash = pcr.MeasurePhase(phase, alg.Alg, hash)
+		}
+		values.Set(alg.Alg, constants.UKIPCR, hash.Hash())
+	}
+
+	return values, nil
+}
+
+// PredictFromCalculation returns the PCR values for the given phase path out of a prediction,
+// as output by 'ukify measure calculate --json'.
+func PredictFromCalculation(calculation measure.Calculation, phase string) (PCRValues, error) {
+	values := PCRValues{}
+	for name, entries := range calculation {
+		banks, err := types.ParsePCRBanks([]string{name})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			if entry.Phase != phase {
+				continue
+			}
+			value, err := hex.DecodeString(entry.Hash)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s hash for phase %q: %w", name, phase, err)
+			}
+			values.Set(banks[0], entry.PCR, value)
+		}
+	}
+
+	if len(values) == 0 {
+		return nil, fmt.Errorf("no prediction for phase %q", phase)
+	}
+
+	return values, nil
+}
+
+// AddPolicyPCRs adds the values of extra PCRs for the given banks, predicting them like the signed policies do.
+func (v PCRValues) AddPolicyPCRs(policyPCRs []types.PolicyPCR, banks []tpm2.TPMAlgID) error {
+	for _, policyPCR := range policyPCRs {
+		for _, bank := range banks {
+			value, err := measure.ExpectedPCRValue(policyPCR, bank)
+			if err != nil {
+				return err
+			}
+			v.Set(bank, policyPCR.PCR, value)
+		}
+	}
+	return nil
+}
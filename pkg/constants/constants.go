@@ -16,7 +16,13 @@ const (
 	PEMTypeRSAPublic = "PUBLIC KEY"
 	Name             = "Kairos"
 	// UKIPCR is the PCR number where sections except `.pcrsig` are measured.
-	UKIPCR            = 11
+	UKIPCR = 11
+	// BootLoaderCodePCR is the PCR where the firmware measures the boot applications it loads.
+	BootLoaderCodePCR = 4
+	// SecureBootPCR is the PCR where the firmware measures the Secure Boot state and the db entries used.
+	SecureBootPCR = 7
+	// KernelConfigPCR is the PCR where systemd-stub measures cmdline overrides, credentials and add-ons.
+	KernelConfigPCR   = 12
 	OSReleaseTemplate = `NAME="{{ .Name }}"
 ID={{ .ID }}
 VERSION_ID={{ .Version }}
@@ -28,6 +34,10 @@ PRETTY_NAME="{{ .Name }} ({{ .Version }})"
 	LeaveInitrd Phase = "leave-initrd"
 	SysInit     Phase = "sysinit"
 	Ready       Phase = "ready"
+	// Shutdown is extended by systemd-pcrphase when the system starts shutting down.
+	Shutdown Phase = "shutdown"
+	// Final is extended right before the system powers off or reboots.
+	Final Phase = "final"
 	// Systemd-measure uses the following phases:
 	// "enter-initrd", "enter-initrd:leave-initrd", "enter-initrd:leave-initrd:sysinit", "enter-initrd:leave-initrd:sysinit:ready"
 
@@ -62,6 +72,20 @@ func OrderedSections() []Section {
 		PCRPKey}
 }
 
+// KnownPhases returns all the phases systemd-pcrphase extends into the PCR.
+//
+// ref: https://www.freedesktop.org/software/systemd/man/systemd-pcrphase.service.html#Description
+func KnownPhases() []Phase {
+	return []Phase{
+		EnterInitrd,
+		LeaveInitrd,
+		SysInit,
+		Ready,
+		Shutdown,
+		Final,
+	}
+}
+
 // OSReleaseFor returns the contents of /etc/os-release for a given name and version.
 func OSReleaseFor(name, version string) ([]byte, error) {
 	data := struct {
@@ -0,0 +1,271 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package eventlog
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// EventKind is what an expected event measures.
+type EventKind string
+
+const (
+	SectionName    EventKind = "section-name"
+	SectionContent EventKind = "section-content"
+	PhaseEvent     EventKind = "phase"
+)
+
+// ExpectedEvent is a measurement ukify expects the stub or systemd-pcrphase to make.
+type ExpectedEvent struct {
+	PCR     int
+	Kind    EventKind
+	Section constants.Section
+	Phase   constants.Phase
+	Digests map[tpm2.TPMAlgID][]byte
+}
+
+// Description returns the description systemd logs for the event.
+func (e *ExpectedEvent) Description() string {
+	if e.Kind == PhaseEvent {
+		return string(e.Phase)
+	}
+	return string(e.Section)
+}
+
+// String returns a human readable name for the event.
+func (e *ExpectedEvent) String() string {
+	if e.Kind == PhaseEvent {
+		return fmt.Sprintf("phase %s", e.Phase)
+	}
+	return fmt.Sprintf("%s %s", e.Kind, e.Section)
+}
+
+// ExpectedUKIEvents returns the events measured into PCR 11 when booting a UKI with the given sections,
+// followed by the given phases, with digests for the given banks or all of them if none are given.
+//
+// Extending PCR 11 with the digests in order gives the same value as pcr.MeasureSectionsData followed by pcr.MeasurePhase.
+func ExpectedUKIEvents(sections map[constants.Section][]byte, phases []types.PhaseInfo, banks []tpm2.TPMAlgID) ([]ExpectedEvent, error) {
+	_, algos, err := types.GetTPMALGorithmForBanks(banks)
+	if err != nil {
+		return nil, err
+	}
+
+	digests := func(data []byte) (map[tpm2.TPMAlgID][]byte, error) {
+		result := map[tpm2.TPMAlgID][]byte{}
+		for _, alg := range algos {
+			hashAlg, err := alg.Alg.Hash()
+			if err != nil {
+				return nil, err
+			}
+			h := hashAlg.New()
+			h.Write(data)
+			result[alg.Alg] = h.Sum(nil)
+		}
+		return result, nil
+	}
+
+	var events []ExpectedEvent
+	for _, section := range constants.OrderedSections() {
+		data, ok := sections[section]
+		if !ok {
+			continue
+		}
+
+		// NULL terminated, like the stub measures it
+		nameDigests, err := digests(append([]byte(section), 0))
+		if err != nil {
+			return nil, err
+		}
+		contentDigests, err := digests(data)
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events,
+			ExpectedEvent{PCR: constants.UKIPCR, Kind: SectionName, Section: section, Digests: nameDigests},
+			ExpectedEvent{PCR: constants.UKIPCR, Kind: SectionContent, Section: section, Digests: contentDigests},
+		)
+	}
+
+	for _, phase := range phases {
+		phaseDigests, err := digests([]byte(phase.Phase))
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, ExpectedEvent{PCR: constants.UKIPCR, Kind: PhaseEvent, Phase: phase.Phase, Digests: phaseDigests})
+	}
+
+	return events, nil
+}
+
+// Status is the outcome of comparing an observed event with the expected one.
+type Status string
+
+const (
+	// Match means every digest present in both events is the same.
+	Match Status = "match"
+	// Mismatch means the event was found but at least one digest differs.
+	Mismatch Status = "mismatch"
+	// Missing means an expected event was not found in the log.
+	Missing Status = "missing"
+	// Unexpected means the log has an event ukify doesn't expect.
+	Unexpected Status = "unexpected"
+	// NotReached means an expected phase was not measured yet, which is not an error on its own.
+	NotReached Status = "not-reached"
+)
+
+// EventComparison is the result of lining up a single event.
+type EventComparison struct {
+	Status   Status
+	Expected *ExpectedEvent
+	Observed *Event
+	// Banks holds the banks whose digests differ, only set on mismatches.
+	Banks []tpm2.TPMAlgID
+}
+
+// String returns a human readable line describing the comparison.
+func (c EventComparison) String() string {
+	switch c.Status {
+	case Missing, NotReached:
+		return fmt.Sprintf("%s: %s", c.Status, c.Expected)
+	case Unexpected:
+		return fmt.Sprintf("%s: event %d on PCR %d %q", c.Status, c.Observed.Index, c.Observed.PCR, c.Observed.Description())
+	case Mismatch:
+		if len(c.Banks) == 0 {
+			return fmt.Sprintf("%s: %s at event %d, no common bank to compare", c.Status, c.Expected, c.Observed.Index)
+		}
+		banks := make([]string, 0, len(c.Banks))
+		for _, bank := range c.Banks {
+			banks = append(banks, types.BankName(bank))
+		}
+		return fmt.Sprintf("%s: %s at event %d, differs in %v", c.Status, c.Expected, c.Observed.Index, banks)
+	default:
+		return fmt.Sprintf("%s: %s at event %d", c.Status, c.Expected, c.Observed.Index)
+	}
+}
+
+// Diverges reports whether the comparison is a problem.
+func (c EventComparison) Diverges() bool {
+	return c.Status != Match && c.Status != NotReached
+}
+
+// Compare lines up the PCR 11 and 12 events of the log against the expected ones.
+//
+// Section events are matched by the section name in their description, so a missing or extra section only
+// affects its own events. Events after the sections are matched against the expected phases in order, and
+// phases that are not in the log are reported as not reached. ukify doesn't expect any PCR 12 event, so all
+// of them are reported as unexpected.
+func Compare(log *Log, expected []ExpectedEvent) []EventComparison {
+	var results []EventComparison
+
+	observed := log.PCREvents(constants.UKIPCR)
+
+	var sections, phases []ExpectedEvent
+	for _, event := range expected {
+		if event.Kind == PhaseEvent {
+			phases = append(phases, event)
+		} else {
+			sections = append(sections, event)
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(sections) && j < len(observed) {
+		want, got := &sections[i], &observed[j]
+		if got.Description() == want.Description() {
+			results = append(results, compareEvent(want, got))
+			i++
+			j++
+			continue
+		}
+
+		// If the observed section is expected later on, everything in between is missing
+		later := slices.IndexFunc(sections[i:], func(e ExpectedEvent) bool { return e.Description() == got.Description() })
+		if later > 0 {
+			for ; later > 0; later-- {
+				results = append(results, EventComparison{Status: Missing, Expected: &sections[i]})
+				i++
+			}
+			continue
+		}
+
+		// Once the sections are over, the rest belongs to the phases
+		if isSectionEvent(got) {
+			results = append(results, EventComparison{Status: Unexpected, Observed: got})
+			j++
+			continue
+		}
+
+		results = append(results, EventComparison{Status: Missing, Expected: want})
+		i++
+	}
+
+	for ; i < len(sections); i++ {
+		results = append(results, EventComparison{Status: Missing, Expected: &sections[i]})
+	}
+
+	for k := range phases {
+		if j >= len(observed) {
+			results = append(results, EventComparison{Status: NotReached, Expected: &phases[k]})
+			continue
+		}
+		results = append(results, compareEvent(&phases[k], &observed[j]))
+		j++
+	}
+
+	for ; j < len(observed); j++ {
+		results = append(results, EventComparison{Status: Unexpected, Observed: &observed[j]})
+	}
+
+	for _, event := range log.PCREvents(constants.KernelConfigPCR) {
+		results = append(results, EventComparison{Status: Unexpected, Observed: &event})
+	}
+
+	return results
+}
+
+// isSectionEvent reports whether the event looks like a section measured by the stub.
+func isSectionEvent(event *Event) bool {
+	description := event.Description()
+	return slices.ContainsFunc(constants.OrderedSections(), func(s constants.Section) bool { return string(s) == description })
+}
+
+// compareEvent compares the digests present in both events.
+func compareEvent(want *ExpectedEvent, got *Event) EventComparison {
+	result := EventComparison{Status: Match, Expected: want, Observed: got}
+
+	compared := 0
+	for _, bank := range sortedBanks(want.Digests) {
+		digest, ok := got.Digests[bank]
+		if !ok {
+			continue
+		}
+		compared++
+		if !bytes.Equal(digest, want.Digests[bank]) {
+			result.Banks = append(result.Banks, bank)
+		}
+	}
+
+	if len(result.Banks) > 0 || compared == 0 {
+		result.Status = Mismatch
+	}
+
+	return result
+}
+
+func sortedBanks(digests map[tpm2.TPMAlgID][]byte) []tpm2.TPMAlgID {
+	banks := make([]tpm2.TPMAlgID, 0, len(digests))
+	for bank := range digests {
+		banks = append(banks, bank)
+	}
+	slices.Sort(banks)
+	return banks
+}
@@ -0,0 +1,315 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package eventlog parses TCG crypto-agile event logs and lines them up against the measurements ukify expects.
+package eventlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// Event types as defined in the TCG PC Client Platform Firmware Profile.
+const (
+	EventTypeNoAction uint32 = 0x00000003
+	EventTypeEventTag uint32 = 0x00000006
+	EventTypeIPL      uint32 = 0x0000000D
+)
+
+// SpecIDSignature is the signature of the first event of a crypto-agile log.
+const SpecIDSignature = "Spec ID Event03\x00"
+
+const (
+	// maxEventSize bounds the size of a single event so corrupt logs don't exhaust memory.
+	maxEventSize = 16 * 1024 * 1024
+	// maxDigests bounds the number of digests of a single event.
+	maxDigests = 32
+	// sha1DigestSize is the digest size of the legacy header event.
+	sha1DigestSize = 20
+)
+
+// Algorithm is a digest algorithm declared in the header of the log.
+type Algorithm struct {
+	ID   tpm2.TPMAlgID
+	Size uint16
+}
+
+// Event is a single measurement in the log.
+type Event struct {
+	// Index is the position of the event in the log, the header being 0.
+	Index   int
+	PCR     int
+	Type    uint32
+	Digests map[tpm2.TPMAlgID][]byte
+	Data    []byte
+}
+
+// Log is a parsed crypto-agile event log.
+type Log struct {
+	Algorithms []Algorithm
+	Events     []Event
+}
+
+// ReadFile parses the event log at path.
+func ReadFile(path string) (*Log, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(bytes.NewReader(data))
+}
+
+// Parse parses a binary crypto-agile event log, as exposed by Linux at /sys/kernel/security/tpm0/binary_bios_measurements.
+func Parse(r io.Reader) (*Log, error) {
+	var header struct {
+		PCR       uint32
+		Type      uint32
+		Digest    [sha1DigestSize]byte
+		EventSize uint32
+	}
+
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, fmt.Errorf("failed reading the log header: %w", err)
+	}
+
+	if header.Type != EventTypeNoAction || header.EventSize > maxEventSize {
+		return nil, errors.New("log doesn't start with a Spec ID event, is it a crypto-agile log?")
+	}
+
+	specID := make([]byte, header.EventSize)
+	if _, err := io.ReadFull(r, specID); err != nil {
+		return nil, fmt.Errorf("failed reading the Spec ID event: %w", err)
+	}
+
+	algorithms, err := parseSpecID(specID)
+	if err != nil {
+		return nil, err
+	}
+
+	log := &Log{Algorithms: algorithms}
+	for index := 1; ; index++ {
+		event, err := readEvent(r, algorithms)
+		if errors.Is(err, io.EOF) {
+			return log, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed reading event %d: %w", index, err)
+		}
+		event.Index = index
+		log.Events = append(log.Events, *event)
+	}
+}
+
+// parseSpecID parses the TCG_EfiSpecIDEvent structure and returns the digest algorithms it declares.
+func parseSpecID(data []byte) ([]Algorithm, error) {
+	r := bytes.NewReader(data)
+
+	var spec struct {
+		Signature        [16]byte
+		PlatformClass    uint32
+		SpecVersionMinor uint8
+		SpecVersionMajor uint8
+		SpecErrata       uint8
+		UintnSize        uint8
+		NumAlgorithms    uint32
+	}
+
+	if err := binary.Read(r, binary.LittleEndian, &spec); err != nil {
+		return nil, fmt.Errorf("failed reading the Spec ID event: %w", err)
+	}
+
+	if string(spec.Signature[:]) != SpecIDSignature {
+		return nil, fmt.Errorf("unsupported Spec ID signature %q, only crypto-agile logs are supported", strings.TrimRight(string(spec.Signature[:]), "\x00"))
+	}
+
+	if spec.NumAlgorithms == 0 || spec.NumAlgorithms > maxDigests {
+		return nil, fmt.Errorf("invalid number of algorithms: %d", spec.NumAlgorithms)
+	}
+
+	algorithms := make([]Algorithm, spec.NumAlgorithms)
+	if err := binary.Read(r, binary.LittleEndian, algorithms); err != nil {
+		return nil, fmt.Errorf("failed reading the log algorithms: %w", err)
+	}
+
+	return algorithms, nil
+}
+
+// readEvent reads a single TCG_PCR_EVENT2 structure.
+func readEvent(r io.Reader, algorithms []Algorithm) (*Event, error) {
+	var header struct {
+		PCR         uint32
+		Type        uint32
+		DigestCount uint32
+	}
+
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		// A clean end of the log falls exactly between events
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+
+	if header.DigestCount > maxDigests {
+		return nil, fmt.Errorf("invalid number of digests: %d", header.DigestCount)
+	}
+
+	event := &Event{
+		PCR:     int(header.PCR),
+		Type:    header.Type,
+		Digests: map[tpm2.TPMAlgID][]byte{},
+	}
+
+	for i := uint32(0); i < header.DigestCount; i++ {
+		var id tpm2.TPMAlgID
+		if err := binary.Read(r, binary.LittleEndian, &id); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+
+		size, ok := digestSize(algorithms, id)
+		if !ok {
+			return nil, fmt.Errorf("digest algorithm 0x%x is not declared in the log header", uint16(id))
+		}
+
+		digest := make([]byte, size)
+		if _, err := io.ReadFull(r, digest); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		event.Digests[id] = digest
+	}
+
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	if size > maxEventSize {
+		return nil, fmt.Errorf("event data too big: %d bytes", size)
+	}
+
+	event.Data = make([]byte, size)
+	if _, err := io.ReadFull(r, event.Data); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	return event, nil
+}
+
+// unexpectedEOF turns an EOF in the middle of an event into an error.
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func digestSize(algorithms []Algorithm, id tpm2.TPMAlgID) (uint16, bool) {
+	for _, alg := range algorithms {
+		if alg.ID == id {
+			return alg.Size, true
+		}
+	}
+	return 0, false
+}
+
+// PCREvents returns the events measured into any of the given PCRs, in log order.
+func (l *Log) PCREvents(pcrs ...int) []Event {
+	var events []Event
+	for _, event := range l.Events {
+		for _, pcr := range pcrs {
+			if event.PCR == pcr && event.Type != EventTypeNoAction {
+				events = append(events, event)
+				break
+			}
+		}
+	}
+	return events
+}
+
+// Description returns the human readable description of the event.
+//
+// systemd-stub logs its measurements as EV_IPL events whose data is the UTF-16 description of the measured
+// data, or as EV_EVENT_TAG events wrapping it in a tagged event. Variable events are described by the name
+// of the variable. Anything else is returned as printable ASCII.
+func (e *Event) Description() string {
+	if e.Type == EventTypeEFIVariableDriverConfig || e.Type == EventTypeEFIVariableAuthority {
+		if name, ok := variableName(e.Data); ok {
+			return name
+		}
+	}
+
+	data := e.Data
+	if e.Type == EventTypeEventTag && len(data) >= 8 {
+		size := binary.LittleEndian.Uint32(data[4:8])
+		if uint64(size) <= uint64(len(data)-8) {
+			data = data[8 : 8+size]
+		}
+	}
+
+	if isUTF16(data) {
+		codes := make([]uint16, 0, len(data)/2)
+		for i := 0; i+1 < len(data); i += 2 {
+			codes = append(codes, binary.LittleEndian.Uint16(data[i:]))
+		}
+		return strings.TrimRight(string(utf16.Decode(codes)), "\x00")
+	}
+
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e {
+			return -1
+		}
+		return r
+	}, string(data))
+}
+
+// variableName returns the name of the variable in an UEFI_VARIABLE_DATA structure.
+func variableName(data []byte) (string, bool) {
+	// GUID, name length and data length
+	const headerSize = 16 + 8 + 8
+	if len(data) < headerSize {
+		return "", false
+	}
+
+	length := binary.LittleEndian.Uint64(data[16:24])
+	if length > uint64(len(data)-headerSize)/2 {
+		return "", false
+	}
+
+	codes := make([]uint16, length)
+	for i := range codes {
+		codes[i] = binary.LittleEndian.Uint16(data[headerSize+2*i:])
+	}
+	return string(utf16.Decode(codes)), true
+}
+
+// isUTF16 reports whether data looks like a NULL terminated UTF-16 string of ASCII characters.
+func isUTF16(data []byte) bool {
+	if len(data) < 2 || len(data)%2 != 0 {
+		return false
+	}
+	for i := 1; i < len(data); i += 2 {
+		if data[i] != 0 {
+			return false
+		}
+	}
+	return data[len(data)-2] == 0
+}
+
+// EncodeDescription encodes a description the way systemd-stub logs it, as a NULL terminated UTF-16 string.
+func EncodeDescription(description string) []byte {
+	codes := utf16.Encode([]rune(description + "\x00"))
+	data := make([]byte, 2*len(codes))
+	for i, code := range codes {
+		binary.LittleEndian.PutUint16(data[2*i:], code)
+	}
+	return data
+}
@@ -0,0 +1,303 @@
+package eventlog
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/go-uefi/efi/util"
+	"github.com/foxboron/go-uefi/efivar"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/keys"
+	"github.com/kairos-io/go-ukify/pkg/measure/pcr"
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+	"github.com/kairos-io/go-ukify/pkg/secureboot"
+	"github.com/kairos-io/go-ukify/pkg/types"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Eventlog test Suite")
+}
+
+// encodeLog builds a crypto-agile log with sha1 and sha256 digests out of the given events
+func encodeLog(events []Event) []byte {
+	var buf bytes.Buffer
+	le := binary.LittleEndian
+
+	var spec bytes.Buffer
+	spec.WriteString(SpecIDSignature)
+	_ = binary.Write(&spec, le, uint32(0))
+	spec.Write([]byte{0, 2, 0, 2})
+	_ = binary.Write(&spec, le, uint32(2))
+	_ = binary.Write(&spec, le, []Algorithm{{tpm2.TPMAlgSHA1, 20}, {tpm2.TPMAlgSHA256, 32}})
+	spec.WriteByte(0)
+
+	_ = binary.Write(&buf, le, uint32(0))
+	_ = binary.Write(&buf, le, EventTypeNoAction)
+	buf.Write(make([]byte, 20))
+	_ = binary.Write(&buf, le, uint32(spec.Len()))
+	buf.Write(spec.Bytes())
+
+	for _, event := range events {
+		_ = binary.Write(&buf, le, uint32(event.PCR))
+		_ = binary.Write(&buf, le, event.Type)
+		_ = binary.Write(&buf, le, uint32(len(event.Digests)))
+		for _, bank := range sortedBanks(event.Digests) {
+			_ = binary.Write(&buf, le, bank)
+			buf.Write(event.Digests[bank])
+		}
+		_ = binary.Write(&buf, le, uint32(len(event.Data)))
+		buf.Write(event.Data)
+	}
+
+	return buf.Bytes()
+}
+
+// observedEvents turns the expected events into the events systemd would log, only keeping the sha1 and sha256 banks
+func observedEvents(expected []ExpectedEvent) []Event {
+	var events []Event
+	for _, e := range expected {
+		events = append(events, Event{
+			PCR:  e.PCR,
+			Type: EventTypeIPL,
+			Digests: map[tpm2.TPMAlgID][]byte{
+				tpm2.TPMAlgSHA1:   e.Digests[tpm2.TPMAlgSHA1],
+				tpm2.TPMAlgSHA256: e.Digests[tpm2.TPMAlgSHA256],
+			},
+			Data: EncodeDescription(e.Description()),
+		})
+	}
+	return events
+}
+
+var _ = Describe("Eventlog tests", func() {
+	var sections map[constants.Section][]byte
+	var phases []types.PhaseInfo
+	var expected []ExpectedEvent
+	var err error
+
+	BeforeEach(func() {
+		sections = map[constants.Section][]byte{
+			constants.Linux:   []byte("kernel"),
+			constants.OSRel:   []byte("ID=kairos"),
+			constants.CMDLine: []byte("console=ttyS0"),
+		}
+		phases = types.OrderedPhases()[:2]
+		expected, err = ExpectedUKIEvents(sections, phases, nil)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	Describe("Parse", func() {
+		It("Parses a crypto-agile log", func() {
+			tmpDir, err := os.MkdirTemp("", "eventlog")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(tmpDir) //nolint:errcheck
+
+			path := filepath.Join(tmpDir, "binary_bios_measurements")
+			Expect(os.WriteFile(path, encodeLog(observedEvents(expected)), 0o644)).To(Succeed())
+
+			log, err := ReadFile(path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(log.Algorithms).To(HaveLen(2))
+			Expect(log.Events).To(HaveLen(8))
+			Expect(log.Events[0].Index).To(Equal(1))
+			Expect(log.Events[0].Description()).To(Equal(".linux"))
+			Expect(log.PCREvents(constants.UKIPCR)).To(HaveLen(8))
+			Expect(log.PCREvents(constants.KernelConfigPCR)).To(BeEmpty())
+		})
+		It("Rejects truncated logs", func() {
+			data := encodeLog(observedEvents(expected))
+			_, err := Parse(bytes.NewReader(data[:len(data)-3]))
+			Expect(err).To(HaveOccurred())
+		})
+		It("Rejects logs that are not crypto-agile", func() {
+			_, err := Parse(bytes.NewReader(make([]byte, 64)))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("ExpectedUKIEvents", func() {
+		It("Extends to the same value as the PCR measurement", func() {
+			hashAlg, _ := tpm2.TPMAlgSHA256.Hash()
+			digest := pcr.NewDigest(hashAlg)
+			for _, event := range expected {
+				digest.ExtendDigest(event.Digests[tpm2.TPMAlgSHA256])
+			}
+
+			measured, err := pcr.MeasureSectionsData(tpm2.TPMAlgSHA256, sections)
+			Expect(err).ToNot(HaveOccurred())
+			for _, phase := range phases {
+				measured = pcr.MeasurePhase(phase, tpm2.TPMAlgSHA256, measured)
+			}
+			Expect(digest.Hash()).To(Equal(measured.Hash()))
+		})
+	})
+
+	Describe("Compare", func() {
+		compare := func(events []Event) []EventComparison {
+			log, err := Parse(bytes.NewReader(encodeLog(events)))
+			Expect(err).ToNot(HaveOccurred())
+			return Compare(log, expected)
+		}
+
+		It("Matches every event", func() {
+			results := compare(observedEvents(expected))
+			Expect(results).To(HaveLen(8))
+			for _, result := range results {
+				Expect(result.Status).To(Equal(Match), result.String())
+			}
+		})
+		It("Reports phases that were not reached", func() {
+			results := compare(observedEvents(expected)[:7])
+			Expect(results).To(HaveLen(8))
+			Expect(results[7].Status).To(Equal(NotReached))
+			Expect(results[7].Diverges()).To(BeFalse())
+		})
+		It("Reports the section whose content differs", func() {
+			events := observedEvents(expected)
+			events[5].Digests[tpm2.TPMAlgSHA256] = make([]byte, 32)
+
+			results := compare(events)
+			Expect(results[5].Status).To(Equal(Mismatch))
+			Expect(results[5].Expected.Section).To(Equal(constants.CMDLine))
+			Expect(results[5].Expected.Kind).To(Equal(SectionContent))
+			Expect(results[5].Banks).To(Equal([]tpm2.TPMAlgID{tpm2.TPMAlgSHA256}))
+			Expect(results[4].Status).To(Equal(Match))
+			Expect(results[6].Status).To(Equal(Match))
+		})
+		It("Reports missing and unexpected events", func() {
+			events := observedEvents(expected)
+			// Drop .osrel and add PCR 12 event
+			events = append(events[:2], events[4:]...)
+			events = append(events, Event{PCR: constants.KernelConfigPCR, Type: EventTypeIPL, Data: EncodeDescription("cmdline")})
+
+			results := compare(events)
+			Expect(results[2].Status).To(Equal(Missing))
+			Expect(results[2].Expected.Section).To(Equal(constants.OSRel))
+			Expect(results[3].Status).To(Equal(Missing))
+			Expect(results[4].Status).To(Equal(Match))
+			last := results[len(results)-1]
+			Expect(last.Status).To(Equal(Unexpected))
+			Expect(last.Observed.PCR).To(Equal(constants.KernelConfigPCR))
+			Expect(last.Diverges()).To(BeTrue())
+		})
+	})
+
+	Describe("Marshal", func() {
+		It("Generates a log that replays to the expected PCR 11 value", func() {
+			log, err := NewLog([]tpm2.TPMAlgID{tpm2.TPMAlgSHA256, tpm2.TPMAlgSHA384})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(log.Add(expected...)).To(Succeed())
+
+			data, err := log.Marshal()
+			Expect(err).ToNot(HaveOccurred())
+
+			parsed, err := Parse(bytes.NewReader(data))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(parsed.Algorithms).To(Equal([]Algorithm{{tpm2.TPMAlgSHA256, 32}, {tpm2.TPMAlgSHA384, 48}}))
+			Expect(parsed.Events).To(Equal(log.Events))
+			Expect(parsed.Events[2].Description()).To(Equal(".osrel"))
+
+			for _, alg := range []tpm2.TPMAlgID{tpm2.TPMAlgSHA256, tpm2.TPMAlgSHA384} {
+				measured, err := pcr.MeasureSectionsData(alg, sections)
+				Expect(err).ToNot(HaveOccurred())
+				for _, phase := range phases {
+					measured = pcr.MeasurePhase(phase, alg, measured)
+				}
+
+				replayed, err := parsed.Replay(constants.UKIPCR, alg)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(replayed).To(Equal(measured.Hash()))
+			}
+
+			for _, result := range Compare(parsed, expected) {
+				Expect(result.Status).To(Equal(Match))
+			}
+		})
+		It("Fails if an event lacks a digest for a bank of the log", func() {
+			log, err := NewLog(nil)
+			Expect(err).ToNot(HaveOccurred())
+			sha256Only, err := ExpectedUKIEvents(sections, nil, []tpm2.TPMAlgID{tpm2.TPMAlgSHA256})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(log.Add(sha256Only...)).ToNot(Succeed())
+		})
+	})
+
+	Describe("Firmware events", func() {
+		var tmpDir string
+		var signer *pesign.Signer
+		var db signature.SignatureDatabase
+
+		BeforeEach(func() {
+			tmpDir, err = os.MkdirTemp("", "eventlog")
+			Expect(err).ToNot(HaveOccurred())
+
+			certPEM, keyPEM, err := keys.GenerateSecureBootKey(keys.SecureBootOptions{Subject: pkix.Name{CommonName: "db"}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(os.WriteFile(filepath.Join(tmpDir, "db.pem"), certPEM, 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(tmpDir, "db.key"), keyPEM, 0o600)).To(Succeed())
+			sb, err := pesign.NewSecureBootSigner(filepath.Join(tmpDir, "db.pem"), filepath.Join(tmpDir, "db.key"))
+			Expect(err).ToNot(HaveOccurred())
+			signer, err = pesign.NewSigner(sb)
+			Expect(err).ToNot(HaveOccurred())
+
+			certDB, err := secureboot.CertificateDatabase(util.EFIGUID{}, sb.Certificate())
+			Expect(err).ToNot(HaveOccurred())
+			db = *certDB
+
+			for _, name := range []string{"sd-boot.efi", "uki.efi"} {
+				Expect(signer.Sign("../pesign/testdata/file.efi", filepath.Join(tmpDir, name))).To(Succeed())
+			}
+		})
+		AfterEach(func() {
+			Expect(os.RemoveAll(tmpDir)).ToNot(HaveOccurred())
+		})
+
+		It("Measures the Authenticode hash of every binary into PCR 4", func() {
+			binaries := []string{filepath.Join(tmpDir, "sd-boot.efi"), filepath.Join(tmpDir, "uki.efi")}
+			events, err := BootApplicationEvents(binaries, []tpm2.TPMAlgID{tpm2.TPMAlgSHA256})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(events).To(HaveLen(4))
+			Expect(events[0].Description()).To(Equal(CallingEFIApplication))
+			Expect(events[1].Type).To(Equal(EventTypeSeparator))
+
+			for i, binary := range binaries {
+				hash, err := pesign.AuthenticodeHash(binary, crypto.SHA256)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(events[2+i].PCR).To(Equal(constants.BootLoaderCodePCR))
+				Expect(events[2+i].Type).To(Equal(EventTypeEFIBootServicesApplication))
+				Expect(events[2+i].Digests[tpm2.TPMAlgSHA256]).To(Equal(hash))
+			}
+		})
+		It("Measures the Secure Boot variables and the db authority into PCR 7", func() {
+			binaries := []string{filepath.Join(tmpDir, "sd-boot.efi"), filepath.Join(tmpDir, "uki.efi")}
+			events, err := SecureBootEvents(SecureBootConfig{DB: db}, binaries, []tpm2.TPMAlgID{tpm2.TPMAlgSHA256})
+			Expect(err).ToNot(HaveOccurred())
+
+			// Both binaries are signed by the same db certificate, so it is only measured once
+			Expect(events).To(HaveLen(7))
+			var names []string
+			for _, event := range events {
+				Expect(event.PCR).To(Equal(constants.SecureBootPCR))
+				names = append(names, event.Description())
+			}
+			Expect(names).To(Equal([]string{"SecureBoot", "PK", "KEK", "db", "dbx", "", "db"}))
+			Expect(events[6].Type).To(Equal(EventTypeEFIVariableAuthority))
+			Expect(events[6].Data).To(Equal(VariableData(efivar.Db, db[0].Signatures[0].Bytes())))
+		})
+		It("Fails if no db entry authorizes a binary", func() {
+			_, err := SecureBootEvents(SecureBootConfig{}, []string{filepath.Join(tmpDir, "uki.efi")}, nil)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
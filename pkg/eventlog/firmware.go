@@ -0,0 +1,252 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package eventlog
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"unicode/utf16"
+
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/go-uefi/efivar"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// Firmware event types as defined in the TCG PC Client Platform Firmware Profile.
+const (
+	EventTypeSeparator                  uint32 = 0x00000004
+	EventTypeEFIVariableDriverConfig    uint32 = 0x80000001
+	EventTypeEFIBootServicesApplication uint32 = 0x80000003
+	EventTypeEFIAction                  uint32 = 0x80000007
+	EventTypeEFIVariableAuthority       uint32 = 0x800000E0
+)
+
+// CallingEFIApplication is the EV_EFI_ACTION the firmware measures before starting a boot option.
+const CallingEFIApplication = "Calling EFI Application from Boot Option"
+
+// TypeName returns the name of an event type, as used in the TCG specification.
+func TypeName(eventType uint32) string {
+	switch eventType {
+	case EventTypeNoAction:
+		return "EV_NO_ACTION"
+	case EventTypeSeparator:
+		return "EV_SEPARATOR"
+	case EventTypeEventTag:
+		return "EV_EVENT_TAG"
+	case EventTypeIPL:
+		return "EV_IPL"
+	case EventTypeEFIVariableDriverConfig:
+		return "EV_EFI_VARIABLE_DRIVER_CONFIG"
+	case EventTypeEFIBootServicesApplication:
+		return "EV_EFI_BOOT_SERVICES_APPLICATION"
+	case EventTypeEFIAction:
+		return "EV_EFI_ACTION"
+	case EventTypeEFIVariableAuthority:
+		return "EV_EFI_VARIABLE_AUTHORITY"
+	}
+	return fmt.Sprintf("0x%08x", eventType)
+}
+
+// newEvent returns an event whose digests are the hash of data in every bank.
+func newEvent(pcr int, eventType uint32, data []byte, banks []tpm2.TPMAlgID) (Event, error) {
+	event := Event{PCR: pcr, Type: eventType, Data: data, Digests: map[tpm2.TPMAlgID][]byte{}}
+	for _, bank := range banks {
+		hashAlg, err := bank.Hash()
+		if err != nil {
+			return event, err
+		}
+		h := hashAlg.New()
+		h.Write(data)
+		event.Digests[bank] = h.Sum(nil)
+	}
+	return event, nil
+}
+
+// separatorEvent returns the EV_SEPARATOR the firmware measures before handing over to the boot loader.
+func separatorEvent(pcr int, banks []tpm2.TPMAlgID) (Event, error) {
+	return newEvent(pcr, EventTypeSeparator, make([]byte, 4), banks)
+}
+
+// VariableData encodes an UEFI_VARIABLE_DATA structure, which is what variable events measure.
+func VariableData(variable efivar.Efivar, data []byte) []byte {
+	name := utf16.Encode([]rune(variable.Name))
+
+	var buf bytes.Buffer
+	buf.Write(variable.GUID.Bytes())
+	_ = binary.Write(&buf, binary.LittleEndian, uint64(len(name)))
+	_ = binary.Write(&buf, binary.LittleEndian, uint64(len(data)))
+	_ = binary.Write(&buf, binary.LittleEndian, name)
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+// banksOrAll resolves the given banks, all of the supported ones if none are given.
+func banksOrAll(banks []tpm2.TPMAlgID) ([]tpm2.TPMAlgID, error) {
+	_, algos, err := types.GetTPMALGorithmForBanks(banks)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved := make([]tpm2.TPMAlgID, 0, len(algos))
+	for _, alg := range algos {
+		resolved = append(resolved, alg.Alg)
+	}
+	return resolved, nil
+}
+
+// BootApplicationEvents returns the PCR 4 events the firmware measures when starting a boot option that loads
+// the given PE binaries in order, typically sd-boot and then the UKI. The digest of each binary is its
+// Authenticode hash, so it's the same signed or unsigned.
+func BootApplicationEvents(binaries []string, banks []tpm2.TPMAlgID) ([]Event, error) {
+	banks, err := banksOrAll(banks)
+	if err != nil {
+		return nil, err
+	}
+
+	action, err := newEvent(constants.BootLoaderCodePCR, EventTypeEFIAction, []byte(CallingEFIApplication), banks)
+	if err != nil {
+		return nil, err
+	}
+
+	separator, err := separatorEvent(constants.BootLoaderCodePCR, banks)
+	if err != nil {
+		return nil, err
+	}
+
+	events := []Event{action, separator}
+	for _, binary := range binaries {
+		event := Event{PCR: constants.BootLoaderCodePCR, Type: EventTypeEFIBootServicesApplication, Digests: map[tpm2.TPMAlgID][]byte{}}
+		for _, bank := range banks {
+			hashAlg, err := bank.Hash()
+			if err != nil {
+				return nil, err
+			}
+			if event.Digests[bank], err = pesign.AuthenticodeHash(binary, hashAlg); err != nil {
+				return nil, err
+			}
+		}
+		events = append(events, event)
+	}
+
+	return events, nil
+}
+
+// SecureBootConfig holds the contents of the Secure Boot variables.
+type SecureBootConfig struct {
+	PK  signature.SignatureDatabase
+	KEK signature.SignatureDatabase
+	DB  signature.SignatureDatabase
+	DBX signature.SignatureDatabase
+}
+
+// SecureBootEvents returns the PCR 7 events the firmware measures with Secure Boot enabled and the given
+// configuration, when booting the given PE binaries in order.
+//
+// Those are the SecureBoot, PK, KEK, db and dbx variables, the separator, and then the db entry that
+// authorized each binary. Each entry is only measured the first time it authorizes a binary.
+func SecureBootEvents(config SecureBootConfig, binaries []string, banks []tpm2.TPMAlgID) ([]Event, error) {
+	banks, err := banksOrAll(banks)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []Event
+	for _, variable := range []struct {
+		variable efivar.Efivar
+		data     []byte
+	}{
+		{efivar.SecureBoot, []byte{1}},
+		{efivar.PK, config.PK.Bytes()},
+		{efivar.KEK, config.KEK.Bytes()},
+		{efivar.Db, config.DB.Bytes()},
+		{efivar.Dbx, config.DBX.Bytes()},
+	} {
+		event, err := newEvent(constants.SecureBootPCR, EventTypeEFIVariableDriverConfig, VariableData(variable.variable, variable.data), banks)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	separator, err := separatorEvent(constants.SecureBootPCR, banks)
+	if err != nil {
+		return nil, err
+	}
+	events = append(events, separator)
+
+	var measured [][]byte
+	for _, binary := range binaries {
+		authority, err := dbAuthority(config.DB, binary)
+		if err != nil {
+			return nil, err
+		}
+
+		data := VariableData(efivar.Db, authority.Bytes())
+		if containsBytes(measured, data) {
+			continue
+		}
+		measured = append(measured, data)
+
+		event, err := newEvent(constants.SecureBootPCR, EventTypeEFIVariableAuthority, data, banks)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	return events, nil
+}
+
+// dbAuthority returns the db entry that authorizes the binary: either its Authenticode hash, or a
+// certificate that is, or issued, one of the certificates the binary is signed with.
+func dbAuthority(db signature.SignatureDatabase, binary string) (*signature.SignatureData, error) {
+	certs, err := pesign.SignerCertificates(binary)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, list := range db {
+		for i := range list.Signatures {
+			entry := &list.Signatures[i]
+			switch list.SignatureType {
+			case signature.CERT_X509_GUID:
+				dbCert, err := x509.ParseCertificate(entry.Data)
+				if err != nil {
+					continue
+				}
+				for _, cert := range certs {
+					if cert.Equal(dbCert) || cert.CheckSignatureFrom(dbCert) == nil {
+						return entry, nil
+					}
+				}
+			case signature.CERT_SHA256_GUID:
+				hash, err := pesign.AuthenticodeHash(binary, crypto.SHA256)
+				if err != nil {
+					return nil, err
+				}
+				if bytes.Equal(hash, entry.Data) {
+					return entry, nil
+				}
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("%s is not authorized by any db entry", binary)
+}
+
+func containsBytes(list [][]byte, data []byte) bool {
+	for _, item := range list {
+		if bytes.Equal(item, data) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package eventlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/kairos-io/go-ukify/pkg/measure/pcr"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// NewLog returns an empty log that records digests for the given banks, or all of them if none are given.
+func NewLog(banks []tpm2.TPMAlgID) (*Log, error) {
+	_, algos, err := types.GetTPMALGorithmForBanks(banks)
+	if err != nil {
+		return nil, err
+	}
+
+	log := &Log{}
+	for _, alg := range algos {
+		hashAlg, err := alg.Alg.Hash()
+		if err != nil {
+			return nil, err
+		}
+		log.Algorithms = append(log.Algorithms, Algorithm{ID: alg.Alg, Size: uint16(hashAlg.Size())})
+	}
+	return log, nil
+}
+
+// Add appends the expected events to the log as the EV_IPL events systemd logs for them.
+func (l *Log) Add(events ...ExpectedEvent) error {
+	for _, expected := range events {
+		event := Event{
+			Index:   len(l.Events) + 1,
+			PCR:     expected.PCR,
+			Type:    EventTypeIPL,
+			Digests: map[tpm2.TPMAlgID][]byte{},
+			Data:    EncodeDescription(expected.Description()),
+		}
+
+		for _, alg := range l.Algorithms {
+			digest, ok := expected.Digests[alg.ID]
+			if !ok {
+				return fmt.Errorf("%s has no %s digest", expected.String(), types.BankName(alg.ID))
+			}
+			event.Digests[alg.ID] = digest
+		}
+
+		l.Events = append(l.Events, event)
+	}
+	return nil
+}
+
+// Marshal encodes the log in the binary crypto-agile format, with a Spec ID header declaring all the log algorithms.
+func (l *Log) Marshal() ([]byte, error) {
+	var buf bytes.Buffer
+	le := binary.LittleEndian
+
+	var spec bytes.Buffer
+	spec.WriteString(SpecIDSignature)
+	_ = binary.Write(&spec, le, struct {
+		PlatformClass    uint32
+		SpecVersionMinor uint8
+		SpecVersionMajor uint8
+		SpecErrata       uint8
+		UintnSize        uint8
+		NumAlgorithms    uint32
+	}{
+		SpecVersionMajor: 2,
+		SpecErrata:       2,
+		// UINTN is 64 bits
+		UintnSize:     2,
+		NumAlgorithms: uint32(len(l.Algorithms)),
+	})
+	_ = binary.Write(&spec, le, l.Algorithms)
+	// No vendor info
+	spec.WriteByte(0)
+
+	// The header is always in the legacy SHA1 format
+	_ = binary.Write(&buf, le, struct {
+		PCR       uint32
+		Type      uint32
+		Digest    [sha1DigestSize]byte
+		EventSize uint32
+	}{
+		Type:      EventTypeNoAction,
+		EventSize: uint32(spec.Len()),
+	})
+	buf.Write(spec.Bytes())
+
+	for _, event := range l.Events {
+		_ = binary.Write(&buf, le, []uint32{uint32(event.PCR), event.Type, uint32(len(l.Algorithms))})
+		for _, alg := range l.Algorithms {
+			digest, ok := event.Digests[alg.ID]
+			if !ok || len(digest) != int(alg.Size) {
+				return nil, fmt.Errorf("event %d has no valid %s digest", event.Index, types.BankName(alg.ID))
+			}
+			_ = binary.Write(&buf, le, alg.ID)
+			buf.Write(digest)
+		}
+		_ = binary.Write(&buf, le, uint32(len(event.Data)))
+		buf.Write(event.Data)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Replay returns the value of the PCR after extending it with all its events in the given bank.
+func (l *Log) Replay(pcrIndex int, alg tpm2.TPMAlgID) ([]byte, error) {
+	hashAlg, err := alg.Hash()
+	if err != nil {
+		return nil, err
+	}
+
+	digest := pcr.NewDigest(hashAlg)
+	for _, event := range l.PCREvents(pcrIndex) {
+		value, ok := event.Digests[alg]
+		if !ok {
+			return nil, fmt.Errorf("event %d has no %s digest", event.Index, types.BankName(alg))
+		}
+		digest.ExtendDigest(value)
+	}
+	return digest.Hash(), nil
+}
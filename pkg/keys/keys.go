@@ -0,0 +1,159 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package keys generates the SecureBoot and PCR signing material used to build UKIs.
+package keys
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+)
+
+const (
+	// DefaultKeySize is the RSA key size used when none is given.
+	DefaultKeySize = 2048
+	// DefaultValidity is how long generated certificates are valid for when none is given.
+	DefaultValidity = 10 * 365 * 24 * time.Hour
+
+	pemTypeCertificate = "CERTIFICATE"
+	pemTypePrivate     = "PRIVATE KEY"
+)
+
+// SecureBootOptions describes the SecureBoot certificate to generate.
+type SecureBootOptions struct {
+	// Subject of the self-signed certificate.
+	Subject pkix.Name
+	// Validity of the certificate, starting now.
+	Validity time.Duration
+	// Size of the RSA key in bits.
+	KeySize int
+}
+
+// GenerateSecureBootKey generates a self-signed code signing certificate and its key.
+//
+// The certificate is returned PEM encoded and the key as a PEM encoded PKCS#8 block, so
+// both can be consumed by pesign.NewSecureBootSigner.
+func GenerateSecureBootKey(opts SecureBootOptions) (certPEM, keyPEM []byte, err error) {
+	if opts.KeySize == 0 {
+		opts.KeySize = DefaultKeySize
+	}
+
+	if opts.Validity == 0 {
+		opts.Validity = DefaultValidity
+	}
+
+	if opts.Subject.CommonName == "" {
+		return nil, nil, errors.New("certificate subject needs a common name")
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, opts.KeySize)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed generating RSA key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed generating serial number: %w", err)
+	}
+
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Subject key identifier as described in RFC 5280 section 4.2.1.2 method 1
+	ski := sha1.Sum(publicKeyBytes)
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               opts.Subject,
+		NotBefore:             now,
+		NotAfter:              now.Add(opts.Validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		BasicConstraintsValid: true,
+		IsCA:                  false,
+		SubjectKeyId:          ski[:],
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed creating certificate: %w", err)
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: pemTypeCertificate, Bytes: certDER})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: pemTypePrivate, Bytes: keyDER})
+
+	return certPEM, keyPEM, nil
+}
+
+// GeneratePCRKey generates the RSA key used to sign PCR policies.
+//
+// The private key is returned as a PEM encoded PKCS#8 block, consumable by pesign.NewPCRSigner,
+// and the public key in the same format that is embedded in the .pcrpkey section.
+func GeneratePCRKey(keySize int) (privatePEM, publicPEM []byte, err error) {
+	if keySize == 0 {
+		keySize = DefaultKeySize
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, keySize)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed generating RSA key: %w", err)
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	privatePEM = pem.EncodeToMemory(&pem.Block{Type: pemTypePrivate, Bytes: keyDER})
+	publicPEM = pem.EncodeToMemory(&pem.Block{Type: constants.PEMTypeRSAPublic, Bytes: publicKeyBytes})
+
+	return privatePEM, publicPEM, nil
+}
+
+// WriteFile writes data to path, refusing to replace an existing file unless overwrite is set.
+func WriteFile(path string, data []byte, perm os.FileMode, overwrite bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !overwrite {
+		flags |= os.O_EXCL
+	}
+
+	f, err := os.OpenFile(path, flags, perm)
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("%s already exists, refusing to overwrite it", path)
+		}
+		return err
+	}
+
+	if _, err = f.Write(data); err != nil {
+		f.Close() //nolint:errcheck
+		return err
+	}
+
+	return f.Close()
+}
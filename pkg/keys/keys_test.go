@@ -0,0 +1,92 @@
+package keys
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Keys test Suite")
+}
+
+var _ = Describe("Keys tests", func() {
+	var tmpDir string
+	var err error
+
+	BeforeEach(func() {
+		tmpDir, err = os.MkdirTemp("", "keys")
+		Expect(err).ToNot(HaveOccurred())
+	})
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmpDir)).ToNot(HaveOccurred())
+	})
+
+	Describe("GenerateSecureBootKey", func() {
+		It("Generates a code signing certificate usable by the SecureBoot signer", func() {
+			certPEM, keyPEM, err := GenerateSecureBootKey(SecureBootOptions{
+				Subject: pkix.Name{CommonName: "Test DB"},
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			block, _ := pem.Decode(certPEM)
+			Expect(block).ToNot(BeNil())
+			cert, err := x509.ParseCertificate(block.Bytes)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cert.Subject.CommonName).To(Equal("Test DB"))
+			Expect(cert.ExtKeyUsage).To(ContainElement(x509.ExtKeyUsageCodeSigning))
+
+			Expect(WriteFile(filepath.Join(tmpDir, "sb.pem"), certPEM, 0o644, false)).To(Succeed())
+			Expect(WriteFile(filepath.Join(tmpDir, "sb.key"), keyPEM, 0o600, false)).To(Succeed())
+			sb, err := pesign.NewSecureBootSigner(filepath.Join(tmpDir, "sb.pem"), filepath.Join(tmpDir, "sb.key"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sb.Certificate().Subject.CommonName).To(Equal("Test DB"))
+		})
+		It("Fails without a common name", func() {
+			_, _, err := GenerateSecureBootKey(SecureBootOptions{})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("GeneratePCRKey", func() {
+		It("Generates a key usable by the PCR signer", func() {
+			privatePEM, publicPEM, err := GeneratePCRKey(0)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(WriteFile(filepath.Join(tmpDir, "pcr.pem"), privatePEM, 0o600, false)).To(Succeed())
+			signer, err := pesign.NewPCRSigner(filepath.Join(tmpDir, "pcr.pem"))
+			Expect(err).ToNot(HaveOccurred())
+
+			block, _ := pem.Decode(publicPEM)
+			Expect(block).ToNot(BeNil())
+			public, err := x509.ParsePKIXPublicKey(block.Bytes)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(signer.PublicRSAKey().Equal(public)).To(BeTrue())
+		})
+	})
+
+	Describe("WriteFile", func() {
+		It("Refuses to overwrite existing files", func() {
+			path := filepath.Join(tmpDir, "file")
+			Expect(WriteFile(path, []byte("first"), 0o600, false)).To(Succeed())
+			Expect(WriteFile(path, []byte("second"), 0o600, false)).ToNot(Succeed())
+			data, err := os.ReadFile(path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(Equal("first"))
+
+			Expect(WriteFile(path, []byte("second"), 0o600, true)).To(Succeed())
+			data, err = os.ReadFile(path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(Equal("second"))
+		})
+	})
+})
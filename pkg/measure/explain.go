@@ -0,0 +1,142 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package measure
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/measure/pcr"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// SectionDigest is the digest of the contents of a single measured section.
+type SectionDigest struct {
+	Section constants.Section `json:"section"`
+	Size    int               `json:"size"`
+	Digest  string            `json:"digest"`
+}
+
+// PCRExplanation is the result of matching an observed PCR value against the expected ones.
+type PCRExplanation struct {
+	Bank     string `json:"bank"`
+	PCR      int    `json:"pcr"`
+	Observed string `json:"observed"`
+	Matched  bool   `json:"matched"`
+	// Phase is the phase path prefix that produced the observed value. Empty means only the sections were measured.
+	Phase string `json:"phase"`
+	// Expected holds the value after every phase path prefix that was tried.
+	Expected []PCRValue `json:"expected"`
+	// Sections holds the digest of every measured section, only set if nothing matched.
+	Sections []SectionDigest `json:"sections,omitempty"`
+}
+
+// ExplainPCR finds the phase the device was in when it reported the observed PCR value.
+//
+// Every prefix of every phase path is measured on top of the sections, including the empty one,
+// until one matches the observed value. If none does, the digest of each section is reported instead,
+// so they can be compared against the ones of the expected inputs.
+func ExplainPCR(sections map[constants.Section][]byte, phasePaths [][]types.PhaseInfo, alg tpm2.TPMAlgID, observed []byte, PCR int) (*PCRExplanation, error) {
+	hashAlg, err := alg.Hash()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(observed) != hashAlg.Size() {
+		return nil, fmt.Errorf("observed value has %d bytes but %s digests have %d", len(observed), types.BankName(alg), hashAlg.Size())
+	}
+
+	sectionsHash, err := pcr.MeasureSectionsData(alg, sections)
+	if err != nil {
+		return nil, err
+	}
+
+	explanation := &PCRExplanation{
+		Bank:     types.BankName(alg),
+		PCR:      PCR,
+		Observed: hex.EncodeToString(observed),
+	}
+
+	// The sections alone are what the stub leaves behind before any phase is measured
+	tried := map[string]bool{"": true}
+	explanation.Expected = append(explanation.Expected, PCRValue{PCR: PCR, Hash: hex.EncodeToString(sectionsHash.Hash())})
+	if bytes.Equal(sectionsHash.Hash(), observed) {
+		explanation.Matched = true
+		return explanation, nil
+	}
+
+	for _, path := range phasePaths {
+		hash := sectionsHash.Clone()
+		for i, phase := range path {
+			hash = pcr.MeasurePhase(phase, alg, hash)
+			prefix := types.PhasesToString(path[:i+1])
+			if tried[prefix] {
+				continue
+			}
+			tried[prefix] = true
+
+			explanation.Expected = append(explanation.Expected, PCRValue{Phase: prefix, PCR: PCR, Hash: hex.EncodeToString(hash.Hash())})
+			if bytes.Equal(hash.Hash(), observed) {
+				explanation.Matched = true
+				explanation.Phase = prefix
+				return explanation, nil
+			}
+		}
+	}
+
+	for _, section := range constants.OrderedSections() {
+		data, ok := sections[section]
+		if !ok {
+			continue
+		}
+		h := hashAlg.New()
+		h.Write(data)
+		explanation.Sections = append(explanation.Sections, SectionDigest{
+			Section: section,
+			Size:    len(data),
+			Digest:  hex.EncodeToString(h.Sum(nil)),
+		})
+	}
+
+	return explanation, nil
+}
+
+// WriteExplanation writes a human readable form of the explanation to w.
+func WriteExplanation(w io.Writer, explanation *PCRExplanation) error {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "Observed %d:%s=%s\n", explanation.PCR, explanation.Bank, explanation.Observed)
+	if explanation.Matched {
+		if explanation.Phase == "" {
+			buf.WriteString("Matches the measured sections before any phase was measured\n")
+		} else {
+			fmt.Fprintf(&buf, "Matches phase: %s\n", explanation.Phase)
+		}
+		_, err := w.Write(buf.Bytes())
+		return err
+	}
+
+	buf.WriteString("No phase matches, expected values:\n")
+	for _, value := range explanation.Expected {
+		phase := value.Phase
+		if phase == "" {
+			phase = "(sections only)"
+		}
+		fmt.Fprintf(&buf, "  %s %s\n", value.Hash, phase)
+	}
+
+	buf.WriteString("Measured sections:\n")
+	for _, section := range explanation.Sections {
+		// PE section names are 8 bytes at most
+		fmt.Fprintf(&buf, "  %-8s %s %d bytes\n", section.Section, section.Digest, section.Size)
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -9,13 +9,18 @@ package measure
 
 import (
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"github.com/google/go-tpm/tpm2"
 	"github.com/kairos-io/go-ukify/pkg/constants"
 	"github.com/kairos-io/go-ukify/pkg/measure/pcr"
 	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/utils"
 	"log/slog"
+	"maps"
 	"os/exec"
 	"regexp"
+	"slices"
 )
 
 // SectionsData holds a map of Section to file path to the corresponding section.
@@ -23,46 +28,251 @@ type SectionsData map[constants.Section]string
 
 // GenerateSignedPCR generates the PCR signed data for a given set of UKI file sections.
 func GenerateSignedPCR(sectionsData SectionsData, phases []types.PhaseInfo, rsaKey types.RSAKey, PCR int) (*types.PCRData, error) {
-	data := &types.PCRData{}
+	return GenerateSignedPCRWithKeys(sectionsData, [][]types.PhaseInfo{phases}, []types.PCRKey{{Signer: rsaKey}}, nil, nil, nil, PCR)
+}
+
+// GenerateSignedPCRWithKeys generates the PCR signed data for a given set of UKI file sections, signing
+// with several keys.
+//
+// Each phase path is measured independently starting from the sections, and a policy is signed for every
+// step of the path. Steps already signed by a previous path, I.E. a shared prefix, are not signed again.
+// Each key only signs the policies for the phases it is restricted to, and the resulting banks contain
+// one entry per key and phase, grouped by key in the given order.
+// Only the given PCR banks are measured and signed, or all of them if none are given.
+// The policies bind the measured PCR together with the extra PCRs at their expected values.
+// The policies are signed concurrently on the given pool, or one sized to the number of CPUs if nil, and
+// all the signing errors are returned joined.
+func GenerateSignedPCRWithKeys(sectionsData SectionsData, phasePaths [][]types.PhaseInfo, keys []types.PCRKey, banks []tpm2.TPMAlgID, extraPCRs []types.PolicyPCR, pool *utils.Pool, PCR int) (*types.PCRData, error) {
 	slog.Debug("Generating PCR data", "sections", sectionsData)
 
+	for _, extra := range extraPCRs {
+		if extra.PCR == PCR {
+			return nil, fmt.Errorf("PCR %d is already the measured PCR", PCR)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no PCR signing keys given")
+	}
+
+	for _, key := range keys {
+		if key.Signer == nil {
+			return nil, errors.New("PCR signing key without a signer")
+		}
+		for _, keyPhase := range key.Phases {
+			if !slices.ContainsFunc(phasePaths, func(path []types.PhaseInfo) bool {
+				return slices.ContainsFunc(path, func(p types.PhaseInfo) bool { return p.Phase == keyPhase.Phase })
+			}) {
+				return nil, fmt.Errorf("PCR signing key restricted to phase %s which is not measured", keyPhase.Phase)
+			}
+		}
+	}
+
+	data, algos, err := types.GetTPMALGorithmForBanks(banks)
+	if err != nil {
+		return nil, err
+	}
+	sectionsHashes, err := measureSections(sectionsData, algos)
+	if err != nil {
+		return nil, err
+	}
+
+	// A policy to sign for a bank, key and step, in the order they end up in the banks
+	type policy struct {
+		alg    tpm2.TPMAlgID
+		step   string
+		key    types.PCRKey
+		values map[int][]byte
+	}
+
+	bankPolicies := make([][]policy, len(algos))
+	for a, alg := range algos {
+		pcrValues := map[int][]byte{}
+		for _, extra := range extraPCRs {
+			pcrValues[extra.PCR], err = ExpectedPCRValue(extra, alg.Alg)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		keyPolicies := make([][]policy, len(keys))
+		sectionsHash := sectionsHashes[alg.Alg]
+		signed := map[string]bool{}
+		for _, path := range phasePaths {
+			hash := sectionsHash.Clone()
+			for i, phase := range path {
+				hash = pcr.MeasurePhase(phase, alg.Alg, hash)
+				step := types.PhasesToString(path[:i+1])
+				if signed[step] {
+					continue
+				}
+				signed[step] = true
+				pcrValues[PCR] = hash.Hash()
+				for k, key := range keys {
+					if !key.SignsPhase(phase) {
+						continue
+					}
+					keyPolicies[k] = append(keyPolicies[k], policy{alg: alg.Alg, step: step, key: key, values: maps.Clone(pcrValues)})
+				}
+			}
+		}
+		for _, p := range keyPolicies {
+			bankPolicies[a] = append(bankPolicies[a], p...)
+		}
+	}
+
+	if pool == nil {
+		pool = utils.NewPool(0)
+	}
+
+	// Sign all the policies concurrently, each one into its own slot so the order doesn't depend on which
+	// signature finishes first
+	signatures := pool.Group()
+	bankData := make([][]types.BankData, len(algos))
+	for a := range algos {
+		bankData[a] = make([]types.BankData, len(bankPolicies[a]))
+		for i, p := range bankPolicies[a] {
+			signatures.Go(func() error {
+				bank, err := pcr.SignPolicyPCRs(p.values, p.alg, p.key.Signer)
+				if err != nil {
+					return fmt.Errorf("error signing the %s policy for phase %s: %w", types.BankName(p.alg), p.step, err)
+				}
+				bankData[a][i] = bank
+				return nil
+			})
+		}
+	}
+
+	if err = signatures.Wait(); err != nil {
+		return nil, err
+	}
+
+	for a, alg := range algos {
+		*alg.BankDataSetter = bankData[a]
+	}
+
+	return data, nil
+}
+
+// measureSections measures the sections for all the given algorithms, reading each section only once
+func measureSections(sectionsData SectionsData, algos []types.Algorithm) (map[tpm2.TPMAlgID]*pcr.Digest, error) {
+	ids := make([]tpm2.TPMAlgID, 0, len(algos))
+	for _, alg := range algos {
+		ids = append(ids, alg.Alg)
+	}
+	return pcr.MeasureSectionsBanks(ids, sectionsData)
+}
+
+// ExpectedPCRValue returns the value of an extra PCR for the given bank.
+//
+// If no value was given for the bank it is predicted, which is only possible for PCR 12 when nothing
+// else than the UKI is booted: systemd-stub only extends it for command line overrides, credentials
+// and add-ons, so it stays unextended.
+func ExpectedPCRValue(policyPCR types.PolicyPCR, alg tpm2.TPMAlgID) ([]byte, error) {
+	hashAlg, err := alg.Hash()
+	if err != nil {
+		return nil, err
+	}
+
+	if value, ok := policyPCR.Values[alg]; ok {
+		if len(value) != hashAlg.Size() {
+			return nil, fmt.Errorf("PCR %d %s value has %d bytes, expected %d", policyPCR.PCR, types.BankName(alg), len(value), hashAlg.Size())
+		}
+		return value, nil
+	}
+
+	if policyPCR.PCR == constants.KernelConfigPCR {
+		slog.Debug("Predicting unextended PCR", "pcr", policyPCR.PCR, "alg", types.BankName(alg))
+		return make([]byte, hashAlg.Size()), nil
+	}
+
+	return nil, fmt.Errorf("no %s value given for PCR %d and it can't be predicted", types.BankName(alg), policyPCR.PCR)
+}
+
+// SignPCRValues signs a policy for every given precomputed PCR value, without measuring anything.
+//
+// Each PCR and bank pair gets its own entry, so several values for the same PCR can be given as
+// alternatives, I.E. the expected PCR 11 value at different phases.
+func SignPCRValues(values []types.PolicyPCR, rsaKey types.RSAKey) (*types.PCRData, error) {
 	data, algos := types.GetTPMALGorithm()
 	for _, alg := range algos {
-		banks := make([]types.BankData, 0)
-		hash, err := pcr.MeasureSections(alg.Alg, sectionsData)
-		if err != nil {
-			return nil, err
+		for _, value := range values {
+			if _, ok := value.Values[alg.Alg]; !ok {
+				continue
+			}
+			expected, err := ExpectedPCRValue(value, alg.Alg)
+			if err != nil {
+				return nil, err
+			}
+			bank, err := pcr.SignPolicyPCRs(map[int][]byte{value.PCR: expected}, alg.Alg, rsaKey)
+			if err != nil {
+				return nil, err
+			}
+			*alg.BankDataSetter = append(*alg.BankDataSetter, bank)
 		}
-		for _, phase := range phases {
-			hash = pcr.MeasurePhase(phase, alg.Alg, hash)
-			bank, err := pcr.SignPolicy(PCR, alg.Alg, rsaKey, hash)
+	}
+
+	return data, nil
+}
+
+// SignCombinedPCRValues signs a single policy per bank binding all the given precomputed PCR values together.
+func SignCombinedPCRValues(values []types.PolicyPCR, rsaKey types.RSAKey) (*types.PCRData, error) {
+	data, algos := types.GetTPMALGorithm()
+	for _, alg := range algos {
+		pcrValues := map[int][]byte{}
+		for _, value := range values {
+			if _, ok := value.Values[alg.Alg]; !ok {
+				continue
+			}
+			if _, ok := pcrValues[value.PCR]; ok {
+				return nil, fmt.Errorf("PCR %d given more than once for %s", value.PCR, types.BankName(alg.Alg))
+			}
+			expected, err := ExpectedPCRValue(value, alg.Alg)
 			if err != nil {
 				return nil, err
 			}
-			banks = append(banks, bank)
+			pcrValues[value.PCR] = expected
+		}
+		if len(pcrValues) == 0 {
+			continue
+		}
+		bank, err := pcr.SignPolicyPCRs(pcrValues, alg.Alg, rsaKey)
+		if err != nil {
+			return nil, err
 		}
-		*alg.BankDataSetter = banks
+		*alg.BankDataSetter = []types.BankData{bank}
 	}
 
 	return data, nil
 }
 
-// GenerateMeasurements generates the PCR measurements for a given set of UKI file sections and phases
-func GenerateMeasurements(sectionsData SectionsData, phases []types.PhaseInfo, PCR int) {
+// GenerateMeasurements generates the PCR measurements for a given set of UKI file sections and phase paths
+// for the given PCR banks, or all of them if none are given.
+func GenerateMeasurements(sectionsData SectionsData, phasePaths [][]types.PhaseInfo, banks []tpm2.TPMAlgID, PCR int) error {
 	slog.Debug("Generating PCR data", "sections", sectionsData)
 	slog.Info("Not signing data, just outputting it to stdout")
-	slog.Info("legend: <PHASE:PCR:ALGORITHM=HASH>")
+	slog.Info("legend: <PHASE PATH:PCR:ALGORITHM=HASH>")
 
-	_, algos := types.GetTPMALGorithm()
+	_, algos, err := types.GetTPMALGorithmForBanks(banks)
+	if err != nil {
+		return err
+	}
+	sectionsHashes, err := measureSections(sectionsData, algos)
+	if err != nil {
+		return err
+	}
 	for _, alg := range algos {
-		hash, _ := pcr.MeasureSections(alg.Alg, sectionsData)
-		for _, phase := range phases {
-			pcr.MeasurePhase(phase, alg.Alg, hash)
-			al, _ := alg.Alg.Hash()
-			slog.Info(fmt.Sprintf("%s:%d:%s=%s", phase.Phase, PCR, al.String(), hex.EncodeToString(hash.Hash())))
+		for _, path := range phasePaths {
+			hash := sectionsHashes[alg.Alg].Clone()
+			for i, phase := range path {
+				pcr.MeasurePhase(phase, alg.Alg, hash)
+				al, _ := alg.Alg.Hash()
+				slog.Info(fmt.Sprintf("%s:%d:%s=%s", types.PhasesToString(path[:i+1]), PCR, al.String(), hex.EncodeToString(hash.Hash())))
+			}
 		}
 
 	}
+	return nil
 }
 
 func PrintSystemdMeasurements(phase string, sectionsData SectionsData, privKey string) {
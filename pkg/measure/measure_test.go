@@ -0,0 +1,319 @@
+package measure
+
+import (
+	"crypto"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/keys"
+	"github.com/kairos-io/go-ukify/pkg/measure/pcr"
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/utils"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Measure test Suite")
+}
+
+var errSigning = errors.New("signer unavailable")
+
+// failingSigner is a PCR signer whose signatures always fail, like an unreachable remote signer
+type failingSigner struct {
+	*pesign.PCRSigner
+}
+
+func (failingSigner) Sign(io.Reader, []byte, crypto.SignerOpts) ([]byte, error) {
+	return nil, errSigning
+}
+
+var _ = Describe("Measure tests", func() {
+	var mainSigner, initrdSigner *pesign.PCRSigner
+	var tmpDir string
+	var err error
+
+	BeforeEach(func() {
+		mainSigner, err = pesign.NewPCRSigner("pcr/testdata/private.pem")
+		Expect(err).ToNot(HaveOccurred())
+
+		tmpDir, err = os.MkdirTemp("", "measure")
+		Expect(err).ToNot(HaveOccurred())
+
+		privatePEM, _, err := keys.GeneratePCRKey(0)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.WriteFile(filepath.Join(tmpDir, "initrd.pem"), privatePEM, 0o600)).To(Succeed())
+		initrdSigner, err = pesign.NewPCRSigner(filepath.Join(tmpDir, "initrd.pem"))
+		Expect(err).ToNot(HaveOccurred())
+	})
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmpDir)).ToNot(HaveOccurred())
+	})
+
+	Describe("GenerateSignedPCRWithKeys", func() {
+		It("Signs each phase only with the keys restricted to it", func() {
+			data, err := GenerateSignedPCRWithKeys(nil, [][]types.PhaseInfo{types.OrderedPhases()}, []types.PCRKey{
+				{Signer: mainSigner},
+				{Signer: initrdSigner, Phases: []types.PhaseInfo{{Phase: constants.EnterInitrd}}},
+			}, nil, nil, nil, constants.UKIPCR)
+			Expect(err).ToNot(HaveOccurred())
+
+			single, err := GenerateSignedPCR(nil, types.OrderedPhases(), mainSigner, constants.UKIPCR)
+			Expect(err).ToNot(HaveOccurred())
+
+			// All the phases for the main key, then only enter-initrd for the initrd one
+			Expect(data.SHA256).To(HaveLen(5))
+			Expect(data.SHA256[:4]).To(Equal(single.SHA256))
+			Expect(data.SHA256[4].Pol).To(Equal(single.SHA256[0].Pol))
+			Expect(data.SHA256[4].PKFP).ToNot(Equal(single.SHA256[0].PKFP))
+			Expect(data.SHA512).To(HaveLen(5))
+		})
+		It("Fails if a key is restricted to a phase that is not measured", func() {
+			_, err := GenerateSignedPCRWithKeys(nil, [][]types.PhaseInfo{types.OrderedPhases()[:1]}, []types.PCRKey{
+				{Signer: initrdSigner, Phases: []types.PhaseInfo{{Phase: constants.Ready}}},
+			}, nil, nil, nil, constants.UKIPCR)
+			Expect(err).To(HaveOccurred())
+		})
+		It("Only signs the selected banks", func() {
+			data, err := GenerateSignedPCRWithKeys(nil, [][]types.PhaseInfo{types.OrderedPhases()}, []types.PCRKey{{Signer: mainSigner}},
+				[]tpm2.TPMAlgID{tpm2.TPMAlgSHA256, tpm2.TPMAlgSHA384}, nil, nil, constants.UKIPCR)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(data.SHA1).To(BeEmpty())
+			Expect(data.SHA256).To(HaveLen(4))
+			Expect(data.SHA384).To(HaveLen(4))
+			Expect(data.SHA512).To(BeEmpty())
+
+			out, err := json.Marshal(data)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(out)).ToNot(ContainSubstring("sha1"))
+			Expect(string(out)).ToNot(ContainSubstring("sha512"))
+		})
+		It("Rejects unknown banks", func() {
+			_, err := GenerateSignedPCRWithKeys(nil, [][]types.PhaseInfo{types.OrderedPhases()}, []types.PCRKey{{Signer: mainSigner}},
+				[]tpm2.TPMAlgID{tpm2.TPMAlgSM3256}, nil, nil, constants.UKIPCR)
+			Expect(err).To(HaveOccurred())
+		})
+		It("Signs every independent phase path once", func() {
+			initrdOnly, err := types.ParsePhases("enter-initrd:shutdown:final")
+			Expect(err).ToNot(HaveOccurred())
+
+			data, err := GenerateSignedPCRWithKeys(nil, [][]types.PhaseInfo{types.OrderedPhases(), initrdOnly},
+				[]types.PCRKey{{Signer: mainSigner}}, nil, nil, nil, constants.UKIPCR)
+			Expect(err).ToNot(HaveOccurred())
+
+			single, err := GenerateSignedPCR(nil, types.OrderedPhases(), mainSigner, constants.UKIPCR)
+			Expect(err).ToNot(HaveOccurred())
+
+			// The shared enter-initrd step is only signed once
+			Expect(data.SHA256).To(HaveLen(6))
+			Expect(data.SHA256[:4]).To(Equal(single.SHA256))
+			Expect(data.SHA256[4].Pol).ToNot(Equal(single.SHA256[1].Pol))
+		})
+		It("Rejects unknown phases", func() {
+			_, err := types.ParsePhases("enter-initrd:bogus")
+			Expect(err).To(HaveOccurred())
+			_, err = types.ParsePhases("enter-initrd::ready")
+			Expect(err).To(HaveOccurred())
+		})
+		It("Binds extra PCRs into the policy", func() {
+			pcr7, err := types.ParsePolicyPCR("7:sha256=" + strings.Repeat("ab", 32))
+			Expect(err).ToNot(HaveOccurred())
+			pcr12, err := types.ParsePolicyPCR("12")
+			Expect(err).ToNot(HaveOccurred())
+
+			data, err := GenerateSignedPCRWithKeys(nil, [][]types.PhaseInfo{types.OrderedPhases()}, []types.PCRKey{{Signer: mainSigner}},
+				[]tpm2.TPMAlgID{tpm2.TPMAlgSHA256}, []types.PolicyPCR{pcr12, pcr7}, nil, constants.UKIPCR)
+			Expect(err).ToNot(HaveOccurred())
+
+			single, err := GenerateSignedPCR(nil, types.OrderedPhases(), mainSigner, constants.UKIPCR)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(data.SHA256).To(HaveLen(4))
+			Expect(data.SHA256[0].PCRs).To(Equal([]int{7, 11, 12}))
+			Expect(data.SHA256[0].Pol).ToNot(Equal(single.SHA256[0].Pol))
+
+			// PCR 7 can't be predicted
+			_, err = GenerateSignedPCRWithKeys(nil, [][]types.PhaseInfo{types.OrderedPhases()}, []types.PCRKey{{Signer: mainSigner}},
+				[]tpm2.TPMAlgID{tpm2.TPMAlgSHA384}, []types.PolicyPCR{pcr7}, nil, constants.UKIPCR)
+			Expect(err).To(HaveOccurred())
+		})
+		It("Signs in the same order regardless of the number of workers", func() {
+			keys := []types.PCRKey{
+				{Signer: mainSigner},
+				{Signer: initrdSigner, Phases: []types.PhaseInfo{{Phase: constants.EnterInitrd}}},
+			}
+			serial, err := GenerateSignedPCRWithKeys(nil, [][]types.PhaseInfo{types.OrderedPhases()}, keys, nil, nil, utils.NewPool(1), constants.UKIPCR)
+			Expect(err).ToNot(HaveOccurred())
+			parallel, err := GenerateSignedPCRWithKeys(nil, [][]types.PhaseInfo{types.OrderedPhases()}, keys, nil, nil, utils.NewPool(8), constants.UKIPCR)
+			Expect(err).ToNot(HaveOccurred())
+
+			for _, banks := range [][2][]types.BankData{
+				{serial.SHA1, parallel.SHA1},
+				{serial.SHA256, parallel.SHA256},
+				{serial.SHA384, parallel.SHA384},
+				{serial.SHA512, parallel.SHA512},
+			} {
+				Expect(banks[1]).To(HaveLen(len(banks[0])))
+				for i := range banks[0] {
+					Expect(banks[1][i].Pol).To(Equal(banks[0][i].Pol))
+					Expect(banks[1][i].PKFP).To(Equal(banks[0][i].PKFP))
+				}
+			}
+		})
+		It("Returns the errors of every failed signature", func() {
+			_, err := GenerateSignedPCRWithKeys(nil, [][]types.PhaseInfo{types.OrderedPhases()[:2]}, []types.PCRKey{{Signer: failingSigner{mainSigner}}},
+				[]tpm2.TPMAlgID{tpm2.TPMAlgSHA256, tpm2.TPMAlgSHA384}, nil, nil, constants.UKIPCR)
+			Expect(err).To(HaveOccurred())
+			// two banks and two phases
+			Expect(strings.Count(err.Error(), errSigning.Error())).To(Equal(4))
+		})
+		It("Rejects invalid extra PCRs", func() {
+			_, err := types.ParsePolicyPCR("24")
+			Expect(err).To(HaveOccurred())
+			_, err = types.ParsePolicyPCR("7:sha256=abcd")
+			Expect(err).To(HaveOccurred())
+			_, err = types.ParsePolicyPCR("7:md5=abcd")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("SignPCRValues", func() {
+		It("Signs the same policy as the measured value", func() {
+			single, err := GenerateSignedPCR(nil, types.OrderedPhases(), mainSigner, constants.UKIPCR)
+			Expect(err).ToNot(HaveOccurred())
+
+			// PCR 11 after extending enter-initrd with no sections
+			hashAlg, _ := tpm2.TPMAlgSHA256.Hash()
+			digest := pcr.NewDigest(hashAlg)
+			digest.Extend([]byte(constants.EnterInitrd))
+
+			data, err := SignPCRValues([]types.PolicyPCR{
+				{PCR: constants.UKIPCR, Values: map[tpm2.TPMAlgID][]byte{tpm2.TPMAlgSHA256: digest.Hash()}},
+			}, mainSigner)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(data.SHA1).To(BeEmpty())
+			Expect(data.SHA256).To(HaveLen(1))
+			Expect(data.SHA256[0]).To(Equal(single.SHA256[0]))
+		})
+		It("Combines the values in a single policy per bank", func() {
+			pcr7, err := types.ParsePolicyPCR("7:sha256=" + strings.Repeat("ab", 32))
+			Expect(err).ToNot(HaveOccurred())
+			pcr11, err := types.ParsePolicyPCR("11:sha256=" + strings.Repeat("cd", 32))
+			Expect(err).ToNot(HaveOccurred())
+
+			data, err := SignCombinedPCRValues([]types.PolicyPCR{pcr11, pcr7}, mainSigner)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(data.SHA256).To(HaveLen(1))
+			Expect(data.SHA256[0].PCRs).To(Equal([]int{7, 11}))
+
+			_, err = SignCombinedPCRValues([]types.PolicyPCR{pcr7, pcr7}, mainSigner)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("systemd-measure compatibility", func() {
+		It("Calculates the final value of every phase path", func() {
+			calculation, err := Calculate(nil, DefaultSystemdPhasePaths(), []tpm2.TPMAlgID{tpm2.TPMAlgSHA256}, constants.UKIPCR)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(calculation).To(HaveKey("sha256"))
+			Expect(calculation).ToNot(HaveKey("sha1"))
+			Expect(calculation["sha256"]).To(HaveLen(4))
+
+			hashAlg, _ := tpm2.TPMAlgSHA256.Hash()
+			digest := pcr.NewDigest(hashAlg)
+			digest.Extend([]byte(constants.EnterInitrd))
+			Expect(calculation["sha256"][0].Phase).To(Equal("enter-initrd"))
+			Expect(calculation["sha256"][0].PCR).To(Equal(constants.UKIPCR))
+			Expect(calculation["sha256"][0].Hash).To(Equal(hex.EncodeToString(digest.Hash())))
+		})
+		It("Signs the same policies as the builder", func() {
+			data, err := Sign(nil, DefaultSystemdPhasePaths(), mainSigner, nil, constants.UKIPCR)
+			Expect(err).ToNot(HaveOccurred())
+
+			single, err := GenerateSignedPCR(nil, types.OrderedPhases(), mainSigner, constants.UKIPCR)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(data.SHA256).To(Equal(single.SHA256))
+			Expect(data.SHA512).To(Equal(single.SHA512))
+		})
+		It("Formats JSON like systemd-measure", func() {
+			out, err := MarshalSystemdJSON(Calculation{"sha256": {{Phase: "enter-initrd", PCR: 11, Hash: "ab"}}}, "pretty")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(out)).To(Equal("{\n\t\"sha256\" : [\n\t\t{\n\t\t\t\"phase\" : \"enter-initrd\",\n" +
+				"\t\t\t\"pcr\" : 11,\n\t\t\t\"hash\" : \"ab\"\n\t\t}\n\t]\n}\n"))
+
+			_, err = MarshalSystemdJSON(Calculation{}, "bogus")
+			Expect(err).To(HaveOccurred())
+		})
+		It("Writes only the values to the output and the phase headers to the info writer", func() {
+			calculation := Calculation{"sha256": {
+				{Phase: "enter-initrd", PCR: 11, Hash: "ab"},
+				{Phase: "enter-initrd:leave-initrd", PCR: 11, Hash: "cd"},
+			}}
+			phasePaths := [][]types.PhaseInfo{
+				{{Phase: constants.EnterInitrd}},
+				{{Phase: constants.EnterInitrd}, {Phase: constants.LeaveInitrd}},
+			}
+			var out, info strings.Builder
+			Expect(WriteCalculation(&out, &info, calculation, []tpm2.TPMAlgID{tpm2.TPMAlgSHA256}, phasePaths)).To(Succeed())
+			Expect(out.String()).To(Equal("11:sha256=ab\n11:sha256=cd\n"))
+			Expect(info.String()).To(Equal("# Phase: enter-initrd\n\n# Phase: enter-initrd:leave-initrd\n"))
+		})
+	})
+
+	Describe("ExplainPCR", func() {
+		var sections map[constants.Section][]byte
+
+		BeforeEach(func() {
+			sections = map[constants.Section][]byte{
+				constants.Linux:   []byte("kernel"),
+				constants.CMDLine: []byte("console=ttyS0"),
+			}
+		})
+
+		It("Finds the phase matching the observed value", func() {
+			Expect(os.WriteFile(filepath.Join(tmpDir, "linux"), sections[constants.Linux], 0o644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(tmpDir, "cmdline"), sections[constants.CMDLine], 0o644)).To(Succeed())
+			calculation, err := Calculate(SectionsData{
+				constants.Linux:   filepath.Join(tmpDir, "linux"),
+				constants.CMDLine: filepath.Join(tmpDir, "cmdline"),
+			}, DefaultSystemdPhasePaths(), []tpm2.TPMAlgID{tpm2.TPMAlgSHA256}, constants.UKIPCR)
+			Expect(err).ToNot(HaveOccurred())
+
+			observed, err := hex.DecodeString(calculation["sha256"][2].Hash)
+			Expect(err).ToNot(HaveOccurred())
+
+			explanation, err := ExplainPCR(sections, [][]types.PhaseInfo{types.OrderedPhases()}, tpm2.TPMAlgSHA256, observed, constants.UKIPCR)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(explanation.Matched).To(BeTrue())
+			Expect(explanation.Phase).To(Equal("enter-initrd:leave-initrd:sysinit"))
+			Expect(explanation.Sections).To(BeEmpty())
+		})
+		It("Reports the section digests if nothing matches", func() {
+			observed := make([]byte, 32)
+			explanation, err := ExplainPCR(sections, [][]types.PhaseInfo{types.OrderedPhases()}, tpm2.TPMAlgSHA256, observed, constants.UKIPCR)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(explanation.Matched).To(BeFalse())
+			// The sections alone plus every phase
+			Expect(explanation.Expected).To(HaveLen(5))
+			Expect(explanation.Sections).To(HaveLen(2))
+			Expect(explanation.Sections[0].Section).To(Equal(constants.Linux))
+			Expect(explanation.Sections[1].Section).To(Equal(constants.CMDLine))
+			Expect(explanation.Sections[1].Size).To(Equal(len("console=ttyS0")))
+		})
+		It("Rejects values of the wrong size for the bank", func() {
+			_, err := ExplainPCR(sections, [][]types.PhaseInfo{types.OrderedPhases()}, tpm2.TPMAlgSHA384, make([]byte, 32), constants.UKIPCR)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -5,6 +5,7 @@
 package pcr
 
 import (
+	"crypto"
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/hex"
@@ -12,8 +13,11 @@ import (
 	"github.com/google/go-tpm/tpm2"
 	"github.com/kairos-io/go-ukify/pkg/constants"
 	"github.com/kairos-io/go-ukify/pkg/types"
+	"hash"
+	"io"
 	"log/slog"
 	"os"
+	"slices"
 )
 
 // CalculateBankData calculates the PCR bank data for a given set of UKI file sections.
@@ -99,31 +103,125 @@ func CalculateBankData(pcrNumber int, phases []types.PhaseInfo, alg tpm2.TPMAlgI
 
 // MeasureSections would measure the given sections for a given TPM algorithm
 func MeasureSections(alg tpm2.TPMAlgID, sectionData map[constants.Section]string) (*Digest, error) {
-	var hashData *Digest
+	digests, err := MeasureSectionsBanks([]tpm2.TPMAlgID{alg}, sectionData)
+	if err != nil {
+		return nil, err
+	}
+	return digests[alg], nil
+}
 
-	hashAlg, err := alg.Hash()
+// MeasureSectionsBanks measures the given sections for several TPM algorithms at once, returning one Digest per algorithm.
+//
+// Each section file is only read once, see SectionDigestsBanks.
+func MeasureSectionsBanks(algs []tpm2.TPMAlgID, sectionData map[constants.Section]string) (map[tpm2.TPMAlgID]*Digest, error) {
+	sectionDigests, err := SectionDigestsBanks(algs, sectionData)
+	if err != nil {
+		return nil, err
+	}
+
+	hashData := make(map[tpm2.TPMAlgID]*Digest, len(algs))
+	for _, alg := range algs {
+		hashAlg, _ := alg.Hash()
+		hashData[alg] = NewDigest(hashAlg)
+		for _, digest := range sectionDigests[alg] {
+			hashData[alg].ExtendDigest(digest)
+		}
+	}
+	return hashData, nil
+}
+
+// SectionDigests returns the digests the given sections extend the PCR with for a given TPM algorithm,
+// in measurement order: for each section, its NULL terminated name and then its contents.
+func SectionDigests(alg tpm2.TPMAlgID, sectionData map[constants.Section]string) ([][]byte, error) {
+	digests, err := SectionDigestsBanks([]tpm2.TPMAlgID{alg}, sectionData)
 	if err != nil {
-		return hashData, err
+		return nil, err
 	}
+	return digests[alg], nil
+}
 
-	hashData = NewDigest(hashAlg)
+// SectionDigestsBanks is like SectionDigests, but for several TPM algorithms at once.
+//
+// Each section file is streamed once through the hashes of all the algorithms, so memory use doesn't
+// depend on the size of the sections nor on the number of algorithms.
+func SectionDigestsBanks(algs []tpm2.TPMAlgID, sectionData map[constants.Section]string) (map[tpm2.TPMAlgID][][]byte, error) {
+	hashAlgs := make([]crypto.Hash, len(algs))
+	for i, alg := range algs {
+		hashAlg, err := alg.Hash()
+		if err != nil {
+			return nil, err
+		}
+		hashAlgs[i] = hashAlg
+	}
 
+	digests := make(map[tpm2.TPMAlgID][][]byte, len(algs))
 	for _, section := range constants.OrderedSections() {
-		if file := sectionData[section]; file != "" {
-			slog.Debug("Measuring section", "section", section, "alg", hashAlg.String())
+		file := sectionData[section]
+		if file == "" {
+			continue
+		}
+		slog.Debug("Measuring section", "section", section, "banks", len(algs))
 
-			sectionD, err := os.ReadFile(file)
-			if err != nil {
-				return hashData, err
-			}
+		hashes := make([]hash.Hash, len(algs))
+		writers := make([]io.Writer, len(algs))
+		for i, hashAlg := range hashAlgs {
 			// NULL terminated, thats why we adding the 0 at the end
-			hashData.Extend(append([]byte(section), 0))
-			hashData.Extend(sectionD)
+			h := hashAlg.New()
+			h.Write(append([]byte(section), 0))
+			digests[algs[i]] = append(digests[algs[i]], h.Sum(nil))
+
+			hashes[i] = hashAlg.New()
+			writers[i] = hashes[i]
+		}
+
+		if err := hashFile(file, io.MultiWriter(writers...)); err != nil {
+			return nil, err
+		}
+
+		for i, h := range hashes {
+			digests[algs[i]] = append(digests[algs[i]], h.Sum(nil))
+		}
+	}
+	return digests, nil
+}
+
+// hashFile streams the contents of the file into w
+func hashFile(path string, w io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close() //nolint:errcheck
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// MeasureSectionsData is like MeasureSections, but takes the contents of the sections instead of their paths
+func MeasureSectionsData(alg tpm2.TPMAlgID, sectionData map[constants.Section][]byte) (*Digest, error) {
+	hashAlg, err := alg.Hash()
+	if err != nil {
+		return nil, err
+	}
+
+	hashData := NewDigest(hashAlg)
+
+	for _, section := range constants.OrderedSections() {
+		if data, ok := sectionData[section]; ok {
+			slog.Debug("Measuring section", "section", section, "alg", hashAlg.String())
+			extendSection(hashData, section, data)
 		}
 	}
 	return hashData, nil
 }
 
+// extendSection extends the digest with the section name and its contents, like the systemd stub does
+func extendSection(hashData *Digest, section constants.Section, data []byte) {
+	// NULL terminated, thats why we adding the 0 at the end
+	hashData.Extend(append([]byte(section), 0))
+	hashData.Extend(data)
+}
+
 // MeasurePhase will measure the given phase
 func MeasurePhase(phase types.PhaseInfo, alg tpm2.TPMAlgID, hashData *Digest) *Digest {
 	hashAlg, _ := alg.Hash()
@@ -141,11 +239,19 @@ func MeasurePhase(phase types.PhaseInfo, alg tpm2.TPMAlgID, hashData *Digest) *D
 
 // SignPolicy will calculate and sign a policy for a given Digest, PCR and algorithm
 func SignPolicy(pcrNumber int, alg tpm2.TPMAlgID, rsaKey types.RSAKey, hashData *Digest) (types.BankData, error) {
+	return SignPolicyPCRs(map[int][]byte{pcrNumber: hashData.Hash()}, alg, rsaKey)
+}
+
+// SignPolicyPCRs will calculate and sign a policy binding all the given PCR values for an algorithm
+//
+// The resulting BankData lists every selected PCR index in ascending order.
+func SignPolicyPCRs(pcrValues map[int][]byte, alg tpm2.TPMAlgID, rsaKey types.RSAKey) (types.BankData, error) {
 	var bankData types.BankData
-	hash := hashData.Hash()
 	pubKeyFingerprint := sha256.Sum256(x509.MarshalPKCS1PublicKey(rsaKey.PublicRSAKey()))
 
-	pcrSelector, err := CreateSelector([]int{pcrNumber})
+	pcrNumbers := sortedPCRs(pcrValues)
+
+	pcrSelector, err := CreateSelector(pcrNumbers)
 	if err != nil {
 		return bankData, fmt.Errorf("failed to create PCR selection: %v", err)
 	}
@@ -159,13 +265,16 @@ func SignPolicy(pcrNumber int, alg tpm2.TPMAlgID, rsaKey types.RSAKey, hashData
 		},
 	}
 
-	policyPCR, err := CalculatePolicy(hash, pcrSelection)
+	policyPCR, err := CalculatePolicy(ConcatPCRValues(pcrValues), pcrSelection)
 
 	if err != nil {
 		return bankData, err
 	}
 
 	hashAlg, err := alg.Hash()
+	if err != nil {
+		return bankData, err
+	}
 
 	sigData, err := Sign(policyPCR, hashAlg, rsaKey)
 	if err != nil {
@@ -177,7 +286,7 @@ func SignPolicy(pcrNumber int, alg tpm2.TPMAlgID, rsaKey types.RSAKey, hashData
 	slog.Debug("signed policy", "Sig", sigData.SignatureBase64)
 
 	return types.BankData{
-		PCRs: []int{pcrNumber},
+		PCRs: pcrNumbers,
 		PKFP: hex.EncodeToString(pubKeyFingerprint[:]),
 		Sig:  sigData.SignatureBase64,
 		Pol:  sigData.Digest,
@@ -185,6 +294,25 @@ func SignPolicy(pcrNumber int, alg tpm2.TPMAlgID, rsaKey types.RSAKey, hashData
 
 }
 
+// ConcatPCRValues concatenates the PCR values in ascending PCR index order, which is the order the TPM
+// uses to compute the PCR digest of a multi PCR selection.
+func ConcatPCRValues(pcrValues map[int][]byte) []byte {
+	var values []byte
+	for _, n := range sortedPCRs(pcrValues) {
+		values = append(values, pcrValues[n]...)
+	}
+	return values
+}
+
+func sortedPCRs(pcrValues map[int][]byte) []int {
+	pcrNumbers := make([]int, 0, len(pcrValues))
+	for n := range pcrValues {
+		pcrNumbers = append(pcrNumbers, n)
+	}
+	slices.Sort(pcrNumbers)
+	return pcrNumbers
+}
+
 // CreateSelector converts PCR  numbers into a bitmask.
 func CreateSelector(pcrs []int) ([]byte, error) {
 	// From https://trustedcomputinggroup.org/resource/pc-client-platform-tpm-profile-ptp-specification/
@@ -206,6 +334,8 @@ func CreateSelector(pcrs []int) ([]byte, error) {
 }
 
 // CalculatePolicy calculates the policy hash for a given PCR value and PCR selection.
+//
+// For selections with several PCRs, pcrValue is the concatenation of their values, see ConcatPCRValues.
 func CalculatePolicy(pcrValue []byte, pcrSelection tpm2.TPMLPCRSelection) ([]byte, error) {
 	calculator, err := tpm2.NewPolicyCalculator(tpm2.TPMAlgSHA256)
 	if err != nil {
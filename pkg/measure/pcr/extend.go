@@ -32,17 +32,28 @@ func (d *Digest) Hash() []byte {
 	return d.hash
 }
 
+// Clone returns a copy of the Digest that can be extended independently.
+func (d *Digest) Clone() *Digest {
+	return &Digest{
+		alg:  d.alg,
+		hash: append([]byte(nil), d.hash...),
+	}
+}
+
 // Extend extends the current hash with the specified data.
 func (d *Digest) Extend(data []byte) {
 	// create hash of incoming data
 	hash := d.alg.New()
 	hash.Write(data)
-	hashSum := hash.Sum(nil)
+	d.ExtendDigest(hash.Sum(nil))
+}
 
+// ExtendDigest extends the current hash with an already hashed value, like replaying an event log does.
+func (d *Digest) ExtendDigest(digest []byte) {
 	// extend hash with previous data and hashed incoming data
-	hash = d.alg.New()
+	hash := d.alg.New()
 	hash.Write(d.hash)
-	hash.Write(hashSum)
+	hash.Write(digest)
 
 	// set sum as new hash
 	d.hash = hash.Sum(nil)
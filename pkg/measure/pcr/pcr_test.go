@@ -333,4 +333,48 @@ var _ = Describe("PCR tests", func() {
 			Expect(hash.Hash()).ToNot(Equal([]byte("5d34a81817bcb7f1856a6e0484572077846d73e9ac5c82bac8d1ee049e2db43e")))
 		})
 	})
+	Describe("MeasureSectionsBanks", func() {
+		It("Streams the sections into every bank with the same result as measuring their contents", func() {
+			dir, err := os.MkdirTemp("", "")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(dir) //nolint:errcheck
+
+			// Bigger than the copy buffer so it is hashed in several chunks
+			initrd := make([]byte, 1024*1024+17)
+			for i := range initrd {
+				initrd[i] = byte(i % 251)
+			}
+			Expect(os.WriteFile(filepath.Join(dir, "initrd"), initrd, 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "cmdline"), []byte("root=LABEL=BOOT"), 0o600)).To(Succeed())
+
+			sectionsData := map[constants.Section]string{
+				constants.Initrd:  filepath.Join(dir, "initrd"),
+				constants.CMDLine: filepath.Join(dir, "cmdline"),
+			}
+			banks := []tpm2.TPMAlgID{tpm2.TPMAlgSHA1, tpm2.TPMAlgSHA256, tpm2.TPMAlgSHA384, tpm2.TPMAlgSHA512}
+
+			digests, err := MeasureSectionsBanks(banks, sectionsData)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(digests).To(HaveLen(len(banks)))
+
+			for _, bank := range banks {
+				expected, err := MeasureSectionsData(bank, map[constants.Section][]byte{
+					constants.Initrd:  initrd,
+					constants.CMDLine: []byte("root=LABEL=BOOT"),
+				})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(digests[bank].Hash()).To(Equal(expected.Hash()))
+
+				single, err := MeasureSections(bank, sectionsData)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(single.Hash()).To(Equal(expected.Hash()))
+			}
+		})
+		It("Fails on missing section files", func() {
+			_, err := MeasureSectionsBanks([]tpm2.TPMAlgID{tpm2.TPMAlgSHA256}, map[constants.Section]string{
+				constants.Linux: filepath.Join(tmpDir, "does-not-exist"),
+			})
+			Expect(err).To(HaveOccurred())
+		})
+	})
 })
@@ -0,0 +1,238 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package measure
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/kairos-io/go-ukify/pkg/measure/pcr"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// PCRValue is the expected value of a PCR after a phase path, as output by 'systemd-measure calculate'.
+type PCRValue struct {
+	Phase string `json:"phase,omitempty"`
+	PCR   int    `json:"pcr"`
+	Hash  string `json:"hash"`
+}
+
+// Calculation holds the expected PCR values per bank name.
+type Calculation map[string][]PCRValue
+
+// DefaultSystemdPhasePaths returns the phase paths systemd-measure uses when none are given.
+//
+// Unlike the builder, systemd-measure measures each path independently and only outputs its final value.
+func DefaultSystemdPhasePaths() [][]types.PhaseInfo {
+	phases := types.OrderedPhases()
+	paths := make([][]types.PhaseInfo, 0, len(phases))
+	for i := range phases {
+		paths = append(paths, phases[:i+1])
+	}
+	return paths
+}
+
+// Calculate mimics 'systemd-measure calculate': it returns the PCR value at the end of each phase path
+// for the given banks, or all of them if none are given.
+func Calculate(sectionsData SectionsData, phasePaths [][]types.PhaseInfo, banks []tpm2.TPMAlgID, PCR int) (Calculation, error) {
+	_, algos, err := types.GetTPMALGorithmForBanks(banks)
+	if err != nil {
+		return nil, err
+	}
+
+	sectionsHashes, err := measureSections(sectionsData, algos)
+	if err != nil {
+		return nil, err
+	}
+
+	calculation := Calculation{}
+	for _, alg := range algos {
+		sectionsHash := sectionsHashes[alg.Alg]
+		name := types.BankName(alg.Alg)
+		for _, path := range phasePaths {
+			hash := measurePath(sectionsHash, path, alg.Alg)
+			calculation[name] = append(calculation[name], PCRValue{
+				Phase: types.PhasesToString(path),
+				PCR:   PCR,
+				Hash:  hex.EncodeToString(hash.Hash()),
+			})
+		}
+	}
+
+	return calculation, nil
+}
+
+// Sign mimics 'systemd-measure sign': it signs the PCR value at the end of each phase path for the given
+// banks, or all of them if none are given.
+func Sign(sectionsData SectionsData, phasePaths [][]types.PhaseInfo, rsaKey types.RSAKey, banks []tpm2.TPMAlgID, PCR int) (*types.PCRData, error) {
+	data, algos, err := types.GetTPMALGorithmForBanks(banks)
+	if err != nil {
+		return nil, err
+	}
+
+	sectionsHashes, err := measureSections(sectionsData, algos)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, alg := range algos {
+		for _, path := range phasePaths {
+			bank, err := pcr.SignPolicy(PCR, alg.Alg, rsaKey, measurePath(sectionsHashes[alg.Alg], path, alg.Alg))
+			if err != nil {
+				return nil, err
+			}
+			*alg.BankDataSetter = append(*alg.BankDataSetter, bank)
+		}
+	}
+
+	return data, nil
+}
+
+// measurePath extends a copy of the sections digest with every phase of the path
+func measurePath(sectionsHash *pcr.Digest, path []types.PhaseInfo, alg tpm2.TPMAlgID) *pcr.Digest {
+	hash := sectionsHash.Clone()
+	for _, phase := range path {
+		if phase.Phase == "" {
+			continue
+		}
+		hash = pcr.MeasurePhase(phase, alg, hash)
+	}
+	return hash
+}
+
+// WriteCalculation writes the calculation in the 'systemd-measure calculate' text format, one
+// PCR:BANK=HASH line per bank to w. If there is more than one phase path, each group of lines is
+// preceded by a "# Phase:" header written to info, which systemd-measure sends to stderr so that
+// only the values end up on stdout.
+func WriteCalculation(w, info io.Writer, calculation Calculation, banks []tpm2.TPMAlgID, phasePaths [][]types.PhaseInfo) error {
+	_, algos, err := types.GetTPMALGorithmForBanks(banks)
+	if err != nil {
+		return err
+	}
+
+	for i, path := range phasePaths {
+		if len(phasePaths) > 1 {
+			if i > 0 {
+				fmt.Fprintln(info)
+			}
+			fmt.Fprintf(info, "# Phase: %s\n", types.PhasesToString(path))
+		}
+		for _, alg := range algos {
+			name := types.BankName(alg.Alg)
+			value := calculation[name][i]
+			if _, err := fmt.Fprintf(w, "%d:%s=%s\n", value.PCR, name, value.Hash); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// MarshalSystemdJSON marshals v in the systemd JSON format, either "short" or "pretty".
+func MarshalSystemdJSON(v any, format string) ([]byte, error) {
+	compact, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case "short":
+		return append(compact, '\n'), nil
+	case "pretty":
+		return prettySystemdJSON(compact)
+	}
+
+	return nil, fmt.Errorf("unknown JSON format %q, valid formats are pretty, short and off", format)
+}
+
+// prettySystemdJSON re-indents compact JSON the way systemd's json_variant_dump does: tab
+// indentation and " : " between keys and values.
+func prettySystemdJSON(compact []byte) ([]byte, error) {
+	var out bytes.Buffer
+	dec := json.NewDecoder(bytes.NewReader(compact))
+	dec.UseNumber()
+
+	// Track, per nesting level, whether we are in an object and how many elements were written
+	type level struct {
+		object bool
+		count  int
+		key    bool
+	}
+	var stack []*level
+
+	indent := func(n int) {
+		out.WriteString(strings.Repeat("\t", n))
+	}
+
+	// before writes the separator and indentation needed before a value or key
+	before := func() {
+		if len(stack) == 0 {
+			return
+		}
+		top := stack[len(stack)-1]
+		if top.object && top.key {
+			// value right after its key
+			top.key = false
+			return
+		}
+		if top.count > 0 {
+			out.WriteString(",")
+		}
+		out.WriteString("\n")
+		indent(len(stack))
+		top.count++
+		if top.object {
+			top.key = true
+		}
+	}
+
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case json.Delim:
+			switch t {
+			case '{', '[':
+				before()
+				out.WriteRune(rune(t))
+				stack = append(stack, &level{object: t == '{'})
+			case '}', ']':
+				top := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				if top.count > 0 {
+					out.WriteString("\n")
+					indent(len(stack))
+				}
+				out.WriteRune(rune(t))
+			}
+		default:
+			isKey := len(stack) > 0 && stack[len(stack)-1].object && !stack[len(stack)-1].key
+			before()
+			encoded, err := json.Marshal(t)
+			if err != nil {
+				return nil, err
+			}
+			out.Write(encoded)
+			if isKey {
+				out.WriteString(" : ")
+			}
+		}
+	}
+
+	out.WriteString("\n")
+	return out.Bytes(), nil
+}
@@ -0,0 +1,122 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package pcrlock generates the .pcrlock files systemd-pcrlock uses to build its PCR policies.
+package pcrlock
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/measure/pcr"
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// File names for the UKI components, following the numbering systemd-pcrlock uses for 'lock-uki'.
+const (
+	UKIAuthenticodeFile = "650-uki-authenticode.pcrlock"
+	UKISectionsFile     = "660-uki-sections.pcrlock"
+)
+
+// Digest is the digest of a measurement in a single bank.
+type Digest struct {
+	HashAlg string `json:"hashAlg"`
+	Digest  string `json:"digest"`
+}
+
+// Record is a single measurement extended into a PCR, with its digest in every bank.
+type Record struct {
+	PCR     int      `json:"pcr"`
+	Digests []Digest `json:"digests"`
+}
+
+// PCRLock is the contents of a .pcrlock file: the measurements of a boot component, in order.
+type PCRLock struct {
+	Records []Record `json:"records"`
+}
+
+// UKISections returns the PCR 11 measurements of the given sections, per bank or all of them if none are given.
+func UKISections(sectionsData map[constants.Section]string, banks []tpm2.TPMAlgID) (*PCRLock, error) {
+	_, algos, err := types.GetTPMALGorithmForBanks(banks)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]tpm2.TPMAlgID, 0, len(algos))
+	for _, alg := range algos {
+		ids = append(ids, alg.Alg)
+	}
+
+	sectionDigests, err := pcr.SectionDigestsBanks(ids, sectionsData)
+	if err != nil {
+		return nil, err
+	}
+
+	lock := &PCRLock{}
+	for _, alg := range algos {
+		digests := sectionDigests[alg.Alg]
+
+		if lock.Records == nil {
+			lock.Records = make([]Record, len(digests))
+		}
+
+		for i, digest := range digests {
+			lock.Records[i].PCR = constants.UKIPCR
+			lock.Records[i].Digests = append(lock.Records[i].Digests, Digest{
+				HashAlg: types.BankName(alg.Alg),
+				Digest:  hex.EncodeToString(digest),
+			})
+		}
+	}
+
+	return lock, nil
+}
+
+// Authenticode returns the PCR 4 measurement the boot loader makes when loading the PE binary at path,
+// per bank or all of them if none are given.
+func Authenticode(path string, banks []tpm2.TPMAlgID) (*PCRLock, error) {
+	_, algos, err := types.GetTPMALGorithmForBanks(banks)
+	if err != nil {
+		return nil, err
+	}
+
+	record := Record{PCR: constants.BootLoaderCodePCR}
+	for _, alg := range algos {
+		hashAlg, err := alg.Alg.Hash()
+		if err != nil {
+			return nil, err
+		}
+
+		digest, err := pesign.AuthenticodeHash(path, hashAlg)
+		if err != nil {
+			return nil, err
+		}
+
+		record.Digests = append(record.Digests, Digest{
+			HashAlg: types.BankName(alg.Alg),
+			Digest:  hex.EncodeToString(digest),
+		})
+	}
+
+	return &PCRLock{Records: []Record{record}}, nil
+}
+
+// Write writes the .pcrlock file to path.
+func (p *PCRLock) Write(path string) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
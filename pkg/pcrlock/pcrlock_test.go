@@ -0,0 +1,100 @@
+package pcrlock
+
+import (
+	"crypto"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/measure/pcr"
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Pcrlock test Suite")
+}
+
+var _ = Describe("Pcrlock tests", func() {
+	var tmpDir string
+	var sectionsData map[constants.Section]string
+	var err error
+
+	BeforeEach(func() {
+		tmpDir, err = os.MkdirTemp("", "pcrlock")
+		Expect(err).ToNot(HaveOccurred())
+
+		sectionsData = map[constants.Section]string{
+			constants.Linux:   filepath.Join(tmpDir, "linux"),
+			constants.CMDLine: filepath.Join(tmpDir, "cmdline"),
+		}
+		Expect(os.WriteFile(sectionsData[constants.Linux], []byte("kernel"), 0o644)).To(Succeed())
+		Expect(os.WriteFile(sectionsData[constants.CMDLine], []byte("console=ttyS0"), 0o644)).To(Succeed())
+	})
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmpDir)).ToNot(HaveOccurred())
+	})
+
+	Describe("UKISections", func() {
+		It("Records the same measurements as MeasureSections", func() {
+			lock, err := UKISections(sectionsData, []tpm2.TPMAlgID{tpm2.TPMAlgSHA256, tpm2.TPMAlgSHA384})
+			Expect(err).ToNot(HaveOccurred())
+
+			// Name and contents for each section
+			Expect(lock.Records).To(HaveLen(4))
+			for i, alg := range []tpm2.TPMAlgID{tpm2.TPMAlgSHA256, tpm2.TPMAlgSHA384} {
+				hashAlg, _ := alg.Hash()
+				digest := pcr.NewDigest(hashAlg)
+				for _, record := range lock.Records {
+					Expect(record.PCR).To(Equal(constants.UKIPCR))
+					Expect(record.Digests).To(HaveLen(2))
+					value, err := hex.DecodeString(record.Digests[i].Digest)
+					Expect(err).ToNot(HaveOccurred())
+					digest.ExtendDigest(value)
+				}
+
+				measured, err := pcr.MeasureSections(alg, sectionsData)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(digest.Hash()).To(Equal(measured.Hash()))
+			}
+		})
+	})
+
+	Describe("Authenticode", func() {
+		It("Records the Authenticode hash of the PE", func() {
+			lock, err := Authenticode("../pesign/testdata/file.efi", []tpm2.TPMAlgID{tpm2.TPMAlgSHA256})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(lock.Records).To(HaveLen(1))
+			Expect(lock.Records[0].PCR).To(Equal(constants.BootLoaderCodePCR))
+
+			hash, err := pesign.AuthenticodeHash("../pesign/testdata/file.efi", crypto.SHA256)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(lock.Records[0].Digests).To(Equal([]Digest{{HashAlg: "sha256", Digest: hex.EncodeToString(hash)}}))
+		})
+	})
+
+	Describe("Write", func() {
+		It("Writes the systemd-pcrlock JSON format", func() {
+			lock, err := UKISections(sectionsData, []tpm2.TPMAlgID{tpm2.TPMAlgSHA256})
+			Expect(err).ToNot(HaveOccurred())
+
+			path := filepath.Join(tmpDir, "pcrlock.d", UKISectionsFile)
+			Expect(lock.Write(path)).To(Succeed())
+
+			data, err := os.ReadFile(path)
+			Expect(err).ToNot(HaveOccurred())
+			var parsed map[string][]map[string]any
+			Expect(json.Unmarshal(data, &parsed)).To(Succeed())
+			Expect(parsed["records"]).To(HaveLen(4))
+			Expect(parsed["records"][0]).To(HaveKeyWithValue("pcr", BeNumerically("==", 11)))
+			Expect(parsed["records"][0]["digests"]).To(ContainElement(HaveKeyWithValue("hashAlg", "sha256")))
+		})
+	})
+})
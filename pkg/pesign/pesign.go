@@ -8,6 +8,7 @@ package pesign
 import (
 	"crypto"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
@@ -15,8 +16,10 @@ import (
 	"io"
 	"log/slog"
 	"os"
+	"time"
 
 	"github.com/foxboron/go-uefi/authenticode"
+	"github.com/foxboron/go-uefi/pkcs7"
 	"github.com/kairos-io/go-ukify/pkg/types"
 )
 
@@ -38,8 +41,24 @@ func NewSigner(provider CertificateSigner) (*Signer, error) {
 	}, nil
 }
 
+// Certificate returns the certificate the signatures are made with.
+func (s *Signer) Certificate() *x509.Certificate {
+	return s.provider.Certificate()
+}
+
 // Sign signs the input file and writes the output to the output file.
+//
+// The signature carries no signing time, so signing the same file twice gives the same output.
 func (s *Signer) Sign(input, output string) error {
+	return s.SignAt(input, output, time.Time{})
+}
+
+// SignAt is like Sign, but records the given signing time in the signature, I.E. SOURCE_DATE_EPOCH. It fails
+// for signing times CheckSigningTime rejects.
+func (s *Signer) SignAt(input, output string, signingTime time.Time) error {
+	if err := CheckSigningTime(signingTime); err != nil {
+		return err
+	}
 	if _, err := os.Stat(input); errors.Is(err, os.ErrNotExist) {
 		return fmt.Errorf("%s does not exist", input)
 	}
@@ -76,11 +95,16 @@ func (s *Signer) Sign(input, output string) error {
 		return err
 	}
 
-	_, err = peBinary.Sign(s.provider.Signer(), s.provider.Certificate())
+	digest := sha256.Sum256(peBinary.HashContent.Bytes())
+	sig, err := signAuthenticode(s.provider.Signer(), s.provider.Certificate(), digest[:], signingTime)
 	if err != nil {
 		return err
 	}
 
+	if err = peBinary.AppendSignature(sig); err != nil {
+		return fmt.Errorf("failed appending signature: %w", err)
+	}
+
 	if err = os.WriteFile(output, peBinary.Bytes(), si.Mode()); err != nil {
 		return err
 	}
@@ -236,3 +260,51 @@ func NewPCRSigner(keyPath string) (*PCRSigner, error) {
 	//rsaKeyParsed := rsaKey.(*rsa.PrivateKey)
 	return &PCRSigner{rsaKey}, nil
 }
+
+// AuthenticodeHash returns the Authenticode digest of the PE file.
+//
+// This is the hash firmware checks against db/dbx and extends into PCR 4 when loading the binary.
+func AuthenticodeHash(path string, hash crypto.Hash) ([]byte, error) {
+	peFile, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer peFile.Close()
+
+	peBinary, err := authenticode.Parse(peFile)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return peBinary.Hash(hash), nil
+}
+
+// SignerCertificates returns the certificates embedded in the Authenticode signatures of the PE file.
+func SignerCertificates(path string) ([]*x509.Certificate, error) {
+	peFile, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer peFile.Close()
+
+	peBinary, err := authenticode.Parse(peFile)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	sigs, err := peBinary.Signatures()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	var certs []*x509.Certificate
+	for _, sig := range sigs {
+		parsed, err := pkcs7.ParsePKCS7(sig.Certificate)
+		if err != nil {
+			return nil, fmt.Errorf("%s: failed parsing signature: %w", path, err)
+		}
+		certs = append(certs, parsed.Certs...)
+	}
+
+	return certs, nil
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -66,5 +67,46 @@ var _ = Describe("Pesign tests", func() {
 
 		})
 
+		It("Signs reproducibly", func() {
+			first := filepath.Join(tmpDir, "first.signed.efi")
+			second := filepath.Join(tmpDir, "second.signed.efi")
+			Expect(sbSigner.Sign("testdata/file.efi", first)).ToNot(HaveOccurred())
+			Expect(sbSigner.Sign("testdata/file.efi", second)).ToNot(HaveOccurred())
+
+			firstData, err := os.ReadFile(first)
+			Expect(err).ToNot(HaveOccurred())
+			secondData, err := os.ReadFile(second)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(firstData).To(Equal(secondData))
+
+			// A signing time changes the signature, but it stays the same between runs and verifies
+			dated := filepath.Join(tmpDir, "dated.signed.efi")
+			Expect(sbSigner.SignAt("testdata/file.efi", dated, time.Unix(1700000000, 0))).ToNot(HaveOccurred())
+			datedData, err := os.ReadFile(dated)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(datedData).ToNot(Equal(firstData))
+
+			Expect(sbSigner.SignAt("testdata/file.efi", second, time.Unix(1700000000, 0))).ToNot(HaveOccurred())
+			secondData, err = os.ReadFile(second)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(secondData).To(Equal(datedData))
+
+			ok, err := sbSigner.VerifyFile(dated)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeTrue())
+		})
+
+		It("Rejects signing times past 2049 instead of panicking", func() {
+			last := filepath.Join(tmpDir, "last.signed.efi")
+			Expect(sbSigner.SignAt("testdata/file.efi", last, time.Unix(2524607999, 0))).ToNot(HaveOccurred())
+			ok, err := sbSigner.VerifyFile(last)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeTrue())
+
+			Expect(sbSigner.SignAt("testdata/file.efi", filepath.Join(tmpDir, "2050.signed.efi"), time.Unix(2524608000, 0))).
+				To(MatchError(ContainSubstring("only years 1950 to 2049")))
+			Expect(sbSigner.SignAt("testdata/file.efi", filepath.Join(tmpDir, "2065.signed.efi"), time.Unix(3000000000, 0))).
+				To(MatchError(ContainSubstring("only years 1950 to 2049")))
+		})
 	})
 })
@@ -0,0 +1,147 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package pesign
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	encasn1 "encoding/asn1"
+	"fmt"
+	"time"
+
+	"github.com/foxboron/go-uefi/authenticode"
+	"github.com/foxboron/go-uefi/pkcs7"
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/cryptobyte/asn1"
+)
+
+// CheckSigningTime fails if the signing time can't be recorded in a signature.
+//
+// The signing time is a UTCTime, the only encoding go-uefi parses when verifying signatures, which only
+// represents the years 1950 to 2049. A zero time records no signing time, so it is always valid.
+func CheckSigningTime(signingTime time.Time) error {
+	if signingTime.IsZero() {
+		return nil
+	}
+	if year := signingTime.UTC().Year(); year < 1950 || year > 2049 {
+		return fmt.Errorf("signing time %s can't be recorded in a signature, only years 1950 to 2049 can", signingTime.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// signAuthenticode returns the Authenticode signature of a PE binary with the given Authenticode hash.
+//
+// It builds the same PKCS#7 SignedData as authenticode.SignAuthenticode, but records signingTime as the
+// signing time, or no signing time at all if it is zero, instead of the current time. RSA PKCS#1 v1.5
+// signatures being deterministic, signing the same binary twice gives the same signature.
+func signAuthenticode(signer crypto.Signer, cert *x509.Certificate, digest []byte, signingTime time.Time) ([]byte, error) {
+	content, err := authenticode.CreateSpcIndirectDataContent(digest, crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating SpcIndirectDataContent: %w", err)
+	}
+
+	h := crypto.SHA256.New()
+	h.Write(content)
+	attrs := &pkcs7.Attributes{
+		ContentType:   authenticode.OIDSpcIndirectDataContent,
+		MessageDigest: h.Sum(nil),
+		SigningTime:   signingTime.UTC(),
+	}
+	attributes := attrs.Marshal()
+
+	h = crypto.SHA256.New()
+	h.Write(attributes)
+	sig, err := signer.Sign(rand.Reader, h.Sum(nil), crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("failed signing binary: %w", err)
+	}
+
+	return signedData(cert, authenticode.OIDSpcIndirectDataContent, content, attributes, sig)
+}
+
+// signedData encodes the PKCS#7 ContentInfo wrapping a SignedData with a single signer, see RFC 2315.
+func signedData(cert *x509.Certificate, oid encasn1.ObjectIdentifier, content, attributes, sig []byte) ([]byte, error) {
+	var b cryptobyte.Builder
+
+	// ContentInfo ::= SEQUENCE
+	b.AddASN1(asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+		b.AddASN1ObjectIdentifier(pkcs7.OIDSignedData)
+
+		// content [0] EXPLICIT SignedData
+		b.AddASN1(asn1.Tag(0).ContextSpecific().Constructed(), func(b *cryptobyte.Builder) {
+			b.AddASN1(asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+				// version
+				b.AddASN1Int64(1)
+
+				// digestAlgorithms
+				b.AddASN1(asn1.SET, func(b *cryptobyte.Builder) {
+					addSHA256AlgorithmIdentifier(b)
+				})
+
+				// contentInfo
+				b.AddASN1(asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+					b.AddASN1ObjectIdentifier(oid)
+					b.AddASN1(asn1.Tag(0).ContextSpecific().Constructed(), func(b *cryptobyte.Builder) {
+						b.AddASN1(asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+							b.AddBytes(content)
+						})
+					})
+				})
+
+				// certificates [0] IMPLICIT
+				b.AddASN1(asn1.Tag(0).ContextSpecific().Constructed(), func(b *cryptobyte.Builder) {
+					b.AddBytes(cert.Raw)
+				})
+
+				// signerInfos
+				b.AddASN1(asn1.SET, func(b *cryptobyte.Builder) {
+					b.AddASN1(asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+						// version
+						b.AddASN1Int64(1)
+
+						// issuerAndSerialNumber
+						b.AddASN1(asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+							b.AddBytes(cert.RawIssuer)
+							b.AddASN1BigInt(cert.SerialNumber)
+						})
+
+						// digestAlgorithm
+						addSHA256AlgorithmIdentifier(b)
+
+						// authenticatedAttributes [0] IMPLICIT, the SET tag is replaced
+						b.AddASN1(asn1.Tag(0).ContextSpecific().Constructed(), func(b *cryptobyte.Builder) {
+							outer := cryptobyte.String(attributes)
+							var inner cryptobyte.String
+							if !outer.ReadASN1(&inner, asn1.SET) {
+								b.SetError(fmt.Errorf("invalid authenticated attributes"))
+								return
+							}
+							b.AddBytes(inner)
+						})
+
+						// digestEncryptionAlgorithm
+						b.AddASN1(asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+							b.AddASN1ObjectIdentifier(pkcs7.OIDEncryptionAlgorithmRSA)
+							b.AddASN1NULL()
+						})
+
+						// encryptedDigest
+						b.AddASN1OctetString(sig)
+					})
+				})
+			})
+		})
+	})
+
+	return b.Bytes()
+}
+
+func addSHA256AlgorithmIdentifier(b *cryptobyte.Builder) {
+	b.AddASN1(asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+		b.AddASN1ObjectIdentifier(pkcs7.OIDDigestAlgorithmSHA256)
+		b.AddASN1NULL()
+	})
+}
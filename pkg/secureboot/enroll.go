@@ -0,0 +1,117 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package secureboot
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/foxboron/go-uefi/efi/util"
+	"github.com/foxboron/go-uefi/efivar"
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+)
+
+// EnrollKeysDir is the directory in the ESP where sd-boot looks for key sets to enroll.
+const EnrollKeysDir = "loader/keys"
+
+// EnrollmentFiles is the set of signed variables sd-boot enrolls.
+type EnrollmentFiles struct {
+	PK  []byte
+	KEK []byte
+	DB  []byte
+}
+
+// Enrollment describes the keys to build the sd-boot auto-enrollment files from.
+type Enrollment struct {
+	// Owner GUID of all the signature entries.
+	Owner util.EFIGUID
+	// Platform key, self-signed and used to sign the KEK.
+	PK pesign.CertificateSigner
+	// Key exchange key, used to sign db.
+	KEK pesign.CertificateSigner
+	// Certificates to add to db, usually the one used to sign the UKIs plus any vendor certificates.
+	DB []*x509.Certificate
+}
+
+// Generate creates the signed PK, KEK and db variables.
+func (e *Enrollment) Generate() (*EnrollmentFiles, error) {
+	if e.PK == nil || e.KEK == nil {
+		return nil, errors.New("both PK and KEK are needed to generate the enrollment files")
+	}
+
+	if len(e.DB) == 0 {
+		return nil, errors.New("no certificates given for db")
+	}
+
+	files := &EnrollmentFiles{}
+
+	for _, v := range []struct {
+		variable efivar.Efivar
+		certs    []*x509.Certificate
+		signer   pesign.CertificateSigner
+		out      *[]byte
+	}{
+		{efivar.PK, []*x509.Certificate{e.PK.Certificate()}, e.PK, &files.PK},
+		{efivar.KEK, []*x509.Certificate{e.KEK.Certificate()}, e.PK, &files.KEK},
+		{efivar.Db, e.DB, e.KEK, &files.DB},
+	} {
+		db, err := CertificateDatabase(e.Owner, v.certs...)
+		if err != nil {
+			return nil, err
+		}
+
+		slog.Debug("Signing variable", "variable", v.variable.Name, "signer", v.signer.Certificate().Subject.String(), "lists", len(*db))
+
+		*v.out, err = SignVariable(v.variable, db, v.signer)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+// Write lays out the files in the sd-boot structure, under <espDir>/loader/keys/<name>/.
+func (f *EnrollmentFiles) Write(espDir, name string, overwrite bool) (string, error) {
+	if name == "" || filepath.Base(name) != name {
+		return "", fmt.Errorf("invalid key set name %q", name)
+	}
+
+	dir := filepath.Join(espDir, EnrollKeysDir, name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"PK.auth", f.PK},
+		{"KEK.auth", f.KEK},
+		{"db.auth", f.DB},
+	}
+
+	// Check everything up front so we don't leave a partial key set behind
+	if !overwrite {
+		for _, file := range files {
+			path := filepath.Join(dir, file.name)
+			if _, err := os.Stat(path); err == nil {
+				return "", fmt.Errorf("%s already exists, refusing to overwrite it", path)
+			}
+		}
+	}
+
+	for _, file := range files {
+		if err := os.WriteFile(filepath.Join(dir, file.name), file.data, 0o644); err != nil {
+			return "", err
+		}
+	}
+
+	return dir, nil
+}
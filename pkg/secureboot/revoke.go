@@ -0,0 +1,142 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package secureboot
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/foxboron/go-uefi/efi/attributes"
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/go-uefi/efi/util"
+	"github.com/foxboron/go-uefi/efivar"
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+)
+
+// Revocation describes the dbx entries to author.
+type Revocation struct {
+	// Owner GUID of all the signature entries.
+	Owner util.EFIGUID
+	// Authenticode SHA-256 hashes of the binaries to revoke.
+	Hashes [][]byte
+	// Certificates to revoke.
+	Certificates []*x509.Certificate
+}
+
+// AddBinary adds the Authenticode SHA-256 hash of the PE file to the revocation.
+func (r *Revocation) AddBinary(path string) ([]byte, error) {
+	hash, err := pesign.AuthenticodeHash(path, crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	r.Hashes = append(r.Hashes, hash)
+
+	return hash, nil
+}
+
+// Database creates the dbx signature database with an EFI_CERT_SHA256 list for the hashes
+// and EFI_CERT_X509 entries for the certificates.
+func (r *Revocation) Database() (*signature.SignatureDatabase, error) {
+	if len(r.Hashes) == 0 && len(r.Certificates) == 0 {
+		return nil, errors.New("nothing to revoke")
+	}
+
+	db := signature.NewSignatureDatabase()
+
+	for _, hash := range r.Hashes {
+		if err := db.Append(signature.CERT_SHA256_GUID, r.Owner, hash); err != nil {
+			if errors.Is(err, signature.ErrSigDataExists) {
+				continue
+			}
+			return nil, fmt.Errorf("failed adding hash %s: %w", hex.EncodeToString(hash), err)
+		}
+	}
+
+	certs, err := CertificateDatabase(r.Owner, r.Certificates...)
+	if err != nil {
+		return nil, err
+	}
+	db.AppendDatabase(certs)
+
+	return db, nil
+}
+
+// Sign creates the dbx database and signs it as an authenticated variable update with the KEK.
+//
+// When appendWrite is set, the update carries EFI_VARIABLE_APPEND_WRITE so firmware adds the entries
+// to the existing dbx instead of replacing it, which would drop the revocations already in place.
+func (r *Revocation) Sign(kek pesign.CertificateSigner, appendWrite bool) ([]byte, error) {
+	db, err := r.Database()
+	if err != nil {
+		return nil, err
+	}
+
+	variable := efivar.Dbx
+	if appendWrite {
+		variable.Attributes |= attributes.EFI_VARIABLE_APPEND_WRITE
+	}
+
+	return SignVariable(variable, db, kek)
+}
+
+// ReadSignatureDatabaseFile reads a signature database from either an .auth file or a raw ESL file.
+func ReadSignatureDatabaseFile(path string) (signature.SignatureDatabase, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, db, err := ReadAuthenticatedVariable(data); err == nil {
+		return db, nil
+	}
+
+	db, err := signature.ReadSignatureDatabase(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s is neither an authenticated variable nor a signature list: %w", path, err)
+	}
+
+	return db, nil
+}
+
+// RevokedBy returns why the PE file is blocked by the dbx database, or an empty string if it isn't.
+//
+// A binary is blocked if its Authenticode SHA-256 hash or any of the certificates it is signed with
+// are in dbx.
+func RevokedBy(dbx signature.SignatureDatabase, path string) (string, error) {
+	hash, err := pesign.AuthenticodeHash(path, crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+
+	certs, err := pesign.SignerCertificates(path)
+	if err != nil {
+		return "", err
+	}
+
+	for _, list := range dbx {
+		for _, sig := range list.Signatures {
+			switch list.SignatureType {
+			case signature.CERT_SHA256_GUID:
+				if bytes.Equal(sig.Data, hash) {
+					return fmt.Sprintf("authenticode hash %s", hex.EncodeToString(hash)), nil
+				}
+			case signature.CERT_X509_GUID:
+				for _, cert := range certs {
+					if bytes.Equal(sig.Data, cert.Raw) {
+						return fmt.Sprintf("certificate %q", cert.Subject.String()), nil
+					}
+				}
+			}
+		}
+	}
+
+	return "", nil
+}
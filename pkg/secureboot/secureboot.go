@@ -0,0 +1,175 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package secureboot builds the UEFI SecureBoot variables (PK, KEK, db, dbx) as signed EFI signature lists.
+package secureboot
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/go-uefi/efi/util"
+	"github.com/foxboron/go-uefi/efivar"
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+)
+
+// NewOwnerGUID returns a random (version 4) GUID to be used as signature owner.
+func NewOwnerGUID() (util.EFIGUID, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return util.EFIGUID{}, err
+	}
+
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return *util.BytesToGUID(b), nil
+}
+
+// ParseOwnerGUID parses a GUID in the usual 8-4-4-4-12 format.
+func ParseOwnerGUID(s string) (util.EFIGUID, error) {
+	decoded, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(decoded) != 16 {
+		return util.EFIGUID{}, fmt.Errorf("invalid GUID %q", s)
+	}
+
+	return *util.BytesToGUID(decoded), nil
+}
+
+// ReadCertificates reads all the certificates in a file.
+//
+// The file can either contain one or more PEM encoded certificates or a single DER encoded one,
+// which is the format vendors usually ship their certificates in.
+func ReadCertificates(path string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: failed to parse certificate: %w", path, err)
+		}
+
+		certs = append(certs, cert)
+	}
+
+	if len(certs) > 0 {
+		return certs, nil
+	}
+
+	cert, err := x509.ParseCertificate(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: no PEM or DER certificate found: %w", path, err)
+	}
+
+	return []*x509.Certificate{cert}, nil
+}
+
+// CertificateDatabase creates a signature database with an EFI_CERT_X509 entry for every certificate.
+func CertificateDatabase(owner util.EFIGUID, certs ...*x509.Certificate) (*signature.SignatureDatabase, error) {
+	db := signature.NewSignatureDatabase()
+
+	for _, cert := range certs {
+		if err := db.Append(signature.CERT_X509_GUID, owner, cert.Raw); err != nil {
+			if errors.Is(err, signature.ErrSigDataExists) {
+				continue
+			}
+			return nil, fmt.Errorf("failed adding certificate %q: %w", cert.Subject.String(), err)
+		}
+	}
+
+	return db, nil
+}
+
+// ReadVariableDatabase reads the contents of a Secure Boot variable, either from an .auth or .esl file,
+// or from certificates that are added with the given owner, like enroll-keys does.
+func ReadVariableDatabase(path string, owner util.EFIGUID) (signature.SignatureDatabase, error) {
+	switch filepath.Ext(path) {
+	case ".auth", ".esl":
+		return ReadSignatureDatabaseFile(path)
+	}
+
+	certs, err := ReadCertificates(path)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := CertificateDatabase(owner, certs...)
+	if err != nil {
+		return nil, err
+	}
+
+	return *db, nil
+}
+
+// SignVariable signs the signature database as a time based authenticated update of the given variable.
+//
+// The returned bytes are the EFI_VARIABLE_AUTHENTICATION_2 header followed by the signature database,
+// which is the format firmware and sd-boot expect in .auth files.
+func SignVariable(variable efivar.Efivar, db *signature.SignatureDatabase, signer pesign.CertificateSigner) ([]byte, error) {
+	_, auth, err := signature.SignEFIVariable(variable, db, signer.Signer(), signer.Certificate())
+	if err != nil {
+		return nil, fmt.Errorf("failed signing %s: %w", variable.Name, err)
+	}
+
+	var b bytes.Buffer
+	auth.Marshal(&b)
+
+	return b.Bytes(), nil
+}
+
+// ReadAuthenticatedVariable splits the contents of an .auth file into its authentication header and the
+// signature database it carries.
+func ReadAuthenticatedVariable(data []byte) (*signature.EFIVariableAuthentication2, signature.SignatureDatabase, error) {
+	// go-uefi aborts the process on malformed headers, so do the basic sanity checks here first
+	const headerSize = util.SizeofEFITime + int(signature.SizeofWinCertificateUEFIGUID)
+	if len(data) < headerSize {
+		return nil, nil, errors.New("authenticated variable is too short")
+	}
+
+	length := binary.LittleEndian.Uint32(data[util.SizeofEFITime:])
+	certType := signature.WINCertType(binary.LittleEndian.Uint16(data[util.SizeofEFITime+6:]))
+	if certType != signature.WIN_CERT_TYPE_EFI_GUID || length < signature.SizeofWinCertificateUEFIGUID || int(length) > len(data)-util.SizeofEFITime {
+		return nil, nil, errors.New("authenticated variable has an invalid header")
+	}
+
+	r := bytes.NewReader(data)
+
+	auth, err := signature.ReadEFIVariableAuthencation2(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	db, err := signature.ReadSignatureDatabase(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return auth, db, nil
+}
@@ -0,0 +1,162 @@
+package secureboot
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/kairos-io/go-ukify/pkg/keys"
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "SecureBoot test Suite")
+}
+
+// newSigner generates a throwaway SecureBoot key pair in dir
+func newSigner(dir, name string) *pesign.SecureBootSigner {
+	certPEM, keyPEM, err := keys.GenerateSecureBootKey(keys.SecureBootOptions{Subject: pkix.Name{CommonName: name}})
+	Expect(err).ToNot(HaveOccurred())
+	Expect(os.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0o600)).To(Succeed())
+	Expect(os.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0o600)).To(Succeed())
+	signer, err := pesign.NewSecureBootSigner(filepath.Join(dir, name+".pem"), filepath.Join(dir, name+".key"))
+	Expect(err).ToNot(HaveOccurred())
+	return signer
+}
+
+var _ = Describe("SecureBoot tests", func() {
+	var tmpDir string
+	var err error
+
+	BeforeEach(func() {
+		tmpDir, err = os.MkdirTemp("", "secureboot")
+		Expect(err).ToNot(HaveOccurred())
+	})
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmpDir)).ToNot(HaveOccurred())
+	})
+
+	Describe("ParseOwnerGUID", func() {
+		It("Round trips a GUID", func() {
+			guid, err := ParseOwnerGUID("d719b2cb-3d3a-4596-a3bc-dad00e67656f")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(guid.Format()).To(Equal("d719b2cb-3d3a-4596-a3bc-dad00e67656f"))
+		})
+		It("Fails on invalid GUIDs", func() {
+			_, err := ParseOwnerGUID("not-a-guid")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("Enrollment", func() {
+		It("Generates the sd-boot enrollment files", func() {
+			pk := newSigner(tmpDir, "PK")
+			kek := newSigner(tmpDir, "KEK")
+			db := newSigner(tmpDir, "DB")
+			vendor := newSigner(tmpDir, "Vendor")
+
+			owner, err := NewOwnerGUID()
+			Expect(err).ToNot(HaveOccurred())
+
+			enrollment := &Enrollment{
+				Owner: owner,
+				PK:    pk,
+				KEK:   kek,
+				DB:    []*x509.Certificate{db.Certificate(), vendor.Certificate()},
+			}
+			files, err := enrollment.Generate()
+			Expect(err).ToNot(HaveOccurred())
+
+			_, pkDB, err := ReadAuthenticatedVariable(files.PK)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pkDB).To(HaveLen(1))
+			Expect(pkDB[0].Signatures[0].Data).To(Equal(pk.Certificate().Raw))
+
+			_, dbDB, err := ReadAuthenticatedVariable(files.DB)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dbDB.SigDataExists(signature.CERT_X509_GUID, &signature.SignatureData{Owner: owner, Data: db.Certificate().Raw})).To(BeTrue())
+			Expect(dbDB.SigDataExists(signature.CERT_X509_GUID, &signature.SignatureData{Owner: owner, Data: vendor.Certificate().Raw})).To(BeTrue())
+
+			dir, err := files.Write(tmpDir, "auto", false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dir).To(Equal(filepath.Join(tmpDir, "loader", "keys", "auto")))
+			for _, name := range []string{"PK.auth", "KEK.auth", "db.auth"} {
+				Expect(filepath.Join(dir, name)).To(BeAnExistingFile())
+			}
+
+			// Never overwrite silently
+			_, err = files.Write(tmpDir, "auto", false)
+			Expect(err).To(HaveOccurred())
+		})
+		It("Rejects garbage auth files", func() {
+			_, _, err := ReadAuthenticatedVariable([]byte("garbage"))
+			Expect(err).To(HaveOccurred())
+			_, _, err = ReadAuthenticatedVariable(make([]byte, 64))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("Revocation", func() {
+		It("Blocks revoked binaries by hash", func() {
+			owner, err := NewOwnerGUID()
+			Expect(err).ToNot(HaveOccurred())
+
+			revocation := &Revocation{Owner: owner}
+			hash, err := revocation.AddBinary("../pesign/testdata/file.efi")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(hash).To(HaveLen(32))
+
+			kek := newSigner(tmpDir, "KEK")
+			auth, err := revocation.Sign(kek, true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(os.WriteFile(filepath.Join(tmpDir, "dbx.auth"), auth, 0o644)).To(Succeed())
+
+			dbx, err := ReadSignatureDatabaseFile(filepath.Join(tmpDir, "dbx.auth"))
+			Expect(err).ToNot(HaveOccurred())
+			reason, err := RevokedBy(dbx, "../pesign/testdata/file.efi")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reason).To(ContainSubstring("authenticode hash"))
+		})
+		It("Blocks binaries signed with a revoked certificate", func() {
+			db := newSigner(tmpDir, "DB")
+			peSigner, err := pesign.NewSigner(db)
+			Expect(err).ToNot(HaveOccurred())
+			signed := filepath.Join(tmpDir, "file.signed.efi")
+			Expect(peSigner.Sign("../pesign/testdata/file.efi", signed)).To(Succeed())
+
+			owner, err := NewOwnerGUID()
+			Expect(err).ToNot(HaveOccurred())
+
+			// Nothing revoked yet for this certificate
+			other := newSigner(tmpDir, "Other")
+			revocation := &Revocation{Owner: owner, Certificates: []*x509.Certificate{other.Certificate()}}
+			dbx, err := revocation.Database()
+			Expect(err).ToNot(HaveOccurred())
+			reason, err := RevokedBy(*dbx, signed)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reason).To(BeEmpty())
+
+			// Write it as a raw signature list this time
+			revocation.Certificates = append(revocation.Certificates, db.Certificate())
+			dbx, err = revocation.Database()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(os.WriteFile(filepath.Join(tmpDir, "dbx.esl"), dbx.Bytes(), 0o644)).To(Succeed())
+			read, err := ReadSignatureDatabaseFile(filepath.Join(tmpDir, "dbx.esl"))
+			Expect(err).ToNot(HaveOccurred())
+			reason, err = RevokedBy(read, signed)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reason).To(ContainSubstring("DB"))
+		})
+		It("Fails with nothing to revoke", func() {
+			_, err := (&Revocation{}).Database()
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -3,6 +3,11 @@ package types
 import (
 	"crypto"
 	"crypto/rsa"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/google/go-tpm/tpm2"
@@ -57,6 +62,161 @@ func GetTPMALGorithm() (*PCRData, []Algorithm) {
 	return data, algs
 }
 
+// GetTPMALGorithmForBanks is like GetTPMALGorithm but only returns the algorithms for the given banks,
+// in the same order as GetTPMALGorithm. All the banks are returned if none are given.
+func GetTPMALGorithmForBanks(banks []tpm2.TPMAlgID) (*PCRData, []Algorithm, error) {
+	data, algs := GetTPMALGorithm()
+	if len(banks) == 0 {
+		return data, algs, nil
+	}
+
+	for _, bank := range banks {
+		if !slices.ContainsFunc(algs, func(a Algorithm) bool { return a.Alg == bank }) {
+			return nil, nil, fmt.Errorf("unsupported PCR bank: 0x%x", uint16(bank))
+		}
+	}
+
+	selected := slices.DeleteFunc(algs, func(a Algorithm) bool { return !slices.Contains(banks, a.Alg) })
+
+	return data, selected, nil
+}
+
+// ParsePCRBanks parses a list of PCR bank names (sha1, sha256, sha384, sha512) into TPM algorithms.
+func ParsePCRBanks(names []string) ([]tpm2.TPMAlgID, error) {
+	var banks []tpm2.TPMAlgID
+	for _, name := range names {
+		var bank tpm2.TPMAlgID
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "sha1":
+			bank = tpm2.TPMAlgSHA1
+		case "sha256":
+			bank = tpm2.TPMAlgSHA256
+		case "sha384":
+			bank = tpm2.TPMAlgSHA384
+		case "sha512":
+			bank = tpm2.TPMAlgSHA512
+		default:
+			return nil, fmt.Errorf("unknown PCR bank %q, valid banks are sha1, sha256, sha384 and sha512", name)
+		}
+		if !slices.Contains(banks, bank) {
+			banks = append(banks, bank)
+		}
+	}
+	return banks, nil
+}
+
+// BankName returns the lowercase name of the PCR bank, as used in the PCR signature json.
+func BankName(alg tpm2.TPMAlgID) string {
+	switch alg {
+	case tpm2.TPMAlgSHA1:
+		return "sha1"
+	case tpm2.TPMAlgSHA256:
+		return "sha256"
+	case tpm2.TPMAlgSHA384:
+		return "sha384"
+	case tpm2.TPMAlgSHA512:
+		return "sha512"
+	}
+	return fmt.Sprintf("0x%x", uint16(alg))
+}
+
+// PolicyPCR is an additional PCR bound into the signed policy, together with its expected values.
+type PolicyPCR struct {
+	// PCR index.
+	PCR int
+	// Expected value per bank. Banks without a value are predicted if possible.
+	Values map[tpm2.TPMAlgID][]byte
+}
+
+// String returns the PCR in the INDEX[:BANK=HEX,BANK=HEX...] form parsed by ParsePolicyPCR, banks sorted by algorithm.
+func (p PolicyPCR) String() string {
+	var banks []tpm2.TPMAlgID
+	for bank := range p.Values {
+		banks = append(banks, bank)
+	}
+	slices.Sort(banks)
+
+	var values []string
+	for _, bank := range banks {
+		values = append(values, fmt.Sprintf("%s=%s", BankName(bank), hex.EncodeToString(p.Values[bank])))
+	}
+	if len(values) == 0 {
+		return strconv.Itoa(p.PCR)
+	}
+	return fmt.Sprintf("%d:%s", p.PCR, strings.Join(values, ","))
+}
+
+// ParsePolicyPCR parses a PCR in the INDEX[:BANK=HEX,BANK=HEX...] form.
+func ParsePolicyPCR(s string) (PolicyPCR, error) {
+	index, values, _ := strings.Cut(s, ":")
+
+	pcr, err := strconv.Atoi(index)
+	if err != nil || pcr < 0 || pcr > 23 {
+		return PolicyPCR{}, fmt.Errorf("invalid PCR index %q", index)
+	}
+
+	policyPCR := PolicyPCR{PCR: pcr, Values: map[tpm2.TPMAlgID][]byte{}}
+	if values == "" {
+		return policyPCR, nil
+	}
+
+	for _, value := range strings.Split(values, ",") {
+		name, digest, ok := strings.Cut(value, "=")
+		if !ok {
+			return PolicyPCR{}, fmt.Errorf("invalid PCR value %q, expected BANK=HEX", value)
+		}
+		banks, err := ParsePCRBanks([]string{name})
+		if err != nil {
+			return PolicyPCR{}, err
+		}
+		decoded, err := hex.DecodeString(digest)
+		if err != nil {
+			return PolicyPCR{}, fmt.Errorf("invalid PCR %d %s value: %w", pcr, name, err)
+		}
+		hashAlg, _ := banks[0].Hash()
+		if len(decoded) != hashAlg.Size() {
+			return PolicyPCR{}, fmt.Errorf("invalid PCR %d %s value: expected %d bytes, got %d", pcr, name, hashAlg.Size(), len(decoded))
+		}
+		policyPCR.Values[banks[0]] = decoded
+	}
+
+	return policyPCR, nil
+}
+
+// ExtraSection is a section added to the UKI out of a file, on top of the ones ukify generates.
+type ExtraSection struct {
+	Name constants.Section
+	Path string
+	// Whether the stub measures the section into PCR 11, which it does for the sections it knows and only those.
+	Measure bool
+}
+
+// String returns the section in the NAME=PATH[:measure] form parsed by ParseExtraSection.
+func (s ExtraSection) String() string {
+	if s.Measure {
+		return fmt.Sprintf("%s=%s:measure", s.Name, s.Path)
+	}
+	return fmt.Sprintf("%s=%s", s.Name, s.Path)
+}
+
+// ParseExtraSection parses a section in the NAME=PATH[:measure] form.
+func ParseExtraSection(s string) (ExtraSection, error) {
+	name, path, ok := strings.Cut(s, "=")
+	if !ok || name == "" || path == "" {
+		return ExtraSection{}, fmt.Errorf("invalid section %q, expected NAME=PATH[:measure]", s)
+	}
+	if len(name) > 8 {
+		return ExtraSection{}, fmt.Errorf("section name %s is longer than 8 bytes", name)
+	}
+
+	path, measure := strings.CutSuffix(path, ":measure")
+	if path == "" {
+		return ExtraSection{}, fmt.Errorf("invalid section %q, expected NAME=PATH[:measure]", s)
+	}
+
+	return ExtraSection{Name: constants.Section(name), Path: path, Measure: measure}, nil
+}
+
 // PhaseInfo describes which phase extensions are signed/measured.
 type PhaseInfo struct {
 	Phase constants.Phase
@@ -90,6 +250,36 @@ func OrderedPhases() []PhaseInfo {
 	}
 }
 
+// ParsePhases parses a list of phases separated by : in order of measurement
+func ParsePhases(s string) ([]PhaseInfo, error) {
+	var phases []PhaseInfo
+	for _, phase := range strings.Split(s, ":") {
+		phases = append(phases, PhaseInfo{Phase: constants.Phase(phase)})
+	}
+	return phases, ValidatePhases(phases)
+}
+
+// ValidatePhases checks that all the phases are known systemd-pcrphase phases
+func ValidatePhases(phases []PhaseInfo) error {
+	if len(phases) == 0 {
+		return errors.New("empty phase path")
+	}
+	for _, phase := range phases {
+		if !slices.Contains(constants.KnownPhases(), phase.Phase) {
+			return fmt.Errorf("unknown phase %q, valid phases are %s", phase.Phase, knownPhasesString())
+		}
+	}
+	return nil
+}
+
+func knownPhasesString() string {
+	var names []string
+	for _, phase := range constants.KnownPhases() {
+		names = append(names, string(phase))
+	}
+	return strings.Join(names, ", ")
+}
+
 // PhasesToString returns a nice string for all the phases with semicolons between them
 func PhasesToString(s []PhaseInfo) string {
 	var data []string
@@ -114,6 +304,32 @@ type UkiSection struct {
 	VMA  uint64
 }
 
+// PCRKey is a PCR signing key together with the phases it signs policies for.
+//
+// This allows restricting a key to a subset of phases, I.E. a key that only signs the enter-initrd
+// phase so secrets bound to it can't be unsealed once the system has left the initrd.
+type PCRKey struct {
+	// Signer of the policies.
+	Signer RSAKey
+	// Path to the private key, used to create the signer if not set.
+	KeyPath string
+	// Phases to sign policies for, all the measured phases if empty.
+	Phases []PhaseInfo
+}
+
+// SignsPhase returns whether the key signs the policy for the given phase.
+func (k PCRKey) SignsPhase(phase PhaseInfo) bool {
+	if len(k.Phases) == 0 {
+		return true
+	}
+	for _, p := range k.Phases {
+		if p.Phase == phase.Phase {
+			return true
+		}
+	}
+	return false
+}
+
 // RSAKey is the input for the CalculateBankData function.
 type RSAKey interface {
 	crypto.Signer
@@ -5,82 +5,19 @@
 package uki
 
 import (
-	"debug/pe"
-	"errors"
-	"fmt"
 	"log/slog"
-	"os"
-	"os/exec"
-	"path/filepath"
-)
-
-// assemble the UKI file out of sections.
-func (builder *Builder) assemble() error {
-	peFile, err := pe.Open(builder.SdStubPath)
-	if err != nil {
-		return err
-	}
-
-	defer peFile.Close() //nolint: errcheck
-
-	// find the first VMA address
-	lastSection := peFile.Sections[len(peFile.Sections)-1]
-
-	// align the VMA to 512 bytes
-	// https://github.com/saferwall/pe/blob/main/helper.go#L22-L26
-	const alignment = 0x1ff
-
-	header, ok := peFile.OptionalHeader.(*pe.OptionalHeader64)
-	if !ok {
-		return errors.New("failed to get optional header")
-	}
-
-	baseVMA := header.ImageBase + uint64(lastSection.VirtualAddress) + uint64(lastSection.VirtualSize)
-	baseVMA = (baseVMA + alignment) &^ alignment
-
-	// calculate sections size and VMA
-	for i := range builder.sections {
-		if !builder.sections[i].Append {
-			continue
-		}
-
-		st, err := os.Stat(builder.sections[i].Path)
-		if err != nil {
-			return err
-		}
-
-		builder.sections[i].Size = uint64(st.Size())
-		builder.sections[i].VMA = baseVMA
+	"time"
 
-		baseVMA += builder.sections[i].Size
-		baseVMA = (baseVMA + alignment) &^ alignment
-	}
-
-	// create the output file
-	args := []string{}
-
-	for _, section := range builder.sections {
-		if !section.Append {
-			continue
-		}
-
-		args = append(args, "--add-section", fmt.Sprintf("%s=%s", section.Name, section.Path), "--change-section-vma", fmt.Sprintf("%s=0x%x", section.Name, section.VMA))
-	}
-
-	// Set the section flag to CODE for .linux not usre if this does anything?
-	args = append(args, "--set-section-flags", ".linux=code,readonly")
-
-	builder.unsignedUKIPath = filepath.Join(builder.scratchDir, "unsigned.uki")
-
-	args = append(args, builder.SdStubPath, builder.unsignedUKIPath)
-
-	objcopy := "objcopy"
-
-	slog.Debug("Assembling", "args", args)
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
 
-	cmd := exec.Command(objcopy, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+// assemble the UKI file out of sections at path.
+//
+// The sections are appended to the sd-stub in the order they were generated, so the same inputs always
+// give the same UKI. The ones not appended overwrite the sd-stub section of the same name.
+func assemble(path, sdStubPath string, sections []types.UkiSection, timestamp *time.Time) error {
+	slog.Debug("Assembling", "stub", sdStubPath, "sections", len(sections))
 
-	return cmd.Run()
+	_, err := writePE(path, sdStubPath, sections, timestamp)
+	return err
 }
@@ -5,183 +5,147 @@
 package uki
 
 import (
+	"context"
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
+	"fmt"
 	"github.com/kairos-io/go-ukify/internal/common"
 	"github.com/kairos-io/go-ukify/pkg/types"
 	"github.com/kairos-io/go-ukify/pkg/utils"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
 
 	"github.com/kairos-io/go-ukify/pkg/constants"
 	"github.com/kairos-io/go-ukify/pkg/measure"
 )
 
-func (builder *Builder) generateOSRel() error {
-	var path string
-	if builder.OsRelease != "" {
-		slog.Debug("Using existing os-release", "path", builder.OsRelease)
-		path = builder.OsRelease
-	} else {
-		// Generate a simplified os-release
-		slog.Debug("Generating a new os-release")
-		osRelease, err := constants.OSReleaseFor(constants.Name, builder.Version)
-		if err != nil {
-			return err
-		}
-		path = filepath.Join(builder.scratchDir, "os-release")
-		if err = os.WriteFile(path, osRelease, 0o600); err != nil {
-			return err
-		}
+// builtinGenerators returns the generators of the sections every UKI has, in order.
+func builtinGenerators() []SectionGenerator {
+	return []SectionGenerator{
+		&generator{section: constants.OSRel, measured: true, appended: true, generate: generateOSRel},
+		&generator{section: constants.CMDLine, measured: true, appended: true, generate: generateCmdline},
+		&generator{section: constants.Initrd, measured: true, appended: true, generate: generateInitrd},
+		&generator{section: constants.Splash, measured: true, appended: true, generate: generateSplash},
+		&generator{section: constants.Uname, measured: true, appended: true, generate: generateUname},
+		// SBAT needs to be measured but NOT added
+		// This is because we build with the systemd-stub as base, and that already has a .sbat section!
+		// So int he final PE file we will get the .sbat section in there, so we need to measure.
+		// If merged with the kernel or extra entries, it overwrites the one of the stub instead.
+		&generator{section: constants.SBAT, measured: true, generate: generateSBAT},
+		&generator{section: constants.PCRPKey, measured: true, appended: true, generate: generatePCRPublicKey},
+		// append kernel last to account for decompression
+		&generator{section: constants.Linux, measured: true, appended: true, generate: generateKernel},
 	}
-
-	builder.sections = append(builder.sections,
-		types.UkiSection{
-			Name:    constants.OSRel,
-			Path:    path,
-			Measure: true,
-			Append:  true,
-		},
-	)
-
-	return nil
 }
 
-func (builder *Builder) generateCmdline() error {
-	slog.Debug("Using cmdline", "cmdline", builder.Cmdline)
-	path := filepath.Join(builder.scratchDir, "cmdline")
-
-	if err := os.WriteFile(path, []byte(builder.Cmdline), 0o600); err != nil {
-		return err
+func generateOSRel(_ context.Context, info *GenerateInfo) (*GeneratedSection, error) {
+	if info.OsReleasePath != "" {
+		slog.Debug("Using existing os-release", "path", info.OsReleasePath)
+		return &GeneratedSection{Path: info.OsReleasePath}, nil
 	}
 
-	builder.sections = append(builder.sections,
-		types.UkiSection{
-			Name:    constants.CMDLine,
-			Path:    path,
-			Measure: true,
-			Append:  true,
-		},
-	)
+	// Generate a simplified os-release
+	slog.Debug("Generating a new os-release")
+	osRelease, err := constants.OSReleaseFor(constants.Name, info.Config.Version)
+	if err != nil {
+		return nil, err
+	}
 
-	return nil
+	return &GeneratedSection{Data: osRelease}, nil
 }
 
-func (builder *Builder) generateInitrd() error {
-	slog.Debug("Using initrd", "path", builder.InitrdPath)
-	builder.sections = append(builder.sections,
-		types.UkiSection{
-			Name:    constants.Initrd,
-			Path:    builder.InitrdPath,
-			Measure: true,
-			Append:  true,
-		},
-	)
+func generateCmdline(_ context.Context, info *GenerateInfo) (*GeneratedSection, error) {
+	slog.Debug("Using cmdline", "cmdline", info.Config.Cmdline)
+	return &GeneratedSection{Data: []byte(info.Config.Cmdline)}, nil
+}
 
-	return nil
+func generateInitrd(_ context.Context, info *GenerateInfo) (*GeneratedSection, error) {
+	slog.Debug("Using initrd", "path", info.InitrdPath)
+	return &GeneratedSection{Path: info.InitrdPath}, nil
 }
 
-func (builder *Builder) generateSplash() error {
-	path := filepath.Join(builder.scratchDir, "splash.bmp")
+func generateSplash(_ context.Context, info *GenerateInfo) (*GeneratedSection, error) {
 	var data []byte
 
-	if builder.Splash != "" {
-		slog.Debug("Using splash", "file", builder.Splash)
-		data, _ = os.ReadFile(builder.Splash)
+	if info.SplashPath != "" {
+		slog.Debug("Using splash", "file", info.SplashPath)
+		data, _ = os.ReadFile(info.SplashPath)
 	} else {
 		slog.Debug("Using generic bundled splash")
 		data = common.Logo
 	}
 
-	if err := os.WriteFile(path, data, 0o600); err != nil {
-		return err
-	}
-
-	builder.sections = append(builder.sections,
-		types.UkiSection{
-			Name:    constants.Splash,
-			Path:    path,
-			Measure: true,
-			Append:  true,
-		},
-	)
-
-	return nil
+	return &GeneratedSection{Data: data}, nil
 }
 
-func (builder *Builder) generateUname() error {
+func generateUname(_ context.Context, info *GenerateInfo) (*GeneratedSection, error) {
 	// it is not always possible to get the kernel version from the kernel image, so we
 	// do a bit of pre-checks
 	var kernelVersion string
 
 	// otherwise, try to get the kernel version from the kernel image
-	kernelVersion, _ = DiscoverKernelVersion(builder.KernelPath) //nolint:errcheck
+	kernelVersion, _ = DiscoverKernelVersion(info.KernelPath) //nolint:errcheck
 
 	if kernelVersion == "" {
 		// we haven't got the kernel version, skip the uname section
-		slog.Info("We could not infer kernel version", "path", builder.KernelPath)
-		return nil
+		slog.Info("We could not infer kernel version", "path", info.KernelPath)
+		return nil, nil
 	} else {
-		slog.Debug("Getting uname", "version", kernelVersion, "path", builder.KernelPath)
+		slog.Debug("Getting uname", "version", kernelVersion, "path", info.KernelPath)
 	}
 
-	path := filepath.Join(builder.scratchDir, "uname")
+	return &GeneratedSection{Data: []byte(kernelVersion)}, nil
+}
 
-	if err := os.WriteFile(path, []byte(kernelVersion), 0o600); err != nil {
-		return err
+func generateSBAT(_ context.Context, info *GenerateInfo) (*GeneratedSection, error) {
+	slog.Debug("Getting SBAT", "path", info.SdStubPath)
+	sbat, err := GetSBAT(info.SdStubPath)
+	if err != nil {
+		return nil, err
 	}
 
-	builder.sections = append(builder.sections,
-		types.UkiSection{
-			Name:    constants.Uname,
-			Path:    path,
-			Measure: true,
-			Append:  true,
-		},
-	)
-
-	return nil
-}
-
-func (builder *Builder) generateSBAT() error {
-	slog.Debug("Getting SBAT", "path", builder.SdStubPath)
-	sbat, err := GetSBAT(builder.SdStubPath)
+	// the kernel can carry its own SBAT, if it is an EFI binary
+	kernelSBAT, err := GetSBAT(info.KernelPath)
 	if err != nil {
-		return err
+		slog.Debug("Kernel has no SBAT", "path", info.KernelPath, "error", err)
 	}
 
-	slog.Debug("Generated SBAT", "sbat", sbat, "path", builder.SdStubPath)
+	if kernelSBAT == nil && len(info.Config.SBAT) == 0 {
+		slog.Debug("Generated SBAT", "sbat", sbat, "path", info.SdStubPath)
+		return &GeneratedSection{Data: sbat}, nil
+	}
 
-	path := filepath.Join(builder.scratchDir, "sbat")
+	// Merge the stub, kernel and user entries, so any of them can be revoked
+	var entries [][]SBATEntry
+	for _, source := range append([]string{string(sbat), string(kernelSBAT)}, info.Config.SBAT...) {
+		parsed, err := ParseSBAT([]byte(source))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, parsed)
+	}
 
-	if err = os.WriteFile(path, sbat, 0o600); err != nil {
-		return err
+	merged, err := MergeSBAT(entries...)
+	if err != nil {
+		return nil, err
 	}
 
-	// SBAT needs to be measured but NOT added
-	// This is because we build with the systemd-stub as base, and that already has a .sbat section!
-	// So int he final PE file we will get the .sbat section in there, so we need to measure.
-	builder.sections = append(builder.sections,
-		types.UkiSection{
-			Name:    constants.SBAT,
-			Path:    path,
-			Measure: true,
-		},
-	)
+	slog.Debug("Generated SBAT", "sbat", merged)
 
-	return nil
+	return &GeneratedSection{Data: merged}, nil
 }
 
-func (builder *Builder) generatePCRPublicKey() error {
-	if !builder.pcrSignEnabled() {
-		return nil
+func generatePCRPublicKey(_ context.Context, info *GenerateInfo) (*GeneratedSection, error) {
+	if !info.Config.pcrSignEnabled() {
+		return nil, nil
 	}
 	slog.Debug("Getting Public PCR key")
-	publicKeyBytes, err := x509.MarshalPKIXPublicKey(builder.PCRSigner.PublicRSAKey())
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(info.Config.pcrKeys()[0].Signer.PublicRSAKey())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	publicKeyPEM := pem.EncodeToMemory(&pem.Block{
@@ -189,74 +153,112 @@ func (builder *Builder) generatePCRPublicKey() error {
 		Bytes: publicKeyBytes,
 	})
 
-	path := filepath.Join(builder.scratchDir, "pcr-public.pem")
+	return &GeneratedSection{Data: publicKeyPEM}, nil
+}
+
+func generateKernel(_ context.Context, info *GenerateInfo) (*GeneratedSection, error) {
+	slog.Debug("Getting kernel")
+	return &GeneratedSection{Path: info.KernelPath}, nil
+}
 
-	if err = os.WriteFile(path, publicKeyPEM, 0o600); err != nil {
+// generateSections runs the generators of the build in order, adding their sections to the plan.
+func (plan *Plan) generateSections(ctx context.Context) error {
+	generators, err := orderGenerators(&plan.config)
+	if err != nil {
 		return err
 	}
 
-	builder.sections = append(builder.sections,
-		types.UkiSection{
-			Name:    constants.PCRPKey,
-			Path:    path,
-			Append:  true,
-			Measure: true,
-		},
-	)
+	info := &GenerateInfo{
+		Config:        &plan.config,
+		SdStubPath:    plan.inputs.sdStub,
+		SdBootPath:    plan.inputs.sdBoot,
+		KernelPath:    plan.inputs.kernel,
+		InitrdPath:    plan.inputs.initrd,
+		OsReleasePath: plan.inputs.osRelease,
+		SplashPath:    plan.inputs.splash,
+	}
 
-	return nil
+	// sections ukify doesn't know about can't replace the ones of the sd-stub
+	stubSections, err := manifestSections(plan.inputs.sdStub)
+	if err != nil {
+		return fmt.Errorf("failed to parse sd-stub: %w", err)
+	}
+	builtin := sectionNames(builtinGenerators())
 
-}
+	for _, generator := range generators {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
 
-func (builder *Builder) generateKernel() error {
-	slog.Debug("Getting kernel")
+		name := generator.Section()
+		if generator.Appended() && !slices.Contains(builtin, name) && slices.ContainsFunc(stubSections, func(section ManifestSection) bool {
+			return section.Name == string(name)
+		}) {
+			return fmt.Errorf("section %s is already in the sd-stub", name)
+		}
 
-	builder.sections = append(builder.sections,
-		types.UkiSection{
-			Name:    constants.Linux,
-			Path:    builder.KernelPath,
-			Append:  true,
-			Measure: true,
-		},
-	)
+		generated, err := generator.Generate(ctx, info)
+		if err != nil {
+			return fmt.Errorf("section %s: %w", name, err)
+		}
+		if generated == nil {
+			continue
+		}
+
+		path := generated.Path
+		if path == "" {
+			path = filepath.Join(plan.dir, "section"+string(name))
+			if err = os.WriteFile(path, generated.Data, 0o600); err != nil {
+				return err
+			}
+		}
+
+		plan.sections = append(plan.sections,
+			types.UkiSection{
+				Name:    name,
+				Path:    path,
+				Measure: generator.Measured(),
+				Append:  generator.Appended(),
+			},
+		)
+	}
 
 	return nil
 }
 
-func (builder *Builder) generatePCRSig() error {
+// generatePCRSig signs the measurements of the planned sections into a .pcrsig section written to dir, or
+// logs them if PCR signing is disabled.
+func (plan *Plan) generatePCRSig(dir string, pool *utils.Pool) (*types.UkiSection, error) {
 	slog.Info("Generating PCR measurements")
 	slog.Debug("Using PCR slot", "number", constants.UKIPCR)
-	sectionsData := utils.SectionsData(builder.sections)
+	sectionsData := utils.SectionsData(plan.sections)
+	config := &plan.config
 
 	// If we have the signer sign the measurements and attach them to the uki file
-	if builder.pcrSignEnabled() {
-		slog.Info("Generating signed policy")
-		pcrData, err := measure.GenerateSignedPCR(sectionsData, builder.Phases, builder.PCRSigner, constants.UKIPCR)
-		if err != nil {
-			return err
-		}
-		pcrSignatureData, err := json.Marshal(pcrData)
-		if err != nil {
-			return err
-		}
+	if !config.pcrSignEnabled() {
+		// Otherwise just measure and print the measurements
+		return nil, measure.GenerateMeasurements(sectionsData, config.phasePaths(), config.PCRBanks, constants.UKIPCR)
+	}
 
-		path := filepath.Join(builder.scratchDir, "pcrpsig")
+	slog.Info("Generating signed policy")
+	pcrData, err := measure.GenerateSignedPCRWithKeys(sectionsData, config.phasePaths(), config.pcrKeys(), config.PCRBanks, config.PolicyPCRs, pool, constants.UKIPCR)
+	if err != nil {
+		return nil, err
+	}
+	pcrSignatureData, err := json.Marshal(pcrData)
+	if err != nil {
+		return nil, err
+	}
 
-		if err = os.WriteFile(path, pcrSignatureData, 0o600); err != nil {
-			return err
-		}
+	path := filepath.Join(dir, "pcrpsig")
 
-		builder.sections = append(builder.sections,
-			types.UkiSection{
-				Name:   constants.PCRSig,
-				Path:   path,
-				Append: true,
-			},
-		)
-	} else {
-		// Otherwise just measure and print the measurements
-		measure.GenerateMeasurements(sectionsData, builder.Phases, constants.UKIPCR)
+	if err = os.WriteFile(path, pcrSignatureData, 0o600); err != nil {
+		return nil, err
 	}
 
-	return nil
+	return &types.UkiSection{
+		Name:   constants.PCRSig,
+		Path:   path,
+		Append: true,
+	}, nil
 }
@@ -0,0 +1,202 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// SectionGenerator generates a section of the UKI.
+//
+// Generators run when planning a build, in order, before the sections are measured and .pcrsig, the signed
+// measurements, is appended last.
+type SectionGenerator interface {
+	// Section returns the name of the section, at most 8 bytes long.
+	Section() constants.Section
+	// Measured tells whether the section is measured into PCR 11. The stub measures the sections it knows, and
+	// only those.
+	Measured() bool
+	// Appended tells whether the section is appended to the sd-stub. If not, the section is already in the
+	// sd-stub, and the generated contents replace its own if they differ.
+	Appended() bool
+	// After returns the sections this one goes after, if they are generated.
+	After() []constants.Section
+	// Generate returns the contents of the section, or nil to leave the section out.
+	Generate(ctx context.Context, info *GenerateInfo) (*GeneratedSection, error)
+}
+
+// GenerateInfo is what generators know about the build.
+type GenerateInfo struct {
+	// Configuration of the build, with defaults and signers resolved. It must not be modified.
+	Config *Builder
+
+	// Paths of the inputs, including the ones given in memory. Empty if not given.
+	SdStubPath    string
+	SdBootPath    string
+	KernelPath    string
+	InitrdPath    string
+	OsReleasePath string
+	SplashPath    string
+}
+
+// GeneratedSection is the contents of a section, either a file or data.
+type GeneratedSection struct {
+	// Path of the file with the contents, read when building.
+	Path string
+	// Contents, if Path is empty.
+	Data []byte
+}
+
+var registry struct {
+	sync.Mutex
+	generators []SectionGenerator
+}
+
+// RegisterSectionGenerator adds a generator to every build, after the built-in ones but the kernel.
+//
+// It fails if the generator isn't valid, or if a generator is already registered for the section.
+func RegisterSectionGenerator(generator SectionGenerator) error {
+	if err := validateGenerator(generator); err != nil {
+		return err
+	}
+
+	registry.Lock()
+	defer registry.Unlock()
+
+	for _, registered := range append(builtinGenerators(), registry.generators...) {
+		if registered.Section() == generator.Section() {
+			return fmt.Errorf("a generator is already registered for section %s", generator.Section())
+		}
+	}
+	registry.generators = append(registry.generators, generator)
+
+	return nil
+}
+
+// SectionGenerators returns the generators of the built-in sections, and the registered ones.
+func SectionGenerators() []SectionGenerator {
+	registry.Lock()
+	defer registry.Unlock()
+
+	return append(builtinGenerators(), registry.generators...)
+}
+
+// validateGenerator checks the section of a generator can be added to the UKI.
+func validateGenerator(generator SectionGenerator) error {
+	name := generator.Section()
+	switch {
+	case name == "":
+		return fmt.Errorf("empty section name")
+	case len(name) > 8:
+		return fmt.Errorf("section name %s is longer than 8 bytes", name)
+	case name == constants.PCRSig:
+		return fmt.Errorf("section %s is generated out of the measurements of the others", name)
+	case generator.Measured() && !slices.Contains(constants.OrderedSections(), name):
+		return fmt.Errorf("section %s can't be measured, the stub only measures known sections", name)
+	case !generator.Measured() && slices.Contains(constants.OrderedSections(), name):
+		return fmt.Errorf("section %s has to be measured, the stub measures every section it knows", name)
+	}
+	return nil
+}
+
+// orderGenerators returns the generators in the order they have to run: the built-in ones, the registered
+// ones, the ones from the builder, its extra sections and the kernel last to account for decompression, as long as every
+// generator goes after the sections it has to.
+func orderGenerators(builder *Builder) ([]SectionGenerator, error) {
+	var kernel SectionGenerator
+	var generators []SectionGenerator
+	seen := map[constants.Section]bool{}
+	all := append(SectionGenerators(), builder.SectionGenerators...)
+	for _, section := range builder.ExtraSections {
+		all = append(all, extraSectionGenerator(section))
+	}
+	for _, generator := range all {
+		if err := validateGenerator(generator); err != nil {
+			return nil, err
+		}
+		if seen[generator.Section()] {
+			return nil, fmt.Errorf("more than one generator for section %s", generator.Section())
+		}
+		seen[generator.Section()] = true
+
+		if generator.Section() == constants.Linux {
+			kernel = generator
+			continue
+		}
+		generators = append(generators, generator)
+	}
+	if kernel != nil {
+		generators = append(generators, kernel)
+	}
+
+	// stable topological sort: take the first generator whose predecessors are all taken
+	ordered := make([]SectionGenerator, 0, len(generators))
+	taken := map[constants.Section]bool{}
+
+	for len(generators) > 0 {
+		next := slices.IndexFunc(generators, func(generator SectionGenerator) bool {
+			for _, after := range generator.After() {
+				if seen[after] && !taken[after] && after != generator.Section() {
+					return false
+				}
+			}
+			return true
+		})
+		if next == -1 {
+			return nil, fmt.Errorf("sections %s have circular ordering constraints", sectionNames(generators))
+		}
+
+		taken[generators[next].Section()] = true
+		ordered = append(ordered, generators[next])
+		generators = slices.Delete(generators, next, next+1)
+	}
+
+	return ordered, nil
+}
+
+// extraSectionGenerator returns a generator of a section out of a file.
+func extraSectionGenerator(section types.ExtraSection) SectionGenerator {
+	return &generator{
+		section:  section.Name,
+		measured: section.Measure,
+		appended: true,
+		generate: func(_ context.Context, _ *GenerateInfo) (*GeneratedSection, error) {
+			slog.Debug("Using extra section", "section", section.Name, "path", section.Path)
+			return &GeneratedSection{Path: section.Path}, nil
+		},
+	}
+}
+
+func sectionNames(generators []SectionGenerator) []constants.Section {
+	names := make([]constants.Section, 0, len(generators))
+	for _, generator := range generators {
+		names = append(names, generator.Section())
+	}
+	return names
+}
+
+// generator is a SectionGenerator out of its properties and a function.
+type generator struct {
+	section  constants.Section
+	measured bool
+	appended bool
+	after    []constants.Section
+	generate func(ctx context.Context, info *GenerateInfo) (*GeneratedSection, error)
+}
+
+func (g *generator) Section() constants.Section { return g.section }
+func (g *generator) Measured() bool             { return g.measured }
+func (g *generator) Appended() bool             { return g.appended }
+func (g *generator) After() []constants.Section { return g.after }
+func (g *generator) Generate(ctx context.Context, info *GenerateInfo) (*GeneratedSection, error) {
+	return g.generate(ctx, info)
+}
@@ -0,0 +1,152 @@
+package uki
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/types"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SectionGenerator", func() {
+	data := func(section constants.Section, after ...constants.Section) *generator {
+		return &generator{
+			section:  section,
+			appended: true,
+			after:    after,
+			generate: func(_ context.Context, _ *GenerateInfo) (*GeneratedSection, error) {
+				return &GeneratedSection{Data: []byte(section)}, nil
+			},
+		}
+	}
+
+	It("Orders the built-in sections, the extra ones and the kernel last", func() {
+		generators, err := orderGenerators(&Builder{SectionGenerators: []SectionGenerator{
+			data(".extra"),
+			data(".first", ".extra"),
+		}})
+		Expect(err).ToNot(HaveOccurred())
+
+		builtin := sectionNames(builtinGenerators())
+		names := sectionNames(generators)
+		Expect(names[:len(builtin)-1]).To(Equal(builtin[:len(builtin)-1]))
+		Expect(names[len(names)-3:]).To(Equal([]constants.Section{".extra", ".first", constants.Linux}))
+	})
+
+	It("Runs generators after the sections they go after", func() {
+		generators, err := orderGenerators(&Builder{SectionGenerators: []SectionGenerator{
+			data(".second", ".third"),
+			data(".third"),
+		}})
+		Expect(err).ToNot(HaveOccurred())
+
+		names := sectionNames(generators)
+		Expect(names[len(names)-3:]).To(Equal([]constants.Section{".third", ".second", constants.Linux}))
+	})
+
+	It("Rejects invalid generators", func() {
+		for _, g := range []SectionGenerator{
+			data(""),
+			data(".toolongname"),
+			data(constants.PCRSig),
+			data(constants.CMDLine),
+			&generator{section: ".extra", measured: true},
+		} {
+			_, err := orderGenerators(&Builder{SectionGenerators: []SectionGenerator{g}})
+			Expect(err).To(HaveOccurred(), string(g.Section()))
+		}
+	})
+
+	It("Rejects circular ordering constraints", func() {
+		_, err := orderGenerators(&Builder{SectionGenerators: []SectionGenerator{
+			data(".a", ".b"),
+			data(".b", ".a"),
+		}})
+		Expect(err).To(MatchError(ContainSubstring("circular")))
+	})
+
+	It("Rejects registering a generator for a built-in section", func() {
+		Expect(RegisterSectionGenerator(data(constants.Splash))).ToNot(Succeed())
+	})
+
+	It("Adds the generated sections to the UKI", func() {
+		stub, err := os.ReadFile("../pesign/testdata/file.efi")
+		Expect(err).ToNot(HaveOccurred())
+
+		builder := &Builder{
+			SdStubData:        Bytes(stub),
+			KernelData:        Bytes(make([]byte, 4096)),
+			InitrdData:        Bytes([]byte("initrd")),
+			SectionGenerators: []SectionGenerator{data(".extra")},
+		}
+		plan, err := builder.Plan(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		defer plan.Close()
+
+		description, err := plan.Describe()
+		Expect(err).ToNot(HaveOccurred())
+		names := make([]string, 0, len(description.Sections))
+		for _, section := range description.Sections {
+			names = append(names, section.Name)
+			if section.Name == ".extra" {
+				Expect(section.Measured).To(BeFalse())
+				Expect(section.Size).To(BeEquivalentTo(len(".extra")))
+			}
+		}
+		Expect(names[len(names)-2:]).To(Equal([]string{".extra", string(constants.Linux)}))
+	})
+
+	Describe("Extra sections", func() {
+		var builder *Builder
+		var dir string
+
+		BeforeEach(func() {
+			stub, err := os.ReadFile("../pesign/testdata/file.efi")
+			Expect(err).ToNot(HaveOccurred())
+
+			dir = GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "extra"), []byte("extra"), 0o600)).ToNot(HaveOccurred())
+			builder = &Builder{
+				SdStubData: Bytes(stub),
+				KernelData: Bytes(make([]byte, 4096)),
+				InitrdData: Bytes([]byte("initrd")),
+			}
+		})
+
+		It("Adds the sections before the kernel and records them", func() {
+			builder.ExtraSections = []types.ExtraSection{{Name: ".sbom", Path: filepath.Join(dir, "extra")}}
+			plan, err := builder.Plan(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			defer plan.Close()
+
+			description, err := plan.Describe()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(description.Sections[len(description.Sections)-2].Name).To(Equal(".sbom"))
+			Expect(description.ExtraSections).To(Equal([]ManifestExtraSection{{Name: ".sbom"}}))
+			Expect(description.Inputs).To(ContainElement(HaveField("Name", ".sbom")))
+		})
+
+		It("Measures the known sections", func() {
+			plan, err := builder.Plan(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			defer plan.Close()
+
+			builder.ExtraSections = []types.ExtraSection{{Name: constants.DTB, Path: filepath.Join(dir, "extra"), Measure: true}}
+			withDTB, err := builder.Plan(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			defer withDTB.Close()
+
+			Expect(withDTB.pcrs).ToNot(Equal(plan.pcrs))
+		})
+
+		It("Rejects sections already in the stub", func() {
+			builder.ExtraSections = []types.ExtraSection{{Name: ".sdmagic", Path: filepath.Join(dir, "extra")}}
+			_, err := builder.Plan(context.Background())
+			Expect(err).To(MatchError(ContainSubstring("section .sdmagic is already in the sd-stub")))
+		})
+	})
+})
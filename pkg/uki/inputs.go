@@ -0,0 +1,143 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+)
+
+// Input is the contents of a build input given in memory instead of as a path, like a *bytes.Reader or
+// an *io.SectionReader.
+//
+// A plain io.ReaderAt, like an *os.File, has no Size: wrap it with ReaderAt, or io.NewSectionReader(r, 0, size).
+// A nil pointer is the same as no Input.
+type Input interface {
+	io.ReaderAt
+	Size() int64
+}
+
+// Bytes returns an Input for the given contents.
+func Bytes(data []byte) Input {
+	return bytes.NewReader(data)
+}
+
+// ReaderAt returns an Input for the first size bytes of r.
+func ReaderAt(r io.ReaderAt, size int64) Input {
+	return io.NewSectionReader(r, 0, size)
+}
+
+// noInput tells whether an input wasn't given, either as nil or as a nil pointer of some type.
+func noInput(input Input) bool {
+	if input == nil {
+		return true
+	}
+	v := reflect.ValueOf(input)
+	return v.Kind() == reflect.Pointer && v.IsNil()
+}
+
+// inputPaths are the paths the inputs of a build are read from.
+type inputPaths struct {
+	sdStub    string
+	sdBoot    string
+	kernel    string
+	initrd    string
+	osRelease string
+	splash    string
+}
+
+// resolveInputs returns the path of every input, writing the ones given in memory to the plan dir
+// as sections are streamed from files.
+func (plan *Plan) resolveInputs(ctx context.Context) (inputPaths, error) {
+	builder := &plan.config
+	var paths inputPaths
+	for _, input := range []struct {
+		name     string
+		path     string
+		data     Input
+		resolved *string
+	}{
+		{ManifestSdStub, builder.SdStubPath, builder.SdStubData, &paths.sdStub},
+		{ManifestSdBoot, builder.SdBootPath, builder.SdBootData, &paths.sdBoot},
+		{ManifestKernel, builder.KernelPath, builder.KernelData, &paths.kernel},
+		{ManifestInitrd, builder.InitrdPath, builder.InitrdData, &paths.initrd},
+		{ManifestOsRelease, builder.OsRelease, builder.OsReleaseData, &paths.osRelease},
+		{ManifestSplash, builder.Splash, builder.SplashData, &paths.splash},
+	} {
+		if err := ctx.Err(); err != nil {
+			return paths, err
+		}
+
+		if noInput(input.data) {
+			*input.resolved = input.path
+			continue
+		}
+		if input.path != "" {
+			return paths, fmt.Errorf("%s given both as a path and in memory", input.name)
+		}
+
+		path := filepath.Join(plan.dir, "input-"+input.name)
+		if err := writeInput(path, input.data); err != nil {
+			return paths, fmt.Errorf("error writing %s: %w", input.name, err)
+		}
+		*input.resolved = path
+	}
+
+	if paths.sdStub == "" {
+		return paths, fmt.Errorf("no %s given", ManifestSdStub)
+	}
+	if paths.kernel == "" {
+		return paths, fmt.Errorf("no %s given", ManifestKernel)
+	}
+
+	return paths, nil
+}
+
+// inputFiles returns the hash of every input, inputs given in memory being recorded without a path.
+func (plan *Plan) inputFiles() ([]ManifestFile, error) {
+	var files []ManifestFile
+	inputs := []struct{ name, path, resolved string }{
+		{ManifestSdStub, plan.config.SdStubPath, plan.inputs.sdStub},
+		{ManifestSdBoot, plan.config.SdBootPath, plan.inputs.sdBoot},
+		{ManifestKernel, plan.config.KernelPath, plan.inputs.kernel},
+		{ManifestInitrd, plan.config.InitrdPath, plan.inputs.initrd},
+		{ManifestOsRelease, plan.config.OsRelease, plan.inputs.osRelease},
+		{ManifestSplash, plan.config.Splash, plan.inputs.splash},
+	}
+	// extra sections are recorded by section name
+	for _, section := range plan.config.ExtraSections {
+		inputs = append(inputs, struct{ name, path, resolved string }{string(section.Name), section.Path, section.Path})
+	}
+	for _, input := range inputs {
+		if input.resolved == "" {
+			continue
+		}
+		sum, err := fileSHA256(input.resolved)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, ManifestFile{Name: input.name, Path: input.path, SHA256: sum})
+	}
+	return files, nil
+}
+
+func writeInput(path string, data Input) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(f, io.NewSectionReader(data, 0, data.Size())); err != nil {
+		f.Close() //nolint:errcheck
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,376 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"crypto/sha256"
+	"debug/pe"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/kairos-io/go-ukify/internal/common"
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/measure"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// Names of the files recorded in a Manifest.
+const (
+	ManifestSdStub    = "sd-stub"
+	ManifestSdBoot    = "sd-boot"
+	ManifestKernel    = "kernel"
+	ManifestInitrd    = "initrd"
+	ManifestOsRelease = "os-release"
+	ManifestSplash    = "splash"
+	ManifestUKI       = "uki"
+)
+
+// Manifest records the inputs and options of a UKI build together with what it produced, so the build can be
+// audited, or done again and compared bit for bit.
+//
+// Signing keys are not recorded, only their fingerprints, they have to be given again when reproducing the build.
+type Manifest struct {
+	// Version of ukify that made the build.
+	Ukify common.BuildInfo `json:"ukify"`
+
+	BuildOptions
+
+	Inputs  []ManifestFile `json:"inputs"`
+	Outputs []ManifestFile `json:"outputs"`
+
+	BuildDetails
+}
+
+// BuildOptions are the options a build was made with.
+type BuildOptions struct {
+	Arch    string `json:"arch,omitempty"`
+	Version string `json:"version,omitempty"`
+	Cmdline string `json:"cmdline"`
+	// Phase paths, main one first, in the PHASE:PHASE... form.
+	Phases []string `json:"phases"`
+	// PCR banks, all the supported ones if empty.
+	PCRBanks []string `json:"pcrBanks,omitempty"`
+	// Extra PCRs bound into the policies, in the INDEX[:BANK=HEX,...] form.
+	PolicyPCRs []string `json:"policyPCRs,omitempty"`
+	// SOURCE_DATE_EPOCH the build was made with, if any.
+	SourceDateEpoch *int64 `json:"sourceDateEpoch,omitempty"`
+	// Extra SBAT entries, as CSV.
+	SBAT []string `json:"sbat,omitempty"`
+	// Sections added out of files, recorded as inputs named after the section.
+	ExtraSections []ManifestExtraSection `json:"extraSections,omitempty"`
+}
+
+// ManifestExtraSection is a section a build added out of a file.
+type ManifestExtraSection struct {
+	Name     string `json:"name"`
+	Measured bool   `json:"measured"`
+}
+
+// BuildDetails describes the UKI a build produced.
+type BuildDetails struct {
+	// Section table of the UKI, including the sd-stub sections.
+	Sections []ManifestSection `json:"sections,omitempty"`
+	// Predicted PCR 11 value per bank at the end of every step of every phase path.
+	PCRs measure.Calculation `json:"pcrs,omitempty"`
+	// Keys the build was signed with.
+	Signing ManifestSigning `json:"signing"`
+}
+
+// ManifestFile is a file used or produced by a build.
+type ManifestFile struct {
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+// ManifestSection is a section of the UKI.
+type ManifestSection struct {
+	Name           string `json:"name"`
+	VirtualAddress uint32 `json:"virtualAddress"`
+	VirtualSize    uint32 `json:"virtualSize"`
+	// SHA-256 of the VirtualSize bytes of the section, what the stub measures.
+	SHA256 string `json:"sha256"`
+	// Whether the stub measures the section into PCR 11.
+	Measured bool `json:"measured"`
+}
+
+// ManifestSigning holds the fingerprints of the keys a build was signed with.
+type ManifestSigning struct {
+	// SHA-256 fingerprint of the Secure Boot certificate, empty if the build wasn't signed.
+	SecureBootCertificate string `json:"secureBootCertificate,omitempty"`
+	// PCR signing keys, the one embedded in .pcrpkey first.
+	PCRKeys []ManifestPCRKey `json:"pcrKeys,omitempty"`
+}
+
+// ManifestPCRKey is a PCR signing key.
+type ManifestPCRKey struct {
+	// SHA-256 fingerprint of the public key, as found in the .pcrsig pkfp field.
+	Fingerprint string `json:"fingerprint"`
+	// Phases the key signs, all of them if empty.
+	Phases []string `json:"phases,omitempty"`
+}
+
+// ReadManifest reads a manifest written by Builder.Build, in any of the manifest formats.
+func ReadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var statement Statement
+	if err = json.Unmarshal(data, &statement); err != nil {
+		return nil, fmt.Errorf("error parsing manifest %s: %w", path, err)
+	}
+	if statement.Type != "" {
+		return statement.Manifest()
+	}
+
+	var manifest Manifest
+	if err = json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("error parsing manifest %s: %w", path, err)
+	}
+
+	return &manifest, nil
+}
+
+// Write the manifest as indented JSON in the given format, ManifestFormatJSON if empty.
+func (m *Manifest) Write(path, format string) error {
+	if err := checkManifestFormat(format); err != nil {
+		return err
+	}
+
+	var v any = m
+	if format == ManifestFormatInToto {
+		v = m.Provenance()
+	}
+
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// Builder returns a builder for the same inputs and options as the recorded build.
+//
+// Relative input paths are resolved against dir. It fails if any input changed since the build. Signing keys
+// and outputs are left for the caller to set.
+func (m *Manifest) Builder(dir string) (*Builder, error) {
+	builder := &Builder{
+		Arch:    m.Arch,
+		Version: m.Version,
+		Cmdline: m.Cmdline,
+		SBAT:    m.SBAT,
+	}
+
+	for i, phases := range m.Phases {
+		parsed, err := types.ParsePhases(phases)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			builder.Phases = parsed
+		} else {
+			builder.PhasePaths = append(builder.PhasePaths, parsed)
+		}
+	}
+
+	banks, err := types.ParsePCRBanks(m.PCRBanks)
+	if err != nil {
+		return nil, err
+	}
+	builder.PCRBanks = banks
+
+	for _, policyPCR := range m.PolicyPCRs {
+		parsed, err := types.ParsePolicyPCR(policyPCR)
+		if err != nil {
+			return nil, err
+		}
+		builder.PolicyPCRs = append(builder.PolicyPCRs, parsed)
+	}
+
+	if m.SourceDateEpoch != nil {
+		epoch := time.Unix(*m.SourceDateEpoch, 0).UTC()
+		builder.SourceDateEpoch = &epoch
+	}
+
+	extraSections := map[string]int{}
+	for i, section := range m.ExtraSections {
+		builder.ExtraSections = append(builder.ExtraSections, types.ExtraSection{Name: constants.Section(section.Name), Measure: section.Measured})
+		extraSections[section.Name] = i
+	}
+
+	for _, input := range m.Inputs {
+		if input.Path == "" {
+			return nil, fmt.Errorf("%s was given in memory, it can't be read again", input.Name)
+		}
+		path := input.Path
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+
+		sum, err := fileSHA256(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", input.Name, err)
+		}
+		if sum != input.SHA256 {
+			return nil, fmt.Errorf("%s %s changed since the build: sha256 is %s, expected %s", input.Name, path, sum, input.SHA256)
+		}
+
+		switch input.Name {
+		case ManifestSdStub:
+			builder.SdStubPath = path
+		case ManifestSdBoot:
+			builder.SdBootPath = path
+		case ManifestKernel:
+			builder.KernelPath = path
+		case ManifestInitrd:
+			builder.InitrdPath = path
+		case ManifestOsRelease:
+			builder.OsRelease = path
+		case ManifestSplash:
+			builder.Splash = path
+		default:
+			i, ok := extraSections[input.Name]
+			if !ok {
+				return nil, fmt.Errorf("unknown manifest input %q", input.Name)
+			}
+			builder.ExtraSections[i].Path = path
+		}
+	}
+
+	for _, section := range builder.ExtraSections {
+		if section.Path == "" {
+			return nil, fmt.Errorf("no input recorded for section %s", section.Name)
+		}
+	}
+
+	return builder, nil
+}
+
+// Diff returns a description of every output of m that is missing or differs in other, and of every UKI
+// section that differs at the same position of the section table, to tell what made the build differ.
+func (m *Manifest) Diff(other *Manifest) []string {
+	got := map[string]string{}
+	for _, output := range other.Outputs {
+		got[output.Name] = output.SHA256
+	}
+
+	var diffs []string
+	for _, output := range m.Outputs {
+		sum, ok := got[output.Name]
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("%s: not rebuilt", output.Name))
+		case sum != output.SHA256:
+			diffs = append(diffs, fmt.Sprintf("%s: sha256 is %s, expected %s", output.Name, sum, output.SHA256))
+		}
+	}
+
+	// sections are compared by position, as stubs can have sections with the same name as the appended ones
+	if len(other.Sections) != len(m.Sections) {
+		diffs = append(diffs, fmt.Sprintf("sections: %d sections, expected %d", len(other.Sections), len(m.Sections)))
+	}
+	for i := range min(len(m.Sections), len(other.Sections)) {
+		section, gotSection := m.Sections[i], other.Sections[i]
+		switch {
+		case gotSection.Name != section.Name:
+			diffs = append(diffs, fmt.Sprintf("section %d: %s, expected %s", i, gotSection.Name, section.Name))
+		case gotSection != section:
+			diffs = append(diffs, fmt.Sprintf("%s section: sha256 %s at 0x%x, expected %s at 0x%x", section.Name,
+				gotSection.SHA256, gotSection.VirtualAddress, section.SHA256, section.VirtualAddress))
+		}
+	}
+
+	return diffs
+}
+
+// manifest records the build of the plan and its result.
+func (plan *Plan) manifest(result *BuildResult, files buildFiles) (*Manifest, error) {
+	m := &Manifest{
+		Ukify:        common.Get(),
+		BuildOptions: plan.options(),
+		Inputs:       slices.Clone(plan.files),
+		BuildDetails: result.BuildDetails,
+	}
+
+	outputs := []struct{ name, path, file string }{{ManifestUKI, result.UKIPath, files.uki}}
+	if files.sdBoot != "" {
+		outputs = append(outputs, struct{ name, path, file string }{ManifestSdBoot, result.SdBootPath, files.sdBoot})
+	}
+	for _, output := range outputs {
+		sum, err := fileSHA256(output.file)
+		if err != nil {
+			return nil, err
+		}
+		m.Outputs = append(m.Outputs, ManifestFile{Name: output.name, Path: output.path, SHA256: sum})
+	}
+
+	return m, nil
+}
+
+// details describes the UKI at ukiPath, built from the plan.
+func (plan *Plan) details(ukiPath string) (BuildDetails, error) {
+	sections, err := manifestSections(ukiPath)
+	if err != nil {
+		return BuildDetails{}, err
+	}
+
+	return BuildDetails{Sections: sections, PCRs: plan.pcrs, Signing: plan.signing}, nil
+}
+
+// manifestSections returns the section table of the UKI at path.
+func manifestSections(path string) ([]ManifestSection, error) {
+	pefile, err := pe.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer pefile.Close() //nolint:errcheck
+
+	var sections []ManifestSection
+	for _, section := range pefile.Sections {
+		data, err := section.Data()
+		if err != nil {
+			return nil, fmt.Errorf("failed reading section %s: %w", section.Name, err)
+		}
+		if size := int(section.VirtualSize); size < len(data) {
+			data = data[:size]
+		}
+		sum := sha256.Sum256(data)
+
+		sections = append(sections, ManifestSection{
+			Name:           section.Name,
+			VirtualAddress: section.VirtualAddress,
+			VirtualSize:    section.VirtualSize,
+			SHA256:         hex.EncodeToString(sum[:]),
+			Measured:       slices.Contains(constants.OrderedSections(), constants.Section(section.Name)),
+		})
+	}
+
+	return sections, nil
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close() //nolint:errcheck
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,199 @@
+package uki
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/kairos-io/go-ukify/pkg/measure"
+	"github.com/kairos-io/go-ukify/pkg/types"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "UKI test Suite")
+}
+
+var _ = Describe("Manifest", func() {
+	var manifest *Manifest
+
+	BeforeEach(func() {
+		epoch := int64(1700000000)
+		manifest = &Manifest{
+			BuildOptions: BuildOptions{
+				Cmdline:         "console=ttyS0",
+				Phases:          []string{"enter-initrd:leave-initrd"},
+				PCRBanks:        []string{"sha256"},
+				SourceDateEpoch: &epoch,
+			},
+			Inputs: []ManifestFile{{Name: ManifestKernel, Path: "vmlinuz", SHA256: "aa"}},
+			Outputs: []ManifestFile{
+				{Name: ManifestUKI, Path: "uki.signed.efi", SHA256: "bb"},
+				{Name: ManifestSdBoot, Path: "sdboot.signed.efi", SHA256: "cc"},
+			},
+			BuildDetails: BuildDetails{
+				Sections: []ManifestSection{
+					{Name: ".cmdline", VirtualAddress: 0x1000, VirtualSize: 13, SHA256: "dd", Measured: true},
+					{Name: ".linux", VirtualAddress: 0x2000, VirtualSize: 100, SHA256: "ee", Measured: true},
+				},
+				PCRs: measure.Calculation{"sha256": {{Phase: "enter-initrd", PCR: 11, Hash: "ff"}}},
+				Signing: ManifestSigning{
+					SecureBootCertificate: "11",
+					PCRKeys:               []ManifestPCRKey{{Fingerprint: "22"}, {Fingerprint: "33", Phases: []string{"enter-initrd"}}},
+				},
+			},
+		}
+		manifest.Ukify.Version = "v1.2.3"
+	})
+
+	It("Reads back the manifest in every format", func() {
+		dir := GinkgoT().TempDir()
+		for _, format := range []string{ManifestFormatJSON, ManifestFormatInToto} {
+			path := filepath.Join(dir, format+".json")
+			Expect(manifest.Write(path, format)).ToNot(HaveOccurred())
+
+			read, err := ReadManifest(path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(read).To(Equal(manifest), format)
+		}
+	})
+
+	It("Writes the outputs as the in-toto statement subject", func() {
+		statement := manifest.Provenance()
+		Expect(statement.Type).To(Equal(InTotoStatementType))
+		Expect(statement.PredicateType).To(Equal(SLSAProvenanceType))
+		Expect(statement.Subject).To(HaveLen(2))
+		Expect(statement.Subject[0].Name).To(Equal(ManifestUKI))
+		Expect(statement.Subject[0].Digest).To(Equal(map[string]string{"sha256": "bb"}))
+		Expect(statement.Predicate.BuildDefinition.ResolvedDependencies[0].Name).To(Equal(ManifestKernel))
+		Expect(statement.Predicate.RunDetails.Builder.Version).To(HaveKeyWithValue("ukify", "v1.2.3"))
+	})
+
+	It("Fails on unknown formats", func() {
+		Expect(manifest.Write(filepath.Join(GinkgoT().TempDir(), "manifest"), "yaml")).To(HaveOccurred())
+	})
+
+	It("Reports the outputs and sections that differ", func() {
+		Expect(manifest.Diff(manifest)).To(BeEmpty())
+
+		rebuilt := *manifest
+		rebuilt.Outputs = []ManifestFile{{Name: ManifestUKI, SHA256: "00"}}
+		rebuilt.Sections = []ManifestSection{manifest.Sections[0], {Name: ".linux", VirtualAddress: 0x2000, VirtualSize: 100, SHA256: "00"}}
+		Expect(manifest.Diff(&rebuilt)).To(Equal([]string{
+			"uki: sha256 is 00, expected bb",
+			"sd-boot: not rebuilt",
+			".linux section: sha256 00 at 0x2000, expected ee at 0x2000",
+		}))
+	})
+
+	It("Compares sections with the same name by position", func() {
+		// stubs can ship an .osrel, and the builder appends another one
+		manifest.Sections = []ManifestSection{
+			{Name: ".osrel", VirtualAddress: 0x1000, VirtualSize: 10, SHA256: "aa"},
+			{Name: ".cmdline", VirtualAddress: 0x2000, VirtualSize: 13, SHA256: "dd", Measured: true},
+			{Name: ".osrel", VirtualAddress: 0x3000, VirtualSize: 20, SHA256: "ab", Measured: true},
+		}
+		rebuilt := *manifest
+		rebuilt.Sections = slices.Clone(manifest.Sections)
+		Expect(manifest.Diff(&rebuilt)).To(BeEmpty())
+
+		rebuilt.Sections[2].SHA256 = "00"
+		Expect(manifest.Diff(&rebuilt)).To(Equal([]string{".osrel section: sha256 00 at 0x3000, expected ab at 0x3000"}))
+
+		rebuilt.Sections = manifest.Sections[:2]
+		Expect(manifest.Diff(&rebuilt)).To(Equal([]string{"sections: 2 sections, expected 3"}))
+
+		rebuilt.Sections = []ManifestSection{manifest.Sections[1], manifest.Sections[0], manifest.Sections[2]}
+		Expect(manifest.Diff(&rebuilt)).To(Equal([]string{"section 0: .cmdline, expected .osrel", "section 1: .osrel, expected .cmdline"}))
+	})
+
+	It("Fails to rebuild from changed inputs", func() {
+		dir := GinkgoT().TempDir()
+		Expect(os.WriteFile(filepath.Join(dir, "vmlinuz"), []byte("kernel"), 0o600)).ToNot(HaveOccurred())
+
+		_, err := manifest.Builder(dir)
+		Expect(err).To(MatchError(ContainSubstring("changed since the build")))
+
+		manifest.Inputs[0].SHA256, err = fileSHA256(filepath.Join(dir, "vmlinuz"))
+		Expect(err).ToNot(HaveOccurred())
+		builder, err := manifest.Builder(dir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(builder.KernelPath).To(Equal(filepath.Join(dir, "vmlinuz")))
+		Expect(builder.Cmdline).To(Equal("console=ttyS0"))
+		Expect(builder.SourceDateEpoch.Unix()).To(Equal(int64(1700000000)))
+		Expect(builder.Phases).To(HaveLen(2))
+	})
+
+	It("Rebuilds the extra sections from their inputs", func() {
+		dir := GinkgoT().TempDir()
+		for name, data := range map[string]string{"vmlinuz": "kernel", "sbom.json": "{}"} {
+			Expect(os.WriteFile(filepath.Join(dir, name), []byte(data), 0o600)).ToNot(HaveOccurred())
+		}
+		kernelSum, err := fileSHA256(filepath.Join(dir, "vmlinuz"))
+		Expect(err).ToNot(HaveOccurred())
+		manifest.Inputs[0].SHA256 = kernelSum
+		manifest.ExtraSections = []ManifestExtraSection{{Name: ".sbom"}}
+
+		_, err = manifest.Builder(dir)
+		Expect(err).To(MatchError(ContainSubstring("no input recorded for section .sbom")))
+
+		sbomSum, err := fileSHA256(filepath.Join(dir, "sbom.json"))
+		Expect(err).ToNot(HaveOccurred())
+		manifest.Inputs = append(manifest.Inputs, ManifestFile{Name: ".sbom", Path: "sbom.json", SHA256: sbomSum})
+		builder, err := manifest.Builder(dir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(builder.ExtraSections).To(Equal([]types.ExtraSection{{Name: ".sbom", Path: filepath.Join(dir, "sbom.json")}}))
+	})
+
+	It("Rebuilds the same UKI from the manifest of a build", func() {
+		dir := GinkgoT().TempDir()
+		kernel := filepath.Join(dir, "vmlinuz")
+		Expect(os.WriteFile(kernel, make([]byte, 4096), 0o600)).To(Succeed())
+		epoch := time.Unix(1700000000, 0).UTC()
+
+		sign := func(builder *Builder, out string) {
+			builder.SBKey = "../pesign/testdata/sb.key"
+			builder.SBCert = "../pesign/testdata/sb.pem"
+			builder.PCRKey = "../measure/pcr/testdata/private.pem"
+			builder.OutUKIPath = filepath.Join(out, "uki.signed.efi")
+			builder.OutSdBootPath = filepath.Join(out, "sdboot.signed.efi")
+			builder.OutManifestPath = filepath.Join(out, "manifest.json")
+		}
+
+		builder := &Builder{
+			SdStubPath:      "../pesign/testdata/file.efi",
+			SdBootPath:      "../pesign/testdata/file.efi",
+			KernelPath:      kernel,
+			Cmdline:         "console=ttyS0",
+			SourceDateEpoch: &epoch,
+		}
+		sign(builder, dir)
+		Expect(builder.Build()).To(Succeed())
+
+		built, err := ReadManifest(builder.OutManifestPath)
+		Expect(err).ToNot(HaveOccurred())
+
+		rebuilder, err := built.Builder("")
+		Expect(err).ToNot(HaveOccurred())
+		out := filepath.Join(dir, "rebuilt")
+		Expect(os.Mkdir(out, 0o700)).To(Succeed())
+		sign(rebuilder, out)
+		Expect(rebuilder.Build()).To(Succeed())
+
+		rebuilt, err := ReadManifest(rebuilder.OutManifestPath)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(built.Diff(rebuilt)).To(BeEmpty())
+		Expect(rebuilt.Outputs).To(HaveLen(2))
+
+		first, err := os.ReadFile(builder.OutUKIPath)
+		Expect(err).ToNot(HaveOccurred())
+		second, err := os.ReadFile(rebuilder.OutUKIPath)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(second).To(Equal(first))
+	})
+})
@@ -0,0 +1,464 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// PE/COFF layout offsets, see https://learn.microsoft.com/en-us/windows/win32/debug/pe-format.
+const (
+	peSignatureOffset = 0x3c
+	coffHeaderSize    = 20
+	sectionHeaderSize = 40
+
+	// offsets in the COFF header
+	coffNumberOfSections   = 2
+	coffTimeDateStamp      = 4
+	coffSizeOfOptionalHdr  = 16
+	coffPointerToSymbolTab = 8
+
+	// offsets in the optional header, the same for PE32 and PE32+
+	optSizeOfCode            = 4
+	optSizeOfInitializedData = 8
+	optSectionAlignment      = 32
+	optFileAlignment         = 36
+	optSizeOfImage           = 56
+	optSizeOfHeaders         = 60
+	optCheckSum              = 64
+
+	// offset of the data directories in the optional header
+	optDataDirectoriesPE32     = 96
+	optDataDirectoriesPE32Plus = 112
+	// index of the certificate table data directory
+	securityDirectory = 4
+
+	pe32Magic     = 0x10b
+	pe32PlusMagic = 0x20b
+)
+
+// Section characteristics.
+const (
+	scnCntCode            = 0x00000020
+	scnCntInitializedData = 0x00000040
+	scnMemExecute         = 0x20000000
+	scnMemRead            = 0x40000000
+)
+
+// peImage is a parsed PE image that sections can be appended to.
+type peImage struct {
+	data []byte
+
+	coff          int
+	opt           int
+	sectionTable  int
+	numSections   int
+	sectionAlign  uint32
+	fileAlign     uint32
+	dataDirectory int
+}
+
+// readPEImage reads and parses the PE image at path.
+func readPEImage(path string) (*peImage, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < peSignatureOffset+4 {
+		return nil, errors.New("file too small to be a PE image")
+	}
+
+	peOffset := int(binary.LittleEndian.Uint32(data[peSignatureOffset:]))
+	if peOffset+4+coffHeaderSize > len(data) || !bytes.Equal(data[peOffset:peOffset+4], []byte("PE\x00\x00")) {
+		return nil, errors.New("missing PE signature")
+	}
+
+	img := &peImage{data: data, coff: peOffset + 4}
+	img.opt = img.coff + coffHeaderSize
+	img.numSections = int(img.u16(img.coff + coffNumberOfSections))
+	img.sectionTable = img.opt + int(img.u16(img.coff+coffSizeOfOptionalHdr))
+
+	if img.opt+optDataDirectoriesPE32Plus > len(data) || img.sectionTable+img.numSections*sectionHeaderSize > len(data) {
+		return nil, errors.New("truncated PE headers")
+	}
+
+	switch img.u16(img.opt) {
+	case pe32Magic:
+		img.dataDirectory = img.opt + optDataDirectoriesPE32
+	case pe32PlusMagic:
+		img.dataDirectory = img.opt + optDataDirectoriesPE32Plus
+	default:
+		return nil, fmt.Errorf("unknown optional header magic 0x%x", img.u16(img.opt))
+	}
+
+	img.sectionAlign = img.u32(img.opt + optSectionAlignment)
+	img.fileAlign = img.u32(img.opt + optFileAlignment)
+	if img.sectionAlign == 0 || img.fileAlign == 0 {
+		return nil, errors.New("invalid PE alignment")
+	}
+
+	return img, nil
+}
+
+func (img *peImage) u16(offset int) uint16 { return binary.LittleEndian.Uint16(img.data[offset:]) }
+func (img *peImage) u32(offset int) uint32 { return binary.LittleEndian.Uint32(img.data[offset:]) }
+func (img *peImage) put16(offset int, v uint16) {
+	binary.LittleEndian.PutUint16(img.data[offset:], v)
+}
+func (img *peImage) put32(offset int, v uint32) {
+	binary.LittleEndian.PutUint32(img.data[offset:], v)
+}
+
+// section returns the offset of the header of the i-th section.
+func (img *peImage) section(i int) int {
+	return img.sectionTable + i*sectionHeaderSize
+}
+
+// imageBase returns the preferred load address of the image.
+func (img *peImage) imageBase() uint64 {
+	if img.u16(img.opt) == pe32Magic {
+		return uint64(img.u32(img.opt + 28))
+	}
+	return binary.LittleEndian.Uint64(img.data[img.opt+24:])
+}
+
+// stripSignature drops the certificate table of a signed image, as appending sections invalidates it.
+func (img *peImage) stripSignature() {
+	dir := img.dataDirectory + securityDirectory*8
+	offset, size := img.u32(dir), img.u32(dir+4)
+	if offset == 0 && size == 0 {
+		return
+	}
+
+	slog.Warn("sd-stub is signed, dropping its signature")
+	if int(offset)+int(size) == len(img.data) {
+		img.data = img.data[:offset]
+	}
+	img.put32(dir, 0)
+	img.put32(dir+4, 0)
+}
+
+// growHeaders makes room in the headers for extra section headers, moving the raw data of the sections
+// further into the file if needed.
+func (img *peImage) growHeaders(extra int) error {
+	needed := uint32(img.sectionTable + (img.numSections+extra)*sectionHeaderSize)
+	sizeOfHeaders := img.u32(img.opt + optSizeOfHeaders)
+	if needed <= sizeOfHeaders {
+		return nil
+	}
+
+	grown := alignUp(needed, img.fileAlign)
+	for i := 0; i < img.numSections; i++ {
+		if va := img.u32(img.section(i) + 12); va != 0 && grown > va {
+			return fmt.Errorf("no room in the PE headers for %d more sections", extra)
+		}
+	}
+
+	delta := grown - sizeOfHeaders
+	slog.Debug("Growing PE headers", "from", sizeOfHeaders, "to", grown)
+
+	data := make([]byte, 0, len(img.data)+int(delta))
+	data = append(data, img.data[:sizeOfHeaders]...)
+	data = append(data, make([]byte, delta)...)
+	img.data = append(data, img.data[sizeOfHeaders:]...)
+
+	for i := 0; i < img.numSections; i++ {
+		if pointer := img.u32(img.section(i) + 20); pointer != 0 {
+			img.put32(img.section(i)+20, pointer+delta)
+		}
+	}
+	if pointer := img.u32(img.coff + coffPointerToSymbolTab); pointer != 0 {
+		img.put32(img.coff+coffPointerToSymbolTab, pointer+delta)
+	}
+	img.put32(img.opt+optSizeOfHeaders, grown)
+
+	return nil
+}
+
+// replaceSection overwrites the contents of the section of the image with the same name, which has to have
+// room for them in the file and before the next section in memory.
+func (img *peImage) replaceSection(section types.UkiSection) error {
+	data, err := os.ReadFile(section.Path)
+	if err != nil {
+		return err
+	}
+
+	header := -1
+	for i := 0; i < img.numSections; i++ {
+		if bytes.Equal(bytes.TrimRight(img.data[img.section(i):img.section(i)+8], "\x00"), []byte(section.Name)) {
+			header = img.section(i)
+			break
+		}
+	}
+	if header == -1 {
+		return fmt.Errorf("section %s is not in the sd-stub", section.Name)
+	}
+
+	virtualSize, virtualAddress := img.u32(header+8), img.u32(header+12)
+	rawSize, pointer := img.u32(header+16), img.u32(header+20)
+	if int(pointer)+int(rawSize) > len(img.data) {
+		return fmt.Errorf("section %s is truncated in the sd-stub", section.Name)
+	}
+
+	// keep the stub untouched if the contents don't change
+	if int(virtualSize) == len(data) && bytes.Equal(img.data[pointer:pointer+virtualSize], data) {
+		return nil
+	}
+
+	room := rawSize
+	for i := 0; i < img.numSections; i++ {
+		if va := img.u32(img.section(i) + 12); va > virtualAddress {
+			room = min(room, va-virtualAddress)
+		}
+	}
+	if uint64(len(data)) > uint64(room) {
+		return fmt.Errorf("section %s is %d bytes, the sd-stub only has room for %d", section.Name, len(data), room)
+	}
+
+	clear(img.data[pointer : pointer+rawSize])
+	copy(img.data[pointer:], data)
+	img.put32(header+8, uint32(len(data)))
+
+	return nil
+}
+
+// appendedSection is a section added to the image, with its contents read from a file.
+type appendedSection struct {
+	name constants.Section
+	path string
+	size uint32
+}
+
+// peLayout is a stub with sections laid out after it, ready to be written.
+type peLayout struct {
+	img       *peImage
+	appended  []appendedSection
+	addresses []uint64
+	imageBase uint64
+}
+
+// writePE writes the stub at stubPath with the given sections appended to outPath.
+//
+// Sections that aren't appended replace the contents of the stub section of the same name in place.
+//
+// The output only depends on the inputs: sections are laid out in the given order right after the last
+// section of the stub, aligned to the stub alignments and padded with zeroes, and the COFF TimeDateStamp
+// is set to timestamp, or kept as in the stub if nil. The section contents are streamed from their files.
+// It returns the address each section is mapped at, in order.
+func writePE(outPath, stubPath string, sections []types.UkiSection, timestamp *time.Time) ([]uint64, error) {
+	layout, err := layoutSections(stubPath, sections, timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	return layout.addresses, layout.write(outPath)
+}
+
+// layoutPE returns the address each appended section would be mapped at if added to the stub at stubPath,
+// and the image base they are relative to.
+//
+// Appending more sections afterwards doesn't move them.
+func layoutPE(stubPath string, sections []types.UkiSection) ([]uint64, uint64, error) {
+	layout, err := layoutSections(stubPath, sections, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return layout.addresses, layout.imageBase, nil
+}
+
+// layoutSections lays out the sections after the stub at stubPath, see writePE.
+func layoutSections(stubPath string, sections []types.UkiSection, timestamp *time.Time) (*peLayout, error) {
+	img, err := readPEImage(stubPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse sd-stub: %w", err)
+	}
+
+	img.stripSignature()
+
+	appended := make([]appendedSection, 0, len(sections))
+	for _, section := range sections {
+		if !section.Append {
+			if err = img.replaceSection(section); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if len(section.Name) > 8 {
+			return nil, fmt.Errorf("section name %s is longer than 8 bytes", section.Name)
+		}
+		st, err := os.Stat(section.Path)
+		if err != nil {
+			return nil, err
+		}
+		if st.Size() > int64(^uint32(0)-img.sectionAlign) {
+			return nil, fmt.Errorf("section %s is too big", section.Name)
+		}
+		appended = append(appended, appendedSection{name: section.Name, path: section.Path, size: uint32(st.Size())})
+	}
+
+	if err = img.growHeaders(len(appended)); err != nil {
+		return nil, err
+	}
+
+	// the new sections go after the end of the stub, both in the file and in memory
+	var virtualEnd uint32
+	for i := 0; i < img.numSections; i++ {
+		header := img.section(i)
+		size := img.u32(header + 8)
+		if size == 0 {
+			size = img.u32(header + 16)
+		}
+		virtualEnd = max(virtualEnd, img.u32(header+12)+size)
+	}
+
+	fileEnd := alignUp(uint32(len(img.data)), img.fileAlign)
+	img.data = append(img.data, make([]byte, fileEnd-uint32(len(img.data)))...)
+
+	addresses := make([]uint64, 0, len(appended))
+	sizeOfCode := img.u32(img.opt + optSizeOfCode)
+	sizeOfData := img.u32(img.opt + optSizeOfInitializedData)
+	virtual, pointer := alignUp(virtualEnd, img.sectionAlign), fileEnd
+	for i, section := range appended {
+		header := img.section(img.numSections + i)
+		rawSize := alignUp(section.size, img.fileAlign)
+
+		characteristics := uint32(scnCntInitializedData | scnMemRead)
+		if section.name == constants.Linux {
+			characteristics = scnCntCode | scnMemExecute | scnMemRead
+			sizeOfCode += rawSize
+		} else {
+			sizeOfData += rawSize
+		}
+
+		clear(img.data[header : header+sectionHeaderSize])
+		copy(img.data[header:header+8], section.name)
+		img.put32(header+8, section.size)
+		img.put32(header+12, virtual)
+		img.put32(header+16, rawSize)
+		img.put32(header+20, pointer)
+		img.put32(header+36, characteristics)
+
+		addresses = append(addresses, img.imageBase()+uint64(virtual))
+		virtual = alignUp(virtual+section.size, img.sectionAlign)
+		pointer += rawSize
+	}
+
+	img.put16(img.coff+coffNumberOfSections, uint16(img.numSections+len(appended)))
+	if timestamp != nil {
+		img.put32(img.coff+coffTimeDateStamp, uint32(timestamp.Unix()))
+	}
+	img.put32(img.opt+optSizeOfCode, sizeOfCode)
+	img.put32(img.opt+optSizeOfInitializedData, sizeOfData)
+	img.put32(img.opt+optSizeOfImage, virtual)
+
+	return &peLayout{img: img, appended: appended, addresses: addresses, imageBase: img.imageBase()}, nil
+}
+
+// write the laid out image to outPath.
+func (layout *peLayout) write(outPath string) error {
+	img := layout.img
+
+	out, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close() //nolint:errcheck
+
+	// The checksum covers the whole file, so it is computed while streaming the sections and patched
+	// into the headers at the end
+	checksum := &peChecksum{skip: int64(img.opt + optCheckSum)}
+	w := io.MultiWriter(out, checksum)
+	if _, err = w.Write(img.data); err != nil {
+		return err
+	}
+
+	for _, section := range layout.appended {
+		if err = copySection(w, section); err != nil {
+			return err
+		}
+		padding := alignUp(section.size, img.fileAlign) - section.size
+		if _, err = w.Write(make([]byte, padding)); err != nil {
+			return err
+		}
+	}
+
+	sum := make([]byte, 4)
+	binary.LittleEndian.PutUint32(sum, checksum.Sum())
+	if _, err = out.WriteAt(sum, int64(img.opt+optCheckSum)); err != nil {
+		return err
+	}
+
+	return out.Close()
+}
+
+// copySection copies the contents of the section file to w, failing if it changed size since it was laid out.
+func copySection(w io.Writer, section appendedSection) error {
+	f, err := os.Open(section.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close() //nolint:errcheck
+
+	n, err := io.Copy(w, f)
+	if err != nil {
+		return err
+	}
+	if n != int64(section.size) {
+		return fmt.Errorf("section %s changed size while assembling", section.name)
+	}
+	return nil
+}
+
+// peChecksum computes the PE image checksum, treating the checksum field itself as zero.
+type peChecksum struct {
+	// offset of the checksum field
+	skip int64
+
+	offset  int64
+	sum     uint32
+	pending int
+}
+
+func (c *peChecksum) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if c.offset >= c.skip && c.offset < c.skip+4 {
+			b = 0
+		}
+		if c.offset%2 == 0 {
+			c.pending = int(b)
+		} else {
+			c.sum += uint32(c.pending) | uint32(b)<<8
+			c.sum = (c.sum & 0xffff) + (c.sum >> 16)
+		}
+		c.offset++
+	}
+	return len(p), nil
+}
+
+// Sum returns the checksum of everything written so far.
+func (c *peChecksum) Sum() uint32 {
+	sum := c.sum
+	if c.offset%2 == 1 {
+		sum += uint32(c.pending)
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return (sum&0xffff + sum>>16) + uint32(c.offset)
+}
+
+func alignUp(v, alignment uint32) uint32 {
+	return (v + alignment - 1) &^ (alignment - 1)
+}
@@ -0,0 +1,197 @@
+package uki
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+	"github.com/kairos-io/go-ukify/pkg/types"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// checksum computes the PE checksum of data the way the loaders do, with the checksum field as zero
+func checksum(data []byte, offset int) uint32 {
+	var sum uint32
+	for i := 0; i < len(data); i += 2 {
+		var word uint32
+		for j := 0; j < 2 && i+j < len(data); j++ {
+			if i+j < offset || i+j >= offset+4 {
+				word |= uint32(data[i+j]) << (8 * j)
+			}
+		}
+		sum += word
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return sum + uint32(len(data))
+}
+
+var _ = Describe("PE", func() {
+	const stub = "../pesign/testdata/file.efi"
+	var dir string
+	var sections []types.UkiSection
+
+	section := func(name constants.Section, data []byte) types.UkiSection {
+		path := filepath.Join(dir, "section"+string(name))
+		Expect(os.WriteFile(path, data, 0o600)).To(Succeed())
+		return types.UkiSection{Name: name, Path: path, Append: true}
+	}
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		sections = []types.UkiSection{
+			section(constants.CMDLine, []byte("console=ttyS0")),
+			section(constants.Linux, bytes.Repeat([]byte{0xaa}, 5000)),
+		}
+	})
+
+	It("Writes a valid PE with the sections appended", func() {
+		out := filepath.Join(dir, "uki.efi")
+		addresses, err := writePE(out, stub, sections, nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		original, err := pe.Open(stub)
+		Expect(err).ToNot(HaveOccurred())
+		defer original.Close() //nolint:errcheck
+
+		written, err := pe.Open(out)
+		Expect(err).ToNot(HaveOccurred())
+		defer written.Close() //nolint:errcheck
+
+		header := written.OptionalHeader.(*pe.OptionalHeader64)
+		Expect(written.Sections).To(HaveLen(len(original.Sections) + 2))
+
+		var end uint32
+		for i, s := range original.Sections {
+			Expect(written.Sections[i].SectionHeader).To(Equal(s.SectionHeader))
+			end = max(end, s.VirtualAddress+s.VirtualSize)
+		}
+		for i, s := range written.Sections[len(original.Sections):] {
+			Expect(s.Name).To(Equal(string(sections[i].Name)))
+			Expect(s.VirtualAddress % header.SectionAlignment).To(BeZero())
+			Expect(s.Offset % header.FileAlignment).To(BeZero())
+			Expect(s.VirtualAddress).To(BeNumerically(">=", end))
+			Expect(header.ImageBase + uint64(s.VirtualAddress)).To(Equal(addresses[i]))
+
+			data, err := os.ReadFile(sections[i].Path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(s.VirtualSize).To(BeEquivalentTo(len(data)))
+			contents, err := s.Data()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(contents[:s.VirtualSize]).To(Equal(data))
+			end = s.VirtualAddress + s.VirtualSize
+		}
+		Expect(written.Sections[len(written.Sections)-1].Characteristics & pe.IMAGE_SCN_MEM_EXECUTE).ToNot(BeZero())
+		Expect(header.SizeOfImage).To(Equal(alignUp(end, header.SectionAlignment)))
+
+		data, err := os.ReadFile(out)
+		Expect(err).ToNot(HaveOccurred())
+		peOffset := int(binary.LittleEndian.Uint32(data[peSignatureOffset:]))
+		checksumOffset := peOffset + 4 + coffHeaderSize + optCheckSum
+		Expect(header.CheckSum).To(Equal(checksum(data, checksumOffset)))
+	})
+
+	It("Sets the TimeDateStamp from the source date epoch", func() {
+		original, err := pe.Open(stub)
+		Expect(err).ToNot(HaveOccurred())
+		defer original.Close() //nolint:errcheck
+
+		kept := filepath.Join(dir, "kept.efi")
+		_, err = writePE(kept, stub, sections, nil)
+		Expect(err).ToNot(HaveOccurred())
+		written, err := pe.Open(kept)
+		Expect(err).ToNot(HaveOccurred())
+		defer written.Close() //nolint:errcheck
+		Expect(written.TimeDateStamp).To(Equal(original.TimeDateStamp))
+
+		epoch := time.Unix(1700000000, 0)
+		stamped := filepath.Join(dir, "stamped.efi")
+		_, err = writePE(stamped, stub, sections, &epoch)
+		Expect(err).ToNot(HaveOccurred())
+		written, err = pe.Open(stamped)
+		Expect(err).ToNot(HaveOccurred())
+		defer written.Close() //nolint:errcheck
+		Expect(written.TimeDateStamp).To(BeEquivalentTo(1700000000))
+	})
+
+	It("Grows the headers to fit more section headers", func() {
+		for i := range 16 {
+			sections = append(sections, section(constants.Section(fmt.Sprintf(".s%d", i)), []byte{byte(i)}))
+		}
+
+		out := filepath.Join(dir, "uki.efi")
+		_, err := writePE(out, stub, sections, nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		original, err := pe.Open(stub)
+		Expect(err).ToNot(HaveOccurred())
+		defer original.Close() //nolint:errcheck
+		written, err := pe.Open(out)
+		Expect(err).ToNot(HaveOccurred())
+		defer written.Close() //nolint:errcheck
+
+		Expect(written.OptionalHeader.(*pe.OptionalHeader64).SizeOfHeaders).To(BeNumerically(">", original.OptionalHeader.(*pe.OptionalHeader64).SizeOfHeaders))
+		Expect(written.Sections).To(HaveLen(len(original.Sections) + len(sections)))
+		// the sections of the stub moved in the file, not in memory
+		for i, s := range original.Sections {
+			Expect(written.Sections[i].VirtualAddress).To(Equal(s.VirtualAddress))
+			Expect(written.Sections[i].Offset).To(BeNumerically(">", s.Offset))
+			want, err := s.Data()
+			Expect(err).ToNot(HaveOccurred())
+			got, err := written.Sections[i].Data()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(got).To(Equal(want), s.Name)
+		}
+	})
+
+	It("Drops the signature of a signed stub", func() {
+		sb, err := pesign.NewSecureBootSigner("../pesign/testdata/sb.pem", "../pesign/testdata/sb.key")
+		Expect(err).ToNot(HaveOccurred())
+		signer, err := pesign.NewSigner(sb)
+		Expect(err).ToNot(HaveOccurred())
+		signed := filepath.Join(dir, "signed.efi")
+		Expect(signer.Sign(stub, signed)).To(Succeed())
+
+		unsigned := filepath.Join(dir, "unsigned.efi")
+		_, err = writePE(unsigned, stub, sections, nil)
+		Expect(err).ToNot(HaveOccurred())
+		out := filepath.Join(dir, "uki.efi")
+		_, err = writePE(out, signed, sections, nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		written, err := pe.Open(out)
+		Expect(err).ToNot(HaveOccurred())
+		defer written.Close() //nolint:errcheck
+		security := written.OptionalHeader.(*pe.OptionalHeader64).DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_SECURITY]
+		Expect(security).To(Equal(pe.DataDirectory{}))
+
+		// the same as appending to the stub before it was signed
+		fromSigned, err := os.ReadFile(out)
+		Expect(err).ToNot(HaveOccurred())
+		fromUnsigned, err := os.ReadFile(unsigned)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fromSigned).To(Equal(fromUnsigned))
+	})
+
+	It("Writes the same bytes out of the same inputs", func() {
+		epoch := time.Unix(1700000000, 0)
+		first, second := filepath.Join(dir, "first.efi"), filepath.Join(dir, "second.efi")
+		_, err := writePE(first, stub, sections, &epoch)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = writePE(second, stub, sections, &epoch)
+		Expect(err).ToNot(HaveOccurred())
+
+		a, err := os.ReadFile(first)
+		Expect(err).ToNot(HaveOccurred())
+		b, err := os.ReadFile(second)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(a).To(Equal(b))
+	})
+})
@@ -0,0 +1,312 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/measure"
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/utils"
+)
+
+// Plan is a resolved build: its inputs, the sections of the UKI, where they are laid out and the PCR values
+// they measure to. Everything but the signatures is known, so nothing is left to fail but signing and
+// writing the outputs.
+//
+// A plan is immutable once made, it can be executed any number of times, concurrently. It holds the
+// generated sections in a directory of its own, removed by Close.
+type Plan struct {
+	// copy of the configuration the plan was made from, with defaults and signers resolved
+	config Builder
+
+	dir       string
+	inputs    inputPaths
+	imageBase uint64
+	files     []ManifestFile
+	sections  []types.UkiSection
+	pcrs      measure.Calculation
+	signing   ManifestSigning
+}
+
+// PlanDescription describes what a plan builds.
+type PlanDescription struct {
+	BuildOptions
+
+	Inputs []ManifestFile `json:"inputs"`
+	// Sections added to the sd-stub, in order.
+	Sections []PlannedSection `json:"sections"`
+	// Predicted PCR 11 value per bank at the end of every step of every phase path.
+	PCRs measure.Calculation `json:"pcrs"`
+	// Keys the build is signed with.
+	Signing ManifestSigning `json:"signing"`
+}
+
+// PlannedSection is a section of the UKI, as planned.
+type PlannedSection struct {
+	Name string `json:"name"`
+	// Size of the section, unknown for .pcrsig until the policies are signed.
+	Size uint64 `json:"size,omitempty"`
+	// Address the section is loaded at relative to the image base, as in the section table. Unknown for
+	// .pcrsig, that goes after the last section.
+	VirtualAddress uint32 `json:"virtualAddress,omitempty"`
+	// SHA-256 of the section contents, unknown for .pcrsig until the policies are signed.
+	SHA256 string `json:"sha256,omitempty"`
+	// Whether the section is appended to the sd-stub, or is measured as found in it.
+	Appended bool `json:"appended"`
+	// Whether the stub measures the section into PCR 11.
+	Measured bool `json:"measured"`
+}
+
+// Plan resolves the build without writing any output.
+//
+// The Builder isn't modified, so a configured Builder can make any number of plans, concurrently.
+func (builder *Builder) Plan(ctx context.Context) (_ *Plan, err error) {
+	plan := &Plan{config: *builder}
+	config := &plan.config
+
+	// the plan has its own copy of everything it resolves
+	config.PCRKeys = slices.Clone(builder.PCRKeys)
+	config.ExtraSections = slices.Clone(builder.ExtraSections)
+	config.SBAT = slices.Clone(builder.SBAT)
+
+	// Check if we got any phases
+	if len(config.Phases) == 0 {
+		// use default phases
+		config.Phases = types.OrderedPhases()
+	}
+
+	for _, path := range config.phasePaths() {
+		if err = types.ValidatePhases(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.SourceDateEpoch == nil {
+		if config.SourceDateEpoch, err = utils.SourceDateEpoch(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Fail early on unsupported banks before signing anything
+	if _, _, err = types.GetTPMALGorithmForBanks(config.PCRBanks); err != nil {
+		return nil, err
+	}
+
+	if err = checkManifestFormat(config.ManifestFormat); err != nil {
+		return nil, err
+	}
+
+	if config.PCRSigner == nil {
+		if config.PCRKey != "" {
+			signer, err := pesign.NewPCRSigner(config.PCRKey)
+			if err != nil {
+				return nil, err
+			}
+			config.PCRSigner = signer
+		}
+	}
+
+	for i := range config.PCRKeys {
+		if config.PCRKeys[i].Signer == nil {
+			signer, err := pesign.NewPCRSigner(config.PCRKeys[i].KeyPath)
+			if err != nil {
+				return nil, err
+			}
+			config.PCRKeys[i].Signer = signer
+		}
+	}
+
+	// Try to generate a signer base on our given args
+	// If we have a	either a signer or key/cert
+	// Try to use first the signer as we can use a custom signed passed in the struct
+	// otherwise create a new default signer with the key and cert
+	if config.sbSignEnabled() {
+		if config.SecureBootSigner == nil {
+			if config.SBCert != "" && config.SBKey != "" {
+				sb, err := pesign.NewSecureBootSigner(config.SBCert, config.SBKey)
+				if err != nil {
+					return nil, err
+				}
+				sbSigner, err := pesign.NewSigner(sb)
+				if err != nil {
+					return nil, err
+				}
+				config.SecureBootSigner = sbSigner
+			}
+		}
+	}
+
+	// Fail before building on a SOURCE_DATE_EPOCH the signatures can't record
+	if config.sbSignEnabled() {
+		if err = pesign.CheckSigningTime(config.signingTime()); err != nil {
+			return nil, err
+		}
+	}
+
+	if plan.dir, err = os.MkdirTemp("", "ukify-plan"); err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			plan.Close()
+		}
+	}()
+
+	if plan.inputs, err = plan.resolveInputs(ctx); err != nil {
+		return nil, err
+	}
+
+	slog.Info("Generating UKI sections")
+
+	// generate and build list of all sections
+	if err = plan.generateSections(ctx); err != nil {
+		return nil, fmt.Errorf("error generating sections: %w", err)
+	}
+
+	slog.Info("Generated UKI sections")
+
+	if err = plan.layout(); err != nil {
+		return nil, fmt.Errorf("error laying out UKI: %w", err)
+	}
+
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if plan.files, err = plan.inputFiles(); err != nil {
+		return nil, err
+	}
+
+	// every step of every path is signed, so predict them all
+	var steps [][]types.PhaseInfo
+	for _, path := range config.phasePaths() {
+		for i := range path {
+			steps = append(steps, path[:i+1])
+		}
+	}
+	if plan.pcrs, err = measure.Calculate(utils.SectionsData(plan.sections), steps, config.PCRBanks, constants.UKIPCR); err != nil {
+		return nil, err
+	}
+
+	if config.SecureBootSigner != nil {
+		fingerprint := sha256.Sum256(config.SecureBootSigner.Certificate().Raw)
+		plan.signing.SecureBootCertificate = hex.EncodeToString(fingerprint[:])
+	}
+	for _, key := range config.pcrKeys() {
+		fingerprint := sha256.Sum256(x509.MarshalPKCS1PublicKey(key.Signer.PublicRSAKey()))
+		pcrKey := ManifestPCRKey{Fingerprint: hex.EncodeToString(fingerprint[:])}
+		if len(key.Phases) > 0 {
+			pcrKey.Phases = []string{types.PhasesToString(key.Phases)}
+		}
+		plan.signing.PCRKeys = append(plan.signing.PCRKeys, pcrKey)
+	}
+
+	return plan, nil
+}
+
+// Close removes the generated sections of the plan, it can't be executed afterwards.
+func (plan *Plan) Close() {
+	if err := os.RemoveAll(plan.dir); err != nil {
+		slog.Warn("failed to remove plan dir", "dir", plan.dir, "error", err)
+	}
+}
+
+// Describe returns what the plan builds.
+func (plan *Plan) Describe() (PlanDescription, error) {
+	description := PlanDescription{
+		BuildOptions: plan.options(),
+		Inputs:       slices.Clone(plan.files),
+		PCRs:         plan.pcrs,
+		Signing:      plan.signing,
+	}
+
+	for _, section := range plan.sections {
+		planned := PlannedSection{
+			Name:     string(section.Name),
+			Size:     section.Size,
+			Appended: section.Append,
+			Measured: section.Measure,
+		}
+		if section.Append {
+			planned.VirtualAddress = uint32(section.VMA - plan.imageBase)
+		}
+		sum, err := fileSHA256(section.Path)
+		if err != nil {
+			return description, err
+		}
+		planned.SHA256 = sum
+		description.Sections = append(description.Sections, planned)
+	}
+
+	if plan.config.pcrSignEnabled() {
+		description.Sections = append(description.Sections, PlannedSection{Name: string(constants.PCRSig), Appended: true})
+	}
+
+	return description, nil
+}
+
+// layout records the size of every section and the address it is loaded at.
+func (plan *Plan) layout() error {
+	addresses, imageBase, err := layoutPE(plan.inputs.sdStub, plan.sections)
+	if err != nil {
+		return err
+	}
+
+	plan.imageBase = imageBase
+	for i, j := 0, 0; i < len(plan.sections); i++ {
+		st, err := os.Stat(plan.sections[i].Path)
+		if err != nil {
+			return err
+		}
+		plan.sections[i].Size = uint64(st.Size())
+		if plan.sections[i].Append {
+			plan.sections[i].VMA = addresses[j]
+			j++
+		}
+	}
+
+	return nil
+}
+
+// options returns the options the plan builds with.
+func (plan *Plan) options() BuildOptions {
+	config := plan.config
+	options := BuildOptions{
+		Arch:    config.Arch,
+		Version: config.Version,
+		Cmdline: config.Cmdline,
+	}
+
+	for _, path := range config.phasePaths() {
+		options.Phases = append(options.Phases, types.PhasesToString(path))
+	}
+	for _, bank := range config.PCRBanks {
+		options.PCRBanks = append(options.PCRBanks, types.BankName(bank))
+	}
+	for _, policyPCR := range config.PolicyPCRs {
+		options.PolicyPCRs = append(options.PolicyPCRs, policyPCR.String())
+	}
+	options.SBAT = config.SBAT
+	for _, section := range config.ExtraSections {
+		options.ExtraSections = append(options.ExtraSections, ManifestExtraSection{Name: string(section.Name), Measured: section.Measure})
+	}
+	if config.SourceDateEpoch != nil {
+		epoch := config.SourceDateEpoch.Unix()
+		options.SourceDateEpoch = &epoch
+	}
+
+	return options
+}
@@ -0,0 +1,154 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"fmt"
+)
+
+// Manifest formats.
+const (
+	// ManifestFormatJSON writes the Manifest as is.
+	ManifestFormatJSON = "json"
+	// ManifestFormatInToto writes the Manifest as an in-toto statement with a SLSA provenance predicate.
+	ManifestFormatInToto = "in-toto"
+)
+
+// in-toto and SLSA identifiers, see https://slsa.dev/spec/v1.0/provenance.
+const (
+	InTotoStatementType = "https://in-toto.io/Statement/v1"
+	SLSAProvenanceType  = "https://slsa.dev/provenance/v1"
+	// ProvenanceBuildType describes how the UKI was built out of the build definition.
+	ProvenanceBuildType = "https://github.com/kairos-io/go-ukify/uki/v1"
+	// ProvenanceBuilderID identifies ukify as the builder.
+	ProvenanceBuilderID = "https://github.com/kairos-io/go-ukify"
+)
+
+// checkManifestFormat fails if format is not a known manifest format, empty being ManifestFormatJSON.
+func checkManifestFormat(format string) error {
+	switch format {
+	case "", ManifestFormatJSON, ManifestFormatInToto:
+		return nil
+	}
+	return fmt.Errorf("unknown manifest format %q, valid formats are %s and %s", format, ManifestFormatJSON, ManifestFormatInToto)
+}
+
+// Statement is an in-toto statement about the outputs of a build.
+type Statement struct {
+	Type          string               `json:"_type"`
+	Subject       []ResourceDescriptor `json:"subject"`
+	PredicateType string               `json:"predicateType"`
+	Predicate     Provenance           `json:"predicate"`
+}
+
+// ResourceDescriptor is an in-toto resource descriptor.
+type ResourceDescriptor struct {
+	Name        string            `json:"name"`
+	Digest      map[string]string `json:"digest"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Provenance is a SLSA v1 provenance predicate.
+type Provenance struct {
+	BuildDefinition BuildDefinition `json:"buildDefinition"`
+	RunDetails      RunDetails      `json:"runDetails"`
+}
+
+// BuildDefinition is the SLSA v1 build definition of a UKI build.
+type BuildDefinition struct {
+	BuildType            string               `json:"buildType"`
+	ExternalParameters   BuildOptions         `json:"externalParameters"`
+	InternalParameters   BuildDetails         `json:"internalParameters"`
+	ResolvedDependencies []ResourceDescriptor `json:"resolvedDependencies"`
+}
+
+// RunDetails is the SLSA v1 run details of a UKI build.
+type RunDetails struct {
+	Builder ProvenanceBuilder `json:"builder"`
+}
+
+// ProvenanceBuilder is the SLSA v1 builder, ukify.
+type ProvenanceBuilder struct {
+	ID      string            `json:"id"`
+	Version map[string]string `json:"version"`
+}
+
+// Provenance returns the manifest as an in-toto statement, the outputs being its subject.
+//
+// The manifest files are recorded with their manifest name, and their path as the path annotation.
+func (m *Manifest) Provenance() *Statement {
+	statement := &Statement{
+		Type:          InTotoStatementType,
+		Subject:       resourceDescriptors(m.Outputs),
+		PredicateType: SLSAProvenanceType,
+		Predicate: Provenance{
+			BuildDefinition: BuildDefinition{
+				BuildType:            ProvenanceBuildType,
+				ExternalParameters:   m.BuildOptions,
+				InternalParameters:   m.BuildDetails,
+				ResolvedDependencies: resourceDescriptors(m.Inputs),
+			},
+			RunDetails: RunDetails{
+				Builder: ProvenanceBuilder{
+					ID: ProvenanceBuilderID,
+					Version: map[string]string{
+						"ukify":     m.Ukify.Version,
+						"gitCommit": m.Ukify.GitCommit,
+						"go":        m.Ukify.GoVersion,
+					},
+				},
+			},
+		},
+	}
+
+	return statement
+}
+
+// Manifest returns the manifest the statement was made from.
+func (s *Statement) Manifest() (*Manifest, error) {
+	if s.Type != InTotoStatementType || s.PredicateType != SLSAProvenanceType {
+		return nil, fmt.Errorf("unsupported statement %s with predicate %s", s.Type, s.PredicateType)
+	}
+	if buildType := s.Predicate.BuildDefinition.BuildType; buildType != ProvenanceBuildType {
+		return nil, fmt.Errorf("unsupported build type %s", buildType)
+	}
+
+	version := s.Predicate.RunDetails.Builder.Version
+	m := &Manifest{
+		BuildOptions: s.Predicate.BuildDefinition.ExternalParameters,
+		Inputs:       manifestFiles(s.Predicate.BuildDefinition.ResolvedDependencies),
+		Outputs:      manifestFiles(s.Subject),
+		BuildDetails: s.Predicate.BuildDefinition.InternalParameters,
+	}
+	m.Ukify.Version = version["ukify"]
+	m.Ukify.GitCommit = version["gitCommit"]
+	m.Ukify.GoVersion = version["go"]
+
+	return m, nil
+}
+
+func resourceDescriptors(files []ManifestFile) []ResourceDescriptor {
+	descriptors := make([]ResourceDescriptor, 0, len(files))
+	for _, file := range files {
+		descriptors = append(descriptors, ResourceDescriptor{
+			Name:        file.Name,
+			Digest:      map[string]string{"sha256": file.SHA256},
+			Annotations: map[string]string{"path": file.Path},
+		})
+	}
+	return descriptors
+}
+
+func manifestFiles(descriptors []ResourceDescriptor) []ManifestFile {
+	files := make([]ManifestFile, 0, len(descriptors))
+	for _, descriptor := range descriptors {
+		files = append(files, ManifestFile{
+			Name:   descriptor.Name,
+			Path:   descriptor.Annotations["path"],
+			SHA256: descriptor.Digest["sha256"],
+		})
+	}
+	return files
+}
@@ -7,9 +7,16 @@ package uki
 import (
 	"debug/pe"
 	"errors"
+	"fmt"
 	"github.com/kairos-io/go-ukify/pkg/constants"
+	"log/slog"
+	"strconv"
+	"strings"
 )
 
+// ErrNoSBAT is returned by GetSBAT for PE files without an SBAT section.
+var ErrNoSBAT = errors.New("could not find SBAT section")
+
 // GetSBAT returns the SBAT section from the PE file.
 func GetSBAT(path string) ([]byte, error) {
 	pefile, err := pe.Open(path)
@@ -26,9 +33,161 @@ func GetSBAT(path string) ([]byte, error) {
 				return nil, err
 			}
 
-			return data[:section.VirtualSize], nil
+			return data[:min(section.VirtualSize, uint32(len(data)))], nil
+		}
+	}
+
+	return nil, ErrNoSBAT
+}
+
+// SBATHeader is the entry SBAT sections start with, the version of the SBAT format itself.
+const SBATHeader = "sbat,1,SBAT Version,sbat,1,https://github.com/rhboot/shim/blob/main/SBAT.md"
+
+// SBATEntry is an entry of an SBAT section: a component, its generation and who ships it.
+//
+// ref: https://github.com/rhboot/shim/blob/main/SBAT.md
+type SBATEntry struct {
+	Component     string
+	Generation    int
+	VendorName    string
+	VendorPackage string
+	VendorVersion string
+	VendorURL     string
+}
+
+// String returns the entry as a line of an SBAT section.
+func (e SBATEntry) String() string {
+	return strings.Join([]string{e.Component, strconv.Itoa(e.Generation), e.VendorName, e.VendorPackage, e.VendorVersion, e.VendorURL}, ",")
+}
+
+// ParseSBAT parses the contents of an SBAT section, an entry per line in the
+// component_name,component_generation,vendor_name,vendor_package_name,vendor_version,vendor_url form.
+func ParseSBAT(data []byte) ([]SBATEntry, error) {
+	var entries []SBATEntry
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\x00"), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		fields := strings.SplitN(line, ",", 6)
+		if len(fields) != 6 || fields[0] == "" {
+			return nil, fmt.Errorf("invalid SBAT entry %q, expected 6 fields", line)
+		}
+		generation, err := strconv.Atoi(fields[1])
+		if err != nil || generation < 1 {
+			return nil, fmt.Errorf("invalid SBAT entry %q, generation is not a positive number", line)
+		}
+
+		entries = append(entries, SBATEntry{
+			Component:     fields[0],
+			Generation:    generation,
+			VendorName:    fields[2],
+			VendorPackage: fields[3],
+			VendorVersion: fields[4],
+			VendorURL:     fields[5],
+		})
+	}
+
+	return entries, nil
+}
+
+// MergeSBAT returns the contents of an SBAT section with the entries of the given sources, in order, after
+// SBATHeader.
+//
+// A component shows up once. If a later source has it again, the later entry wins unless it has a lower
+// generation, so a vendor can bump the generation of a component of the stub or the kernel. A component with
+// different generations within the same source is an error.
+func MergeSBAT(sources ...[]SBATEntry) ([]byte, error) {
+	var merged []SBATEntry
+	index := map[string]int{}
+	for _, source := range sources {
+		generations := map[string]int{}
+		for _, entry := range source {
+			// the header is already there
+			if entry.Component == "sbat" {
+				continue
+			}
+			if generation, ok := generations[entry.Component]; ok && generation != entry.Generation {
+				return nil, fmt.Errorf("SBAT component %s has generations %d and %d", entry.Component, generation, entry.Generation)
+			}
+			generations[entry.Component] = entry.Generation
+
+			i, ok := index[entry.Component]
+			switch {
+			case !ok:
+				index[entry.Component] = len(merged)
+				merged = append(merged, entry)
+			case entry.Generation < merged[i].Generation:
+				slog.Warn("Ignoring SBAT entry with a lower generation", "component", entry.Component,
+					"generation", entry.Generation, "kept", merged[i].Generation)
+			default:
+				if entry.Generation > merged[i].Generation {
+					slog.Info("Bumping SBAT generation", "component", entry.Component,
+						"from", merged[i].Generation, "to", entry.Generation)
+				}
+				merged[i] = entry
+			}
+		}
+	}
+
+	lines := []string{SBATHeader}
+	for _, entry := range merged {
+		lines = append(lines, entry.String())
+	}
+
+	// NUL terminated, as the stubs ship it
+	return []byte(strings.Join(lines, "\n") + "\n\x00"), nil
+}
+
+// SBATRevocation is an entry of an SBAT level, like shim's SbatLevel: the component is revoked below Generation.
+type SBATRevocation struct {
+	Component  string
+	Generation int
+}
+
+// ParseSBATLevel parses an SBAT level, a revocation per line in the component_name,component_generation form.
+// Further fields, like the date of the sbat entry, are ignored, as are empty lines and # comments.
+func ParseSBATLevel(data []byte) ([]SBATRevocation, error) {
+	var revocations []SBATRevocation
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\x00"), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, ",")
+		if len(fields) < 2 || fields[0] == "" {
+			return nil, fmt.Errorf("invalid SBAT revocation %q, expected COMPONENT,GENERATION", line)
+		}
+		generation, err := strconv.Atoi(fields[1])
+		if err != nil || generation < 1 {
+			return nil, fmt.Errorf("invalid SBAT revocation %q, generation is not a positive number", line)
+		}
+
+		revocations = append(revocations, SBATRevocation{Component: fields[0], Generation: generation})
+	}
+
+	return revocations, nil
+}
+
+// SBATRefusal is an SBAT entry refused by a revocation.
+type SBATRefusal struct {
+	Entry      SBATEntry
+	Revocation SBATRevocation
+}
+
+// CheckSBAT returns the entries the SBAT level refuses, the ones with a lower generation than the revocation
+// of their component, as shim does.
+func CheckSBAT(entries []SBATEntry, level []SBATRevocation) []SBATRefusal {
+	var refusals []SBATRefusal
+	for _, entry := range entries {
+		for _, revocation := range level {
+			if entry.Component == revocation.Component && entry.Generation < revocation.Generation {
+				refusals = append(refusals, SBATRefusal{Entry: entry, Revocation: revocation})
+			}
 		}
 	}
 
-	return nil, errors.New("could not find SBAT section")
+	return refusals
 }
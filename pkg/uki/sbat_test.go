@@ -0,0 +1,128 @@
+package uki
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SBAT", func() {
+	const kairos = "kairos,1,Kairos,kairos,3.0,https://kairos.io"
+
+	It("Parses SBAT sections", func() {
+		entries, err := ParseSBAT([]byte(SBATHeader + "\n" + kairos + "\n\x00"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(Equal([]SBATEntry{
+			{Component: "sbat", Generation: 1, VendorName: "SBAT Version", VendorPackage: "sbat", VendorVersion: "1", VendorURL: "https://github.com/rhboot/shim/blob/main/SBAT.md"},
+			{Component: "kairos", Generation: 1, VendorName: "Kairos", VendorPackage: "kairos", VendorVersion: "3.0", VendorURL: "https://kairos.io"},
+		}))
+		Expect(entries[1].String()).To(Equal(kairos))
+	})
+
+	It("Rejects invalid entries", func() {
+		for _, sbat := range []string{"kairos,1", "kairos,0,Kairos,kairos,3.0,https://kairos.io", ",1,Kairos,kairos,3.0,https://kairos.io"} {
+			_, err := ParseSBAT([]byte(sbat))
+			Expect(err).To(HaveOccurred(), sbat)
+		}
+	})
+
+	It("Merges entries once, after the header", func() {
+		stub, err := ParseSBAT([]byte(SBATHeader + "\nsystemd,1,The systemd Developers,systemd,254,https://systemd.io/\n"))
+		Expect(err).ToNot(HaveOccurred())
+		user, err := ParseSBAT([]byte(kairos + "\nsystemd,1,The systemd Developers,systemd,254,https://systemd.io/"))
+		Expect(err).ToNot(HaveOccurred())
+
+		merged, err := MergeSBAT(stub, user)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(merged)).To(Equal(SBATHeader + "\nsystemd,1,The systemd Developers,systemd,254,https://systemd.io/\n" + kairos + "\n\x00"))
+
+		// later sources bump the generation, but can't lower it
+		bumped, err := ParseSBAT([]byte("systemd,2,The systemd Developers,systemd,255,https://systemd.io/"))
+		Expect(err).ToNot(HaveOccurred())
+		merged, err = MergeSBAT(stub, bumped, user)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(merged)).To(Equal(SBATHeader + "\nsystemd,2,The systemd Developers,systemd,255,https://systemd.io/\n" + kairos + "\n\x00"))
+
+		conflicting, err := ParseSBAT([]byte("systemd,2,The systemd Developers,systemd,255,https://systemd.io/\nsystemd,3,The systemd Developers,systemd,256,https://systemd.io/"))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = MergeSBAT(stub, conflicting)
+		Expect(err).To(MatchError(ContainSubstring("systemd has generations 2 and 3")))
+	})
+
+	It("Reports the entries an SBAT level refuses", func() {
+		level, err := ParseSBATLevel([]byte("sbat,1,2023012900\n# revocations\nshim,2\nsystemd,2\n"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(level).To(Equal([]SBATRevocation{{Component: "sbat", Generation: 1}, {Component: "shim", Generation: 2}, {Component: "systemd", Generation: 2}}))
+
+		sbat, err := GetSBAT("../pesign/testdata/file.efi")
+		Expect(err).ToNot(HaveOccurred())
+		entries, err := ParseSBAT(sbat)
+		Expect(err).ToNot(HaveOccurred())
+
+		refusals := CheckSBAT(entries, level)
+		Expect(refusals).To(HaveLen(1))
+		Expect(refusals[0].Entry.Component).To(Equal("systemd"))
+		Expect(refusals[0].Revocation.Generation).To(Equal(2))
+
+		Expect(CheckSBAT(entries, level[:2])).To(BeEmpty())
+
+		_, err = ParseSBATLevel([]byte("shim"))
+		Expect(err).To(HaveOccurred())
+	})
+
+	Describe("Builder", func() {
+		var builder *Builder
+
+		BeforeEach(func() {
+			stub, err := os.ReadFile("../pesign/testdata/file.efi")
+			Expect(err).ToNot(HaveOccurred())
+			builder = &Builder{
+				SdStubData: Bytes(stub),
+				KernelData: Bytes(make([]byte, 4096)),
+				InitrdData: Bytes([]byte("initrd")),
+			}
+		})
+
+		It("Rewrites the stub .sbat with the extra entries and measures it", func() {
+			builder.SBAT = []string{kairos}
+			plan, err := builder.Plan(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			defer plan.Close()
+
+			description, err := plan.Describe()
+			Expect(err).ToNot(HaveOccurred())
+			result, err := builder.Execute(context.Background(), plan)
+			Expect(err).ToNot(HaveOccurred())
+
+			planned := map[string]PlannedSection{}
+			for _, section := range description.Sections {
+				planned[section.Name] = section
+			}
+			sbat := string(constants.SBAT)
+			Expect(planned[sbat].Measured).To(BeTrue())
+			Expect(result.Sections).To(ContainElement(And(HaveField("Name", sbat), HaveField("SHA256", planned[sbat].SHA256))))
+
+			path := filepath.Join(GinkgoT().TempDir(), "uki.efi")
+			Expect(os.WriteFile(path, result.UKI, 0o600)).ToNot(HaveOccurred())
+			data, err := GetSBAT(path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(HavePrefix(SBATHeader + "\nsystemd,"))
+			Expect(string(data)).To(HaveSuffix("\n" + kairos + "\n\x00"))
+		})
+
+		It("Fails if the stub has no room for the entries", func() {
+			builder.SBAT = []string{kairos}
+			for i := range 64 {
+				builder.SBAT = append(builder.SBAT, strings.Replace(kairos, "kairos,", "kairos"+strings.Repeat("x", i+1)+",", 1))
+			}
+			_, err := builder.Plan(context.Background())
+			Expect(err).To(MatchError(ContainSubstring("the sd-stub only has room for")))
+		})
+	})
+})
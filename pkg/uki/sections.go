@@ -0,0 +1,48 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"debug/pe"
+	"fmt"
+	"slices"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+)
+
+// GetMeasuredSections returns the contents of the sections of a UKI that the stub measures into PCR 11.
+func GetMeasuredSections(path string) (map[constants.Section][]byte, error) {
+	pefile, err := pe.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer pefile.Close() //nolint:errcheck
+
+	sections := map[constants.Section][]byte{}
+	for _, section := range pefile.Sections {
+		name := constants.Section(section.Name)
+		if !slices.Contains(constants.OrderedSections(), name) {
+			continue
+		}
+
+		data, err := section.Data()
+		if err != nil {
+			return nil, fmt.Errorf("failed reading section %s: %w", name, err)
+		}
+
+		// The raw data is padded to the file alignment, the stub only measures the virtual size
+		if size := int(section.VirtualSize); size < len(data) {
+			data = data[:size]
+		}
+		sections[name] = data
+	}
+
+	if _, ok := sections[constants.Linux]; !ok {
+		return nil, fmt.Errorf("%s has no %s section, is it a UKI?", path, constants.Linux)
+	}
+
+	return sections, nil
+}
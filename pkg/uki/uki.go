@@ -6,17 +6,28 @@
 package uki
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
+	"github.com/google/go-tpm/tpm2"
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/pcrlock"
 	"github.com/kairos-io/go-ukify/pkg/pesign"
 	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/utils"
 )
 
 // Builder is a UKI file builder.
+//
+// Building doesn't modify the Builder, so it can be reused, and build concurrently.
 type Builder struct {
 	// Source options.
 	//
@@ -36,8 +47,18 @@ type Builder struct {
 	Cmdline string
 	// Os-release file
 	OsRelease string
+	// Inputs given in memory, instead of the paths above. Giving both the path and the contents of an input
+	// is an error.
+	SdStubData    Input
+	SdBootData    Input
+	KernelData    Input
+	InitrdData    Input
+	OsReleaseData Input
+	SplashData    Input
 	// Phases to measure for
 	Phases []types.PhaseInfo
+	// Additional phase paths, each measured independently of Phases and signed at every step
+	PhasePaths [][]types.PhaseInfo
 
 	// SecureBoot certificate and signer.
 	SecureBootSigner *pesign.Signer
@@ -50,146 +71,292 @@ type Builder struct {
 	PCRSigner types.RSAKey
 	// Path to the PCR signing key
 	PCRKey string
+	// Additional PCR signing keys, each restricted to a set of phases.
+	// The first key used to sign, starting with PCRSigner/PCRKey, is the one embedded in .pcrpkey
+	PCRKeys []types.PCRKey
+	// PCR banks to measure and sign, all the supported ones if empty
+	PCRBanks []tpm2.TPMAlgID
+	// Extra PCRs bound into the signed policies together with the UKI PCR
+	PolicyPCRs []types.PolicyPCR
+	// Maximum number of signatures computed at the same time, one per CPU if 0.
+	// Policies for different banks and phases, and the sd-boot and UKI Authenticode signatures, are independent.
+	SigningWorkers int
 
 	Splash string
 
+	// SBAT entries, as CSV, merged with the ones of the sd-stub and the kernel into the .sbat section.
+	SBAT []string
+
+	// Sections added to the UKI out of files, after the generated ones but the kernel.
+	ExtraSections []types.ExtraSection
+
+	// Generators of additional sections for this build, on top of the built-in and registered ones.
+	SectionGenerators []SectionGenerator
+
+	// Time recorded as the UKI TimeDateStamp and as the signing time of its signatures, for reproducible builds.
+	// If nil, SOURCE_DATE_EPOCH is used if set, otherwise the UKI keeps the sd-stub TimeDateStamp and the
+	// signatures carry no signing time.
+	SourceDateEpoch *time.Time
+
 	// Output options:
 	//
-	// Path to the signed sd-boot.
+	// Path to the signed sd-boot. If empty, it is returned in BuildResult.SdBoot instead.
 	OutSdBootPath string
-	// Path to the output UKI file.
+	// Path to the output UKI file. If empty, it is returned in BuildResult.UKI instead.
 	OutUKIPath string
+	// Directory to write the systemd-pcrlock files for the UKI to, none are written if empty.
+	OutPCRLockDir string
+	// Path to write the build manifest to, used to reproduce the build. None is written if empty.
+	OutManifestPath string
+	// Format of the manifest, ManifestFormatJSON or ManifestFormatInToto. Defaults to ManifestFormatJSON.
+	ManifestFormat string
+}
 
-	// fields initialized during build
-	sections        []types.UkiSection
-	scratchDir      string
-	unsignedUKIPath string
+// BuildResult is what a build produced.
+type BuildResult struct {
+	// Path the UKI was written to, empty if it was returned in UKI.
+	UKIPath string
+	// Contents of the UKI, only if OutUKIPath was empty.
+	UKI []byte
+	// Path the signed sd-boot was written to, empty if it was returned in SdBoot or sd-boot wasn't signed.
+	SdBootPath string
+	// Contents of the signed sd-boot, only if OutSdBootPath was empty.
+	SdBoot []byte
+
+	BuildDetails
+}
+
+// buildFiles are the files the outputs end up at during the build.
+type buildFiles struct {
+	uki    string
+	sdBoot string
 }
 
 // Build the UKI file.
 //
 // Build process is as follows:
+//   - plan the build: build ephemeral sections (uname, os-release), and other proposed sections, lay them
+//     out and predict their measurements
 //   - sign the sd-boot EFI binary, and write it to the OutSdBootPath
-//   - build ephemeral sections (uname, os-release), and other proposed sections
 //   - measure sections, generate signature, and append to the list of sections
 //   - assemble the final UKI file starting from sd-stub and appending generated section.
 func (builder *Builder) Build() error {
-	var err error
-
-	// Check if we got any phases
-	if len(builder.Phases) == 0 {
-		// use default phases
-		builder.Phases = types.OrderedPhases()
-	}
+	_, err := builder.BuildContext(context.Background())
+	return err
+}
 
-	if builder.PCRSigner == nil {
-		if builder.PCRKey != "" {
-			signer, err := pesign.NewPCRSigner(builder.PCRKey)
-			if err != nil {
-				return err
-			}
-			builder.PCRSigner = signer
-		}
+// BuildContext is like Build, but stops as soon as possible once ctx is done, and returns what was built.
+func (builder *Builder) BuildContext(ctx context.Context) (*BuildResult, error) {
+	plan, err := builder.Plan(ctx)
+	if err != nil {
+		return nil, err
 	}
+	defer plan.Close()
 
-	// Try to generate a signer base on our given args
-	// If we have a	either a signer or key/cert
-	// Try to use first the signer as we can use a custom signed passed in the struct
-	// otherwise create a new default signer with the key and cert
-	if builder.sbSignEnabled() {
-		if builder.SecureBootSigner == nil {
-			if builder.SBCert != "" && builder.SBKey != "" {
-				sb, err := pesign.NewSecureBootSigner(builder.SBCert, builder.SBKey)
-				if err != nil {
-					return err
-				}
-				sbSigner, err := pesign.NewSigner(sb)
-				if err != nil {
-					return err
-				}
-				builder.SecureBootSigner = sbSigner
-			}
-		}
-	}
+	return builder.Execute(ctx, plan)
+}
 
-	builder.scratchDir, err = os.MkdirTemp("", "ukify")
+// Execute builds the plan, writing the outputs as set in the output options of the builder. The rest of the
+// options are the ones the plan was made with.
+//
+// Executions don't share any state, a plan can be executed concurrently by one or more builders, as long
+// as they don't write to the same outputs.
+func (builder *Builder) Execute(ctx context.Context, plan *Plan) (*BuildResult, error) {
+	scratchDir, err := os.MkdirTemp("", "ukify")
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	defer func() {
-		if err = os.RemoveAll(builder.scratchDir); err != nil {
+		if err := os.RemoveAll(scratchDir); err != nil {
 			log.Printf("failed to remove scratch dir: %v", err)
 		}
 	}()
 
-	// Sign sd-boot if given and signing is enabled
-	if builder.SdBootPath != "" && builder.sbSignEnabled() {
-		slog.Info("Signing systemd-boot", "path", builder.SdBootPath)
+	config := &plan.config
+	pool := utils.NewPool(builder.SigningWorkers)
+	signatures := pool.Group()
 
-		// sign sd-boot
-		if err = builder.SecureBootSigner.Sign(builder.SdBootPath, builder.OutSdBootPath); err != nil {
-			return fmt.Errorf("error signing sd-boot: %w", err)
-		}
+	result := &BuildResult{}
+	var files buildFiles
+
+	// Sign sd-boot if given and signing is enabled, while the UKI is being built
+	if plan.inputs.sdBoot != "" && config.sbSignEnabled() {
+		slog.Info("Signing systemd-boot", "path", plan.inputs.sdBoot)
 
-		slog.Info("Signed systemd-boot", "path", builder.OutSdBootPath)
+		result.SdBootPath = builder.OutSdBootPath
+		sdBootFile := outputFile(builder.OutSdBootPath, scratchDir, "sdboot.signed.efi")
+		files.sdBoot = sdBootFile
+		signatures.Go(func() error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			// sign sd-boot
+			if err := config.SecureBootSigner.SignAt(plan.inputs.sdBoot, sdBootFile, config.signingTime()); err != nil {
+				return fmt.Errorf("error signing sd-boot: %w", err)
+			}
+
+			slog.Info("Signed systemd-boot", "path", sdBootFile)
+			return nil
+		})
 	} else {
 		slog.Info("Not signing systemd-boot")
 	}
 
-	slog.Info("Generating UKI sections")
-
-	// generate and build list of all sections
-	for _, generateSection := range []func() error{
-		builder.generateOSRel,
-		builder.generateCmdline,
-		builder.generateInitrd,
-		builder.generateSplash,
-		builder.generateUname,
-		builder.generateSBAT,
-		builder.generatePCRPublicKey,
-		// append kernel last to account for decompression
-		builder.generateKernel,
-		// measure sections last
-		builder.generatePCRSig,
-	} {
-		if err = generateSection(); err != nil {
-			return fmt.Errorf("error generating sections: %w", err)
+	files.uki, err = builder.buildUKI(ctx, plan, scratchDir, pool, signatures)
+
+	// wait for the signatures even if building failed, the UKI one reads from the scratch dir
+	if err = errors.Join(err, signatures.Wait()); err != nil {
+		return nil, err
+	}
+
+	if builder.OutUKIPath != "" {
+		result.UKIPath = files.uki
+	}
+
+	if result.BuildDetails, err = plan.details(files.uki); err != nil {
+		return nil, fmt.Errorf("error describing UKI: %w", err)
+	}
+
+	if builder.OutPCRLockDir != "" {
+		if err = builder.writePCRLock(plan, files.uki); err != nil {
+			return nil, fmt.Errorf("error writing pcrlock files: %w", err)
 		}
 	}
 
-	slog.Info("Generated UKI sections")
+	if builder.OutManifestPath != "" {
+		manifest, err := plan.manifest(result, files)
+		if err != nil {
+			return nil, fmt.Errorf("error generating manifest: %w", err)
+		}
+		if err = manifest.Write(builder.OutManifestPath, builder.ManifestFormat); err != nil {
+			return nil, fmt.Errorf("error writing manifest: %w", err)
+		}
+		slog.Info("Wrote manifest", "path", builder.OutManifestPath)
+	}
+
+	// outputs not written to a path are returned before the scratch dir is removed
+	if builder.OutUKIPath == "" {
+		if result.UKI, err = os.ReadFile(files.uki); err != nil {
+			return nil, err
+		}
+	}
+	if files.sdBoot != "" && builder.OutSdBootPath == "" {
+		if result.SdBoot, err = os.ReadFile(files.sdBoot); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// buildUKI signs the measurements of the planned sections, assembles them and signs the UKI on the
+// signatures group if signing is enabled. It returns the path the UKI ends up at.
+func (builder *Builder) buildUKI(ctx context.Context, plan *Plan, scratchDir string, pool *utils.Pool, signatures *utils.Group) (string, error) {
+	config := &plan.config
+	sections := slices.Clone(plan.sections)
+
+	// measure sections last
+	pcrSig, err := plan.generatePCRSig(scratchDir, pool)
+	if err != nil {
+		return "", fmt.Errorf("error generating sections: %w", err)
+	}
+	if pcrSig != nil {
+		sections = append(sections, *pcrSig)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
 
 	slog.Info("Assembling UKI")
 
 	// assemble the final UKI file
-	if err = builder.assemble(); err != nil {
-		return fmt.Errorf("error assembling UKI: %w", err)
+	unsignedUKIPath := filepath.Join(scratchDir, "unsigned.uki")
+	if err := assemble(unsignedUKIPath, plan.inputs.sdStub, sections, config.SourceDateEpoch); err != nil {
+		return "", fmt.Errorf("error assembling UKI: %w", err)
 	}
 
 	slog.Info("Assembled UKI")
 
 	// sign the UKI file if signing is enabled
-	if builder.sbSignEnabled() {
+	if config.sbSignEnabled() {
 		slog.Info("Signing UKI")
-		err = builder.SecureBootSigner.Sign(builder.unsignedUKIPath, builder.OutUKIPath)
-		if err == nil {
-			slog.Info(fmt.Sprintf("Signed UKI at %s", builder.OutUKIPath))
-		}
-	} else {
-		// Move it to final place as we will remove the scratch dir
-		fileRead, err := os.ReadFile(builder.unsignedUKIPath)
-		if err != nil {
-			return err
-		}
-		err = os.WriteFile(strings.Replace(builder.OutUKIPath, "signed", "unsigned", -1), fileRead, os.ModePerm)
-		if err != nil {
-			return err
-		}
-		slog.Info(fmt.Sprintf("Unsigned UKI at %s", strings.Replace(builder.OutUKIPath, "signed", "unsigned", -1)))
+		outUKIPath := outputFile(builder.OutUKIPath, scratchDir, "uki.signed.efi")
+		signatures.Go(func() error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := config.SecureBootSigner.SignAt(unsignedUKIPath, outUKIPath, config.signingTime()); err != nil {
+				return err
+			}
+			slog.Info(fmt.Sprintf("Signed UKI at %s", outUKIPath))
+			return nil
+		})
+		return outUKIPath, nil
 	}
 
-	return err
+	if builder.OutUKIPath == "" {
+		return unsignedUKIPath, nil
+	}
+
+	// Move it to final place as we will remove the scratch dir
+	outUKIPath := strings.Replace(builder.OutUKIPath, "signed", "unsigned", -1)
+	fileRead, err := os.ReadFile(unsignedUKIPath)
+	if err != nil {
+		return "", err
+	}
+	err = os.WriteFile(outUKIPath, fileRead, os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+	slog.Info(fmt.Sprintf("Unsigned UKI at %s", outUKIPath))
+
+	return outUKIPath, nil
+}
+
+// outputFile returns the path to write an output to, in the scratch dir if it is returned in memory
+func outputFile(path, scratchDir, name string) string {
+	if path == "" {
+		return filepath.Join(scratchDir, name)
+	}
+	return path
+}
+
+// writePCRLock writes the systemd-pcrlock files for the UKI sections and the final UKI PE
+func (builder *Builder) writePCRLock(plan *Plan, ukiPath string) error {
+	sections, err := pcrlock.UKISections(utils.SectionsData(plan.sections), plan.config.PCRBanks)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(builder.OutPCRLockDir, pcrlock.UKISectionsFile)
+	if err = sections.Write(path); err != nil {
+		return err
+	}
+	slog.Info("Wrote pcrlock file", "path", path, "pcr", constants.UKIPCR)
+
+	authenticode, err := pcrlock.Authenticode(ukiPath, plan.config.PCRBanks)
+	if err != nil {
+		return err
+	}
+
+	path = filepath.Join(builder.OutPCRLockDir, pcrlock.UKIAuthenticodeFile)
+	if err = authenticode.Write(path); err != nil {
+		return err
+	}
+	slog.Info("Wrote pcrlock file", "path", path, "pcr", constants.BootLoaderCodePCR)
+
+	return nil
+}
+
+// signingTime returns the signing time to record in the Authenticode signatures, none if zero
+func (builder *Builder) signingTime() time.Time {
+	if builder.SourceDateEpoch == nil {
+		return time.Time{}
+	}
+	return *builder.SourceDateEpoch
 }
 
 // sbSignEnabled let us know if we have to sign the sd-boot and uki final file
@@ -201,5 +368,19 @@ func (builder *Builder) sbSignEnabled() bool {
 // pcrSignEnabled let us know if we have to sign the measurements
 // Checks if we have a pcr signer or a pcrkey
 func (builder *Builder) pcrSignEnabled() bool {
-	return builder.PCRSigner != nil || builder.PCRKey != ""
+	return builder.PCRSigner != nil || builder.PCRKey != "" || len(builder.PCRKeys) > 0
+}
+
+// phasePaths returns all the phase paths to measure, starting with Phases
+func (builder *Builder) phasePaths() [][]types.PhaseInfo {
+	return append([][]types.PhaseInfo{builder.Phases}, builder.PhasePaths...)
+}
+
+// pcrKeys returns all the PCR signing keys, the single PCRSigner signing all phases first
+func (builder *Builder) pcrKeys() []types.PCRKey {
+	var keys []types.PCRKey
+	if builder.PCRSigner != nil {
+		keys = append(keys, types.PCRKey{Signer: builder.PCRSigner})
+	}
+	return append(keys, builder.PCRKeys...)
 }
@@ -0,0 +1,204 @@
+package uki
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/types"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Builder", func() {
+	var stub []byte
+	var kernel []byte
+	var epoch time.Time
+
+	newBuilder := func() *Builder {
+		return &Builder{
+			SdStubData:      Bytes(stub),
+			SdBootData:      Bytes(stub),
+			KernelData:      Bytes(kernel),
+			InitrdData:      Bytes([]byte("initrd")),
+			Cmdline:         "console=ttyS0",
+			SBKey:           "../pesign/testdata/sb.key",
+			SBCert:          "../pesign/testdata/sb.pem",
+			PCRKey:          "../measure/pcr/testdata/private.pem",
+			SourceDateEpoch: &epoch,
+		}
+	}
+
+	BeforeEach(func() {
+		var err error
+		stub, err = os.ReadFile("../pesign/testdata/file.efi")
+		Expect(err).ToNot(HaveOccurred())
+		kernel = make([]byte, 4096)
+		for i := range kernel {
+			kernel[i] = byte(i)
+		}
+		epoch = time.Unix(1700000000, 0).UTC()
+	})
+
+	It("Builds from in-memory inputs and returns the outputs", func() {
+		result, err := newBuilder().BuildContext(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.UKIPath).To(BeEmpty())
+		Expect(result.UKI).ToNot(BeEmpty())
+		Expect(result.SdBootPath).To(BeEmpty())
+		Expect(result.SdBoot).ToNot(BeEmpty())
+
+		kernelSum := sha256.Sum256(kernel)
+		Expect(result.Sections).To(ContainElement(HaveField("Name", string(constants.Linux))))
+		for _, section := range result.Sections {
+			if section.Name == string(constants.Linux) {
+				Expect(section.SHA256).To(Equal(hex.EncodeToString(kernelSum[:])))
+				Expect(section.Measured).To(BeTrue())
+			}
+		}
+		Expect(result.PCRs).To(HaveKey("sha256"))
+		// one prediction per step of the default phases
+		Expect(result.PCRs["sha256"]).To(HaveLen(len(types.OrderedPhases())))
+		Expect(result.Signing.SecureBootCertificate).ToNot(BeEmpty())
+		Expect(result.Signing.PCRKeys).To(HaveLen(1))
+
+		// the same inputs give the same UKI
+		again, err := newBuilder().BuildContext(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(again.UKI).To(Equal(result.UKI))
+		Expect(again.SdBoot).To(Equal(result.SdBoot))
+	})
+
+	It("Writes the outputs to the given paths", func() {
+		dir := GinkgoT().TempDir()
+		builder := newBuilder()
+		builder.OutUKIPath = filepath.Join(dir, "uki.signed.efi")
+		builder.OutSdBootPath = filepath.Join(dir, "sdboot.signed.efi")
+
+		result, err := builder.BuildContext(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.UKIPath).To(Equal(builder.OutUKIPath))
+		Expect(result.UKI).To(BeNil())
+		Expect(result.SdBootPath).To(Equal(builder.OutSdBootPath))
+		Expect(result.SdBoot).To(BeNil())
+
+		sections, err := GetMeasuredSections(result.UKIPath)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(sections[constants.Linux]).To(Equal(kernel))
+		Expect(sections[constants.CMDLine]).To(Equal([]byte("console=ttyS0")))
+	})
+
+	It("Stops when the context is done", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := newBuilder().BuildContext(ctx)
+		Expect(err).To(MatchError(context.Canceled))
+	})
+
+	It("Fails to plan a signed build with a source date epoch past 2049", func() {
+		builder := newBuilder()
+		late := time.Unix(2524608000, 0).UTC()
+		builder.SourceDateEpoch = &late
+
+		_, err := builder.Plan(context.Background())
+		Expect(err).To(MatchError(ContainSubstring("can't be recorded in a signature")))
+	})
+
+	It("Fails if an input is given both as a path and in memory", func() {
+		builder := newBuilder()
+		builder.KernelPath = "vmlinuz"
+
+		_, err := builder.BuildContext(context.Background())
+		Expect(err).To(MatchError(ContainSubstring("kernel given both as a path and in memory")))
+	})
+	It("Takes inputs from any io.ReaderAt and ignores nil pointers", func() {
+		path := filepath.Join(GinkgoT().TempDir(), "vmlinuz")
+		Expect(os.WriteFile(path, kernel, 0o600)).To(Succeed())
+		f, err := os.Open(path)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close() //nolint:errcheck
+
+		builder := newBuilder()
+		builder.KernelData = ReaderAt(f, int64(len(kernel)))
+		var splash *bytes.Reader
+		builder.SplashData = splash
+
+		result, err := builder.BuildContext(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		expected, err := newBuilder().BuildContext(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.UKI).To(Equal(expected.UKI))
+	})
+
+	Describe("Plan", func() {
+		It("Doesn't modify the builder", func() {
+			builder := newBuilder()
+			plan, err := builder.Plan(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			defer plan.Close()
+
+			Expect(builder.Phases).To(BeEmpty())
+			Expect(builder.PCRSigner).To(BeNil())
+			Expect(builder.SecureBootSigner).To(BeNil())
+		})
+
+		It("Lays out the sections where the UKI has them", func() {
+			plan, err := newBuilder().Plan(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			defer plan.Close()
+
+			description, err := plan.Describe()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(description.Sections[len(description.Sections)-1].Name).To(Equal(string(constants.PCRSig)))
+
+			result, err := newBuilder().Execute(context.Background(), plan)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.PCRs).To(Equal(description.PCRs))
+
+			built := map[string]ManifestSection{}
+			for _, section := range result.Sections {
+				built[section.Name] = section
+			}
+			for _, section := range description.Sections {
+				if !section.Appended || section.Name == string(constants.PCRSig) {
+					continue
+				}
+				Expect(built).To(HaveKey(section.Name))
+				Expect(built[section.Name].VirtualAddress).To(Equal(section.VirtualAddress), section.Name)
+				Expect(built[section.Name].SHA256).To(Equal(section.SHA256), section.Name)
+			}
+		})
+
+		It("Executes the same plan concurrently", func() {
+			plan, err := newBuilder().Plan(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			defer plan.Close()
+
+			results := make([]*BuildResult, 4)
+			errs := make([]error, 4)
+			done := make(chan struct{})
+			for i := range results {
+				go func() {
+					defer GinkgoRecover()
+					results[i], errs[i] = (&Builder{}).Execute(context.Background(), plan)
+					done <- struct{}{}
+				}()
+			}
+			for range results {
+				<-done
+			}
+
+			for i := range results {
+				Expect(errs[i]).ToNot(HaveOccurred())
+				Expect(results[i].UKI).To(Equal(results[0].UKI))
+			}
+		})
+	})
+})
@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+)
+
+// Pool bounds the number of tasks running at the same time across all the groups sharing it.
+//
+// It is used to run independent signatures concurrently, as remote or HSM backed signers make every
+// signature a round trip.
+type Pool struct {
+	slots chan struct{}
+}
+
+// NewPool returns a pool running at most workers tasks at the same time, or one per CPU if workers is 0 or less.
+func NewPool(workers int) *Pool {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	return &Pool{slots: make(chan struct{}, workers)}
+}
+
+// Workers returns the maximum number of tasks the pool runs at the same time.
+func (p *Pool) Workers() int {
+	return cap(p.slots)
+}
+
+// Group returns a new group of tasks running on the pool.
+func (p *Pool) Group() *Group {
+	return &Group{pool: p}
+}
+
+// Group runs tasks on a pool and collects their errors.
+//
+// Unlike errgroup, every task runs to completion and all the errors are reported, in the order the
+// tasks were started, so the result doesn't depend on scheduling.
+type Group struct {
+	pool *Pool
+	wg   sync.WaitGroup
+	mu   sync.Mutex
+	errs []error
+}
+
+// Go runs the task in the background once the pool has a free worker for it.
+func (g *Group) Go(task func() error) {
+	g.mu.Lock()
+	index := len(g.errs)
+	g.errs = append(g.errs, nil)
+	g.mu.Unlock()
+
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+
+		g.pool.slots <- struct{}{}
+		defer func() { <-g.pool.slots }()
+
+		err := task()
+
+		g.mu.Lock()
+		g.errs[index] = err
+		g.mu.Unlock()
+	}()
+}
+
+// Wait waits for all the tasks started so far and returns their errors joined, or nil if all of them succeeded.
+func (g *Group) Wait() error {
+	g.wg.Wait()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return errors.Join(g.errs...)
+}
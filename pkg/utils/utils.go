@@ -5,10 +5,15 @@ import (
 	"crypto"
 	"crypto/x509"
 	"errors"
+	"fmt"
 	"github.com/foxboron/go-uefi/authenticode"
 	"github.com/kairos-io/go-ukify/pkg/constants"
 	"github.com/kairos-io/go-ukify/pkg/types"
 	"log/slog"
+	"math"
+	"os"
+	"strconv"
+	"time"
 )
 
 // SectionsData transforms a []types.UkiSection into a map[constants.Section]string
@@ -50,3 +55,21 @@ func SignEFIExecutable(key crypto.Signer, cert *x509.Certificate, file []byte) (
 
 	return signedFile, nil
 }
+
+// SourceDateEpoch returns the time set in the SOURCE_DATE_EPOCH environment variable, or nil if not set.
+//
+// See https://reproducible-builds.org/specs/source-date-epoch/.
+func SourceDateEpoch() (*time.Time, error) {
+	value := os.Getenv("SOURCE_DATE_EPOCH")
+	if value == "" {
+		return nil, nil
+	}
+
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 || seconds > math.MaxUint32 {
+		return nil, fmt.Errorf("invalid SOURCE_DATE_EPOCH %q", value)
+	}
+
+	epoch := time.Unix(seconds, 0).UTC()
+	return &epoch, nil
+}
@@ -1,11 +1,15 @@
 package utils
 
 import (
+	"errors"
 	"github.com/kairos-io/go-ukify/pkg/constants"
 	"github.com/kairos-io/go-ukify/pkg/types"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -74,4 +78,69 @@ var _ = Describe("Utils tests", func() {
 			Expect(SectionsData(ukiSections)).To(Equal(expectedSections))
 		})
 	})
+	Describe("Pool", func() {
+		It("Never runs more tasks than workers at the same time", func() {
+			pool := NewPool(2)
+			Expect(pool.Workers()).To(Equal(2))
+
+			var running, peak atomic.Int32
+			group := pool.Group()
+			for range 10 {
+				group.Go(func() error {
+					current := running.Add(1)
+					for {
+						old := peak.Load()
+						if current <= old || peak.CompareAndSwap(old, current) {
+							break
+						}
+					}
+					time.Sleep(5 * time.Millisecond)
+					running.Add(-1)
+					return nil
+				})
+			}
+			Expect(group.Wait()).To(Succeed())
+			Expect(peak.Load()).To(BeNumerically("<=", 2))
+		})
+		It("Defaults to one worker per CPU", func() {
+			Expect(NewPool(0).Workers()).To(Equal(runtime.GOMAXPROCS(0)))
+		})
+		It("Returns all the errors in the order the tasks were started", func() {
+			errFirst, errSecond := errors.New("first"), errors.New("second")
+			group := NewPool(4).Group()
+			group.Go(func() error {
+				// finishes last
+				time.Sleep(20 * time.Millisecond)
+				return errFirst
+			})
+			group.Go(func() error { return nil })
+			group.Go(func() error { return errSecond })
+
+			err := group.Wait()
+			Expect(err).To(MatchError(errFirst))
+			Expect(err).To(MatchError(errSecond))
+			Expect(err.Error()).To(Equal("first\nsecond"))
+		})
+	})
+	Describe("SourceDateEpoch", func() {
+		It("Parses SOURCE_DATE_EPOCH", func() {
+			GinkgoT().Setenv("SOURCE_DATE_EPOCH", "1700000000")
+			epoch, err := SourceDateEpoch()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*epoch).To(Equal(time.Unix(1700000000, 0).UTC()))
+		})
+		It("Returns nil if SOURCE_DATE_EPOCH is not set", func() {
+			GinkgoT().Setenv("SOURCE_DATE_EPOCH", "")
+			epoch, err := SourceDateEpoch()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(epoch).To(BeNil())
+		})
+		It("Fails on values that don't fit a PE timestamp", func() {
+			for _, value := range []string{"yesterday", "-1", "4294967296"} {
+				GinkgoT().Setenv("SOURCE_DATE_EPOCH", value)
+				_, err := SourceDateEpoch()
+				Expect(err).To(HaveOccurred(), value)
+			}
+		})
+	})
 })